@@ -3,9 +3,11 @@ package main
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"sync"
 	"time"
 
 	"gossip_common"
@@ -14,8 +16,9 @@ import (
 )
 
 var (
-	recordDevice    *Recorder
-	playbackDevices = make(map[string]*Player)
+	recordDevice  *Recorder
+	playbackMixer *Mixer // Plays every participant through one device, nil when nothing is playing
+	mixerLock     sync.Mutex
 )
 
 // App struct
@@ -56,25 +59,53 @@ func (a *App) SaveSettings(settings Settings) error {
 }
 
 /**
- * LoadSettings loads settings from a file
+ * defaultSettings returns the settings used on first run and for keys missing from the settings file.
+ * @return Settings Default settings
+ */
+func defaultSettings() Settings {
+	return Settings{
+		SelectedTheme:      "wintry",
+		DefaultUsername:    "",
+		DefaultHost:        "",
+		DefaultPort:        "1720",
+		OpusBitrate:        defaultOpusBitrate,
+		OpusFrameSize:      defaultOpusFrameSize,
+		OpusFEC:            true,
+		EncryptMediaFrames: true,
+		InputMode:          inputModeVoice,
+		VADSensitivity:     vadDefaultSensitivity,
+		PushToTalkKey:      defaultPushToTalkKey,
+		PushToTalkRelease:  defaultPushToTalkRelease,
+		HighPassFilter:     true,
+		NoiseSuppression:   true,
+		EchoCancellation:   true,
+		VideoCodec:         videoCodecVP8,
+		VideoWidth:         defaultVideoWidth,
+		VideoHeight:        defaultVideoHeight,
+		VideoFramerate:     defaultVideoFramerate,
+		ScreenWidth:        defaultScreenShareWidth,
+		ScreenHeight:       defaultScreenShareHeight,
+		ScreenFramerate:    defaultScreenShareFramerate,
+		CallMode:           callModeAuto,
+		PeerGracePeriod:    defaultPeerGracePeriod,
+	}
+}
+
+/**
+ * LoadSettings loads settings from a file. Keys the file does not contain, such as ones added
+ * after it was saved, keep their default values.
  * @return Settings Loaded settings
  * @return error Error if any occurred during loading
  */
 func LoadSettings() (Settings, error) {
-	var settings Settings
+	settings := defaultSettings()
 	data, err := ioutil.ReadFile(filepath.Join(os.TempDir(), "gossip_settings.json"))
 	if err != nil {
 		if os.IsNotExist(err) {
 			// If the file does not exist, create it with default settings
-			defaultSettings := Settings{
-				SelectedTheme:   "wintry",
-				DefaultUsername: "",
-				DefaultHost:     "",
-				DefaultPort:     "1720",
-			} // Assuming default settings are handled in the Settings struct
-			data, _ := json.Marshal(defaultSettings)
+			data, _ := json.Marshal(settings)
 			ioutil.WriteFile(filepath.Join(os.TempDir(), "gossip_settings.json"), data, 0644)
-			return defaultSettings, nil
+			return settings, nil
 		}
 		return settings, err
 	}
@@ -111,14 +142,18 @@ func (a *App) Boot(chost string, cport int, cusername string, cpassword string)
 	password = gossip_common.HashPassword(cpassword)
 
 	runtime.EventsEmit(a.ctx, "update-loading-status", "Starting connection...")
+	clearServerICEServers()
 
-	conn, writer = bootstrap(a) // Establish a connection (function not provided)
+	newConn, newWriter := bootstrap(a) // Establish a connection (function not provided)
+	writerLock.Lock()
+	conn, writer = newConn, newWriter
+	writerLock.Unlock()
 	if conn != nil {
 		defer conn.Close() // Close the connection when the function returns
 
 		runtime.EventsEmit(a.ctx, "update-loading-status", "Sending greeting to server...")
 
-		go handleResponses(conn, writer, a) // Handle responses in a separate goroutine (function not provided)
+		go handleResponses(conn, a) // Handle responses in a separate goroutine (function not provided)
 
 		select {} // Block the main goroutine indefinitely
 	}
@@ -127,37 +162,31 @@ func (a *App) Boot(chost string, cport int, cusername string, cpassword string)
 }
 
 /**
- * SendMessage sends an encrypted message to all clients
+ * SendMessage sends an encrypted message to a channel
  * @param message The message to send
  * @param expiry Expiry time of the message
+ * @param channel The channel to send the message to
  * @return error Error if any occurred during message sending
  */
 func (a *App) SendMessage(message string, expiry int64, channel string) error {
-	// Refresh the slice of public keys from the map
-	publicKeysSlice := make([][]byte, 0, len(publicKeys))
-	for _, publicKey := range publicKeys {
-		publicKeysSlice = append(publicKeysSlice, publicKey)
-	}
-
-	// Encrypt the input value with all public keys
-	encryptedMsg, err := gossip_common.GWEncryptToMultiple([]byte(message), publicKeysSlice)
+	body, err := json.Marshal(chatBody{UID: username, Message: message})
 	if err != nil {
-		gossip_common.Err("Failed to encrypt PLD: %v", err)
+		gossip_common.Err("Failed to marshal PLD: %v", err)
 		return nil
 	}
 
-	// Encrypt UID to all clients
-	encryptedUID, err := gossip_common.GWEncryptToMultiple([]byte(username), publicKeysSlice)
+	// Encrypt the message with our ratcheting sender key for the channel
+	encryptedMsg, err := encryptChannelMessage(channel, body)
 	if err != nil {
-		gossip_common.Err("Failed to encrypt UID: %v", err)
+		gossip_common.Err("Failed to encrypt PLD: %v", err)
 		return nil
 	}
 
 	// Create a data packet with the encrypted message
-	cPacket := gossip_common.NewDataPacketFromData("cht", encryptedUID, time.Now().Unix(), expiry, 1, 1, gossip_common.GetClientID(), channel, encryptedMsg)
+	cPacket := gossip_common.NewDataPacketFromData("cht", nil, time.Now().Unix(), expiry, 1, 1, gossip_common.GetClientID(), channel, encryptedMsg)
 
 	// Send the data packet
-	err = gossip_common.SendDataPacket(writer, cPacket, serverPublicKey)
+	err = sendData(cPacket, serverPublicKey)
 	if err != nil {
 		gossip_common.Err("Failed to send packet: %v", err)
 		return nil
@@ -166,6 +195,28 @@ func (a *App) SendMessage(message string, expiry int64, channel string) error {
 	return nil
 }
 
+/**
+ * SendDirectMessage sends an encrypted message to a single client over a ratchet session
+ * @param message The message to send
+ * @param expiry Expiry time of the message
+ * @param recipient The client ID of the recipient
+ * @return error Error if any occurred during message sending
+ */
+func (a *App) SendDirectMessage(message string, expiry int64, recipient string) error {
+	body, err := json.Marshal(chatBody{UID: username, Message: message})
+	if err != nil {
+		gossip_common.Err("Failed to marshal PLD: %v", err)
+		return nil
+	}
+
+	if err := sendDirectMessage(recipient, body); err != nil {
+		gossip_common.Err("Failed to send direct message: %v", err)
+		return err
+	}
+
+	return nil
+}
+
 /**
  * Disconnect closes the current connection
  * @return error Error if any occurred during disconnection
@@ -177,13 +228,7 @@ func (a *App) Disconnect() error {
 		}
 	}
 
-	// Loop through all playback devices and stop each one if it's started
-	for id, player := range playbackDevices {
-		if player.device.IsStarted() {
-			player.Stop()
-		}
-		delete(playbackDevices, id)
-	}
+	stopMixer()
 
 	conn.Close()
 	return nil
@@ -197,18 +242,17 @@ func (a *App) Disconnect() error {
 func (a *App) StartRecording() {
 
 	// Clear peers and data channels
-	for key := range participentDataChannels {
-		if dc := participentDataChannels[key]; dc != nil {
-			dc.Close()
-		}
-		delete(participentDataChannels, key)
-	}
-	for key := range participentPeerConnections {
-		if pc := participentPeerConnections[key]; pc != nil {
-			pc.Close()
-		}
-		delete(participentPeerConnections, key)
-	}
+	closeAllPeers()
+
+	callKeys.reset()
+	config := startAudioCodecs()
+	startVAD(a, config)
+	startPushToTalk(a, config)
+	startCapturePipeline(config)
+	startAudioTrack()
+	startVideoTrack()
+	startScreenTrack()
+	startSFU()
 
 	recordDevice = NewRecorder()
 	if err := recordDevice.Start(); err != nil {
@@ -217,6 +261,11 @@ func (a *App) StartRecording() {
 	}
 
 	inCall = true
+	resetRoster(a)
+	startCallHeartbeat()
+	startConnectionMonitor(a)
+	startCallStats(a)
+	requestICEServers()
 
 	if callID == "" {
 		// Generate a random call ID
@@ -228,7 +277,7 @@ func (a *App) StartRecording() {
 		startCallPacket := gossip_common.NewSignalPacketFromData("start_call", "", gossip_common.GetClientID(), []byte(callID))
 
 		// Send the start call packet
-		err := gossip_common.SendSignalPacket(writer, startCallPacket)
+		err := sendSignal(startCallPacket)
 		if err != nil {
 			gossip_common.Err("Failed to send start call packet: %v", err)
 			return
@@ -241,35 +290,59 @@ func (a *App) StartRecording() {
 func (a *App) StopRecording() {
 
 	// Clear peers and data channels
-	for key := range participentDataChannels {
-		if dc := participentDataChannels[key]; dc != nil {
-			dc.Close()
-		}
-		delete(participentDataChannels, key)
-	}
-	for key := range participentPeerConnections {
-		if pc := participentPeerConnections[key]; pc != nil {
-			pc.Close()
-		}
-		delete(participentPeerConnections, key)
-	}
+	closeAllPeers()
 
 	if recordDevice.device.IsStarted() {
 		recordDevice.Stop()
 	}
 
-	// Loop through all playback devices and stop each one if it's started
-	for id, player := range playbackDevices {
-		if player.device.IsStarted() {
-			player.Stop()
-		}
-		delete(playbackDevices, id)
-	}
+	stopMixer()
 
 	runtime.EventsEmit(a.ctx, "caller_self_hung_up")
 
 	HangUp(a)
+	teardownCall(a)
+}
+
+/**
+ * endCall leaves a call the server ended, running the same cleanup as hanging up without
+ * announcing it to anyone.
+ * @param endedCallID The call the server ended.
+ */
+func (a *App) endCall(endedCallID string) {
+	if !inCall || endedCallID != callID {
+		return
+	}
+
+	closeAllPeers()
+
+	if recordDevice != nil && recordDevice.device.IsStarted() {
+		recordDevice.Stop()
+	}
+
+	stopMixer()
+
+	runtime.EventsEmit(a.ctx, "caller_self_hung_up")
+	runtime.EventsEmit(a.ctx, "hang-up")
+
+	teardownCall(a)
+}
+
+// teardownCall stops everything a call started once its peers and devices are closed.
+func teardownCall(a *App) {
 	inCall = false
+	stopCallHeartbeat()
+	stopConnectionMonitor()
+	stopCallStats()
+	callKeys.reset()
+	stopAudioCodecs()
+	stopAudioTrack()
+	stopVideoTrack(a)
+	stopScreenTrack(a)
+	stopSFU()
+	stopPushToTalk()
+	stopCapturePipeline()
+	clearRoster(a)
 }
 
 /**
@@ -280,16 +353,84 @@ func (a *App) UpdateCallID(callerID string) {
 	callID = callerID
 }
 
+/**
+ * InviteToCall rings other clients to join the current call
+ * @param invitees Client IDs to invite
+ * @return error Error if not in a call or the invite could not be sent
+ */
+func (a *App) InviteToCall(invitees []string) error {
+	if !inCall || callID == "" {
+		return errors.New("not in a call")
+	}
+
+	payload, err := json.Marshal(gossip_common.CallInvite{CallID: callID, Invitees: invitees})
+	if err != nil {
+		return err
+	}
+
+	invitePacket := gossip_common.NewSignalPacketFromData("invite", "", gossip_common.GetClientID(), payload)
+	if err := sendSignal(invitePacket); err != nil {
+		gossip_common.Err("Failed to send invite packet: %v", err)
+		return err
+	}
+	return nil
+}
+
+/**
+ * AcceptCall answers an incoming call and joins it, leaving any current call first
+ * @param invitedCallID The call ID received with the call-incoming event
+ * @return error Error if the answer could not be sent
+ */
+func (a *App) AcceptCall(invitedCallID string) error {
+	acceptPacket := gossip_common.NewSignalPacketFromData("accept", "", gossip_common.GetClientID(), []byte(invitedCallID))
+	if err := sendSignal(acceptPacket); err != nil {
+		gossip_common.Err("Failed to send accept packet: %v", err)
+		return err
+	}
+
+	if inCall {
+		a.StopRecording()
+	}
+	callID = invitedCallID
+	a.StartRecording()
+	return nil
+}
+
+/**
+ * DeclineCall rejects an incoming call
+ * @param invitedCallID The call ID received with the call-incoming event
+ * @return error Error if the answer could not be sent
+ */
+func (a *App) DeclineCall(invitedCallID string) error {
+	declinePacket := gossip_common.NewSignalPacketFromData("decline", "", gossip_common.GetClientID(), []byte(invitedCallID))
+	if err := sendSignal(declinePacket); err != nil {
+		gossip_common.Err("Failed to send decline packet: %v", err)
+		return err
+	}
+	return nil
+}
+
 /**
  * ToggleGoMute toggles the mute state of the client
  * @return error Error if any occurred during mute toggling
  */
 func (a *App) ToggleGoMute() {
 	muted = !muted
+	if muted {
+		stopLocalSpeaking()
+	}
+	sendCallState(a)
 }
 
+/**
+ * ToggleGoDeaf toggles the deafen state of the client
+ */
 func (a *App) ToggleGoDeaf() {
 	deafened = !deafened
+	if deafened {
+		stopLocalSpeaking()
+	}
+	sendCallState(a)
 }
 
 func (a *App) cleanup(ctx context.Context) bool {
@@ -297,13 +438,8 @@ func (a *App) cleanup(ctx context.Context) bool {
 		recordDevice.Stop()
 	}
 
-	// Loop through all playback devices and stop each one if it's started
-	for id, player := range playbackDevices {
-		if player.device.IsStarted() {
-			player.Stop()
-		}
-		delete(playbackDevices, id)
-	}
+	stopMixer()
+	closeAudioContext()
 
 	conn.Close()
 	os.Exit(0)
@@ -4,13 +4,19 @@ import (
 	"fmt"
 	"sync"
 
+	"gossip_common"
+
 	"github.com/gen2brain/malgo"
 )
 
+const captureQueueLength = 32 // Captured chunks waiting to be processed before new ones are dropped
+
 // Recorder encapsulates the audio recording logic.
 type Recorder struct {
 	deviceConfig malgo.DeviceConfig
 	device       *malgo.Device
+	resampler    *resampler  // Converts the device rate to the call rate, nil when they match
+	frames       chan []byte // Captured chunks waiting for the capture worker, nil while stopped
 	buffer       [][]byte
 	mutex        sync.Mutex
 }
@@ -25,39 +31,53 @@ func NewRecorder() *Recorder {
 // initDevice initializes the malgo device for audio capture.
 func (r *Recorder) initDevice() error {
 	r.deviceConfig.Capture.Format = malgo.FormatS16
-	r.deviceConfig.Capture.Channels = 1
-	r.deviceConfig.SampleRate = 44100
+	r.deviceConfig.Capture.Channels = audioChannels
+	r.deviceConfig.SampleRate = 0 // Capture at the device's native rate and resample ourselves
 	r.deviceConfig.Alsa.NoMMap = 1
 
-	// Create a malgo context
-	allocatedCtx, err := malgo.InitContext(nil, malgo.ContextConfig{}, nil)
+	// Use the malgo context shared with the playback mixer
+	allocatedCtx, err := sharedAudioContext()
 	if err != nil {
-		return fmt.Errorf("failed to initialize context: %v", err)
+		return err
 	}
-	defer allocatedCtx.Uninit()
 
 	// Define the callback using malgo.DeviceCallbacks
 	callbacks := malgo.DeviceCallbacks{
 		Data: func(output, input []byte, framecount uint32) {
+			// Copy the input for the capture worker; the realtime thread never waits on processing or the network
+			chunk := make([]byte, len(input))
+			copy(chunk, input)
+
 			r.mutex.Lock()
 			defer r.mutex.Unlock()
 
-			// Copy input to a new slice to avoid overwriting during async operations
-			chunk := make([]byte, len(input))
-			copy(chunk, input)
-			//r.buffer = append(r.buffer, chunk)
-			if !muted && !deafened {
-				SendAudioToChannels(chunk)
+			if r.frames == nil {
+				return
+			}
+			select {
+			case r.frames <- chunk:
+			default:
+				if debugLogging {
+					gossip_common.Dbg("Dropped captured audio, processing is falling behind")
+				}
 			}
 		},
 	}
 
-	// Initialize the device with the correct parameters using the Context field of AllocatedContext
-	r.device, err = malgo.InitDevice(allocatedCtx.Context, r.deviceConfig, callbacks)
+	// Initialize the device on the selected device with the correct parameters using the Context field of AllocatedContext
+	r.device, err = initSelectedDevice(allocatedCtx.Context, malgo.Capture, r.deviceConfig, callbacks)
 	if err != nil {
 		return fmt.Errorf("failed to initialize device: %v", err)
 	}
 
+	r.resampler = nil
+	if rate := int(r.device.SampleRate()); rate != audioSampleRate {
+		r.resampler = newResampler(rate, audioSampleRate)
+		if debugLogging {
+			gossip_common.Dbg("Capture device runs at %d Hz, resampling to %d Hz", rate, audioSampleRate)
+		}
+	}
+
 	return nil
 }
 
@@ -67,6 +87,11 @@ func (r *Recorder) Start() error {
 		return err
 	}
 
+	r.mutex.Lock()
+	r.frames = make(chan []byte, captureQueueLength)
+	go r.processFrames(r.frames, r.resampler)
+	r.mutex.Unlock()
+
 	if err := r.device.Start(); err != nil {
 		return fmt.Errorf("failed to start device: %v", err)
 	}
@@ -76,12 +101,41 @@ func (r *Recorder) Start() error {
 
 // Stop halts the audio recording process.
 func (r *Recorder) Stop() error {
-	if err := r.device.Stop(); err != nil {
+	err := r.device.Stop()
+
+	r.mutex.Lock()
+	if r.frames != nil {
+		close(r.frames)
+		r.frames = nil
+	}
+	r.mutex.Unlock()
+
+	if err != nil {
 		return fmt.Errorf("failed to stop device: %v", err)
 	}
 	return nil
 }
 
+/**
+ * processFrames brings captured chunks to the call rate, runs them through the capture
+ * pipeline and sends them until the queue is closed.
+ * @param frames The captured chunks.
+ * @param resampler Converts the device rate to the call rate, nil when they match.
+ */
+func (r *Recorder) processFrames(frames chan []byte, resampler *resampler) {
+	for input := range frames {
+		chunk := input
+		if resampler != nil {
+			chunk = samplesToBytes(resampler.Process(bytesToSamples(input)))
+		}
+		chunk = processCapture(chunk)
+		//r.buffer = append(r.buffer, chunk)
+		if !muted && !deafened {
+			SendAudioToChannels(chunk)
+		}
+	}
+}
+
 // GetBuffer returns the recorded audio data.
 func (r *Recorder) GetBuffer() [][]byte {
 	r.mutex.Lock()
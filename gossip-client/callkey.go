@@ -0,0 +1,399 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	"gossip_common"
+)
+
+const (
+	callRekeyInterval = 5 * time.Minute // Rotate the send key at least this often
+	callRekeyFrames   = 1 << 20         // Rotate the send key after this many frames
+	callKeyEpochsKept = 2               // Number of epochs kept per peer to cover in-flight frames
+	callKeyAckTimeout = 2 * time.Second // Longest we keep sealing with the old key while peers acknowledge a new one
+)
+
+/**
+ * CallKeyMessage is the payload of a "ckey" packet, encrypted to the recipient's PGP key.
+ * @param CallID The call the key belongs to.
+ * @param Epoch The epoch of the key.
+ * @param Key The sender's symmetric key for that epoch.
+ */
+type CallKeyMessage struct {
+	CallID string `json:"call"`
+	Epoch  uint32 `json:"epoch"`
+	Key    []byte `json:"key"`
+}
+
+/**
+ * CallKeyAck is the payload of a "cack" packet, telling a participant we stored their key.
+ * @param CallID The call the key belongs to.
+ * @param Epoch The epoch of the key.
+ */
+type CallKeyAck struct {
+	CallID string `json:"call"`
+	Epoch  uint32 `json:"epoch"`
+}
+
+// callKeyring holds our own send key and the keys announced by every peer in the call.
+type callKeyring struct {
+	mutex    sync.Mutex
+	epoch    uint32
+	key      []byte
+	counter  uint64
+	created  time.Time
+	rekeying bool // A rekey is distributing a new key
+	pending  bool // Another rekey was requested while one was running
+	peers    map[string]map[uint32][]byte
+
+	awaitEpoch uint32          // Epoch of the key being distributed
+	awaiting   map[string]bool // Peers that have not acknowledged it yet
+	acked      chan struct{}   // Closed once every peer acknowledged it
+}
+
+var callKeys = &callKeyring{peers: make(map[string]map[uint32][]byte)}
+
+// reset discards every key, used when a call starts or ends.
+func (k *callKeyring) reset() {
+	k.mutex.Lock()
+	defer k.mutex.Unlock()
+
+	k.epoch = 0
+	k.key = nil
+	k.counter = 0
+	k.rekeying = false
+	k.pending = false
+	k.peers = make(map[string]map[uint32][]byte)
+	k.awaiting = nil
+}
+
+// expectAcks starts waiting for peers to acknowledge a new key, returning a channel closed once all have.
+func (k *callKeyring) expectAcks(epoch uint32, peers []string) <-chan struct{} {
+	k.mutex.Lock()
+	defer k.mutex.Unlock()
+
+	k.awaitEpoch = epoch
+	k.awaiting = make(map[string]bool, len(peers))
+	for _, id := range peers {
+		k.awaiting[id] = true
+	}
+	k.acked = make(chan struct{})
+	if len(k.awaiting) == 0 {
+		close(k.acked)
+	}
+	return k.acked
+}
+
+// ack records that a peer stored the key for an epoch.
+func (k *callKeyring) ack(sender string, epoch uint32) {
+	k.mutex.Lock()
+	defer k.mutex.Unlock()
+
+	if epoch != k.awaitEpoch || !k.awaiting[sender] {
+		return
+	}
+	delete(k.awaiting, sender)
+	if len(k.awaiting) == 0 {
+		close(k.acked)
+	}
+}
+
+// activate switches sending to the given key. The caller must hold the mutex.
+func (k *callKeyring) activate(epoch uint32, key []byte) {
+	k.epoch = epoch
+	k.key = key
+	k.counter = 0
+	k.created = time.Now()
+}
+
+// current returns the active send key, creating the first one if needed.
+func (k *callKeyring) current() (uint32, []byte, error) {
+	k.mutex.Lock()
+	defer k.mutex.Unlock()
+
+	if k.key == nil {
+		key, err := gossip_common.GenerateSessionKey()
+		if err != nil {
+			return 0, nil, err
+		}
+		k.activate(k.epoch+1, key)
+	}
+	return k.epoch, k.key, nil
+}
+
+// needsRekey reports whether the send key is old enough to be rotated.
+func (k *callKeyring) needsRekey() bool {
+	k.mutex.Lock()
+	defer k.mutex.Unlock()
+
+	if k.key == nil || k.rekeying {
+		return false
+	}
+	if k.counter >= callRekeyFrames || time.Since(k.created) >= callRekeyInterval {
+		k.rekeying = true
+		return true
+	}
+	return false
+}
+
+// requestRekey claims the next rekey, or queues one after the rekey already running.
+func (k *callKeyring) requestRekey() bool {
+	k.mutex.Lock()
+	defer k.mutex.Unlock()
+
+	if k.key == nil {
+		return false
+	}
+	if k.rekeying {
+		k.pending = true
+		return false
+	}
+	k.rekeying = true
+	return true
+}
+
+// finishRekey releases the rekey claim, reporting whether a queued rekey should run next.
+func (k *callKeyring) finishRekey() bool {
+	k.mutex.Lock()
+	defer k.mutex.Unlock()
+
+	if k.pending && k.key != nil {
+		k.pending = false
+		return true
+	}
+	k.pending = false
+	k.rekeying = false
+	return false
+}
+
+// seal encrypts a frame with the current send key and advances the counter.
+func (k *callKeyring) seal(plaintext []byte) ([]byte, error) {
+	if _, _, err := k.current(); err != nil {
+		return nil, err
+	}
+
+	k.mutex.Lock()
+	epoch, key, counter := k.epoch, k.key, k.counter
+	k.counter++
+	k.mutex.Unlock()
+
+	return gossip_common.SealFrame(key, epoch, counter, plaintext)
+}
+
+// addPeerKey stores a key announced by a peer, keeping only the most recent epochs.
+func (k *callKeyring) addPeerKey(sender string, epoch uint32, key []byte) {
+	k.mutex.Lock()
+	defer k.mutex.Unlock()
+
+	if k.peers[sender] == nil {
+		k.peers[sender] = make(map[uint32][]byte)
+	}
+	k.peers[sender][epoch] = key
+
+	for e := range k.peers[sender] {
+		if epoch >= callKeyEpochsKept && e <= epoch-callKeyEpochsKept {
+			delete(k.peers[sender], e)
+		}
+	}
+}
+
+// removePeer forgets every key announced by a peer.
+func (k *callKeyring) removePeer(sender string) {
+	k.mutex.Lock()
+	defer k.mutex.Unlock()
+
+	delete(k.peers, sender)
+	if k.awaiting[sender] {
+		delete(k.awaiting, sender)
+		if len(k.awaiting) == 0 {
+			close(k.acked)
+		}
+	}
+}
+
+// open decrypts a frame received from a peer using the key for the frame's epoch.
+func (k *callKeyring) open(sender string, frame []byte) ([]byte, error) {
+	epoch, _, err := gossip_common.ParseFrameHeader(frame)
+	if err != nil {
+		return nil, err
+	}
+
+	k.mutex.Lock()
+	key, exists := k.peers[sender][epoch]
+	k.mutex.Unlock()
+
+	if !exists {
+		return nil, fmt.Errorf("no call key from %s for epoch %d", sender, epoch)
+	}
+	return gossip_common.OpenFrame(key, frame)
+}
+
+/**
+ * SendCallKey encrypts our current call key to a participant's PGP key and sends it through the server.
+ * @param destination The participant to send the key to.
+ * @return error An error if the key could not be encrypted or sent.
+ */
+func SendCallKey(destination string) error {
+	epoch, key, err := callKeys.current()
+	if err != nil {
+		return fmt.Errorf("failed to create call key: %w", err)
+	}
+	return sendCallKey(destination, epoch, key)
+}
+
+// sendCallKey sends a specific epoch's key to a participant.
+func sendCallKey(destination string, epoch uint32, key []byte) error {
+	publicKey, exists := publicKeys[destination]
+	if !exists || publicKey == nil {
+		return fmt.Errorf("no public key for %s", destination)
+	}
+
+	payload, err := json.Marshal(CallKeyMessage{CallID: callID, Epoch: epoch, Key: key})
+	if err != nil {
+		return fmt.Errorf("failed to marshal call key: %w", err)
+	}
+
+	encryptedKey, err := gossip_common.GWEncrypt(payload, publicKey)
+	if err != nil {
+		return fmt.Errorf("failed to encrypt call key: %w", err)
+	}
+
+	keyPacket := gossip_common.NewSignalPacketFromData("ckey", destination, gossip_common.GetClientID(), encryptedKey)
+	if err := sendSignal(keyPacket); err != nil {
+		return fmt.Errorf("failed to send call key: %w", err)
+	}
+
+	if debugLogging {
+		gossip_common.Dbg("Sent call key epoch %d to %s", epoch, destination)
+	}
+	return nil
+}
+
+/**
+ * HandleCallKey decrypts a "ckey" packet and stores the sender's call key.
+ * @param sender The participant that sent the key.
+ * @param payload The PGP-encrypted CallKeyMessage.
+ * @return error An error if the key could not be decrypted or belongs to another call.
+ */
+func HandleCallKey(sender string, payload []byte) error {
+	decrypted, err := gossip_common.GWDecrypt(payload)
+	if err != nil {
+		return fmt.Errorf("failed to decrypt call key: %w", err)
+	}
+
+	var msg CallKeyMessage
+	if err := json.Unmarshal(decrypted, &msg); err != nil {
+		return fmt.Errorf("failed to unmarshal call key: %w", err)
+	}
+
+	if msg.CallID != callID {
+		return fmt.Errorf("call key from %s is for call %s", sender, msg.CallID)
+	}
+	if len(msg.Key) != gossip_common.SessionKeySize {
+		return fmt.Errorf("call key from %s has invalid size %d", sender, len(msg.Key))
+	}
+
+	callKeys.addPeerKey(sender, msg.Epoch, msg.Key)
+
+	if debugLogging {
+		gossip_common.Dbg("Stored call key epoch %d from %s", msg.Epoch, sender)
+	}
+
+	// Tell the sender it can start sealing with the key
+	ack, err := json.Marshal(CallKeyAck{CallID: msg.CallID, Epoch: msg.Epoch})
+	if err != nil {
+		return fmt.Errorf("failed to marshal call key acknowledgement: %w", err)
+	}
+	ackPacket := gossip_common.NewSignalPacketFromData("cack", sender, gossip_common.GetClientID(), ack)
+	if err := sendSignal(ackPacket); err != nil {
+		return fmt.Errorf("failed to acknowledge call key: %w", err)
+	}
+	return nil
+}
+
+/**
+ * HandleCallKeyAck records that a participant stored one of our call keys.
+ * @param sender The participant that acknowledged the key.
+ * @param payload The CallKeyAck.
+ * @return error An error if the acknowledgement is invalid.
+ */
+func HandleCallKeyAck(sender string, payload []byte) error {
+	var ack CallKeyAck
+	if err := json.Unmarshal(payload, &ack); err != nil {
+		return fmt.Errorf("failed to unmarshal call key acknowledgement: %w", err)
+	}
+	if ack.CallID != callID {
+		return nil
+	}
+
+	callKeys.ack(sender, ack.Epoch)
+	return nil
+}
+
+// rekeyCall distributes a fresh send key to every connected participant and switches to it once
+// they acknowledged it, or after callKeyAckTimeout. Keys travel through the server while frames go
+// peer to peer, so we keep sealing with the old key until then. The caller must have claimed the
+// rekey through needsRekey or requestRekey; rekeys requested meanwhile run after it.
+func rekeyCall() {
+	for {
+		rotateCallKey()
+		if !callKeys.finishRekey() {
+			return
+		}
+	}
+}
+
+// rotateCallKey sends a new key for the epoch after the current one and activates it once acknowledged.
+func rotateCallKey() {
+	key, err := gossip_common.GenerateSessionKey()
+	if err != nil {
+		gossip_common.Err("Failed to rotate call key: %v", err)
+		return
+	}
+
+	callKeys.mutex.Lock()
+	current := callKeys.epoch
+	callKeys.mutex.Unlock()
+	epoch := current + 1
+
+	peers := []string{}
+	for id := range dataChannels() {
+		peers = append(peers, id)
+	}
+	peers = append(peers, relayedPeerIDs(peers)...)
+
+	// Expect the acknowledgements before sending, as they may come back before the loop ends
+	acked := callKeys.expectAcks(epoch, peers)
+	for _, id := range peers {
+		if err := sendCallKey(id, epoch, key); err != nil {
+			gossip_common.Err("Failed to send call key to %s: %v", id, err)
+			callKeys.ack(id, epoch)
+		}
+	}
+
+	timeout := time.NewTimer(callKeyAckTimeout)
+	select {
+	case <-acked:
+	case <-timeout.C:
+		if debugLogging {
+			gossip_common.Dbg("Not every participant acknowledged call key epoch %d, switching anyway", epoch)
+		}
+	}
+	timeout.Stop()
+
+	callKeys.mutex.Lock()
+	defer callKeys.mutex.Unlock()
+
+	// The call ended or was reset while the key was being sent
+	if callKeys.key == nil || callKeys.epoch != current {
+		return
+	}
+	callKeys.activate(epoch, key)
+
+	if debugLogging {
+		gossip_common.Dbg("Call key rotated to epoch %d", epoch)
+	}
+}
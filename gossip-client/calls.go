@@ -0,0 +1,115 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"sync"
+	"time"
+
+	"gossip_common"
+)
+
+const (
+	callHeartbeatInterval = 30 * time.Second // How often we tell the server we are still in the call
+	listCallsTimeout      = 5 * time.Second  // How long ListActiveCalls waits for the server
+)
+
+var (
+	heartbeatStop   chan struct{}
+	heartbeatLock   sync.Mutex
+	callListReplies = make(chan []gossip_common.CallSummary, 1)
+	callListLock    sync.Mutex
+)
+
+/**
+ * ListActiveCalls asks the server which calls are running. Call IDs are only
+ * returned for calls we are in or have been invited to.
+ * @return []gossip_common.CallSummary The active calls
+ * @return error Error if the request failed or the server did not answer in time
+ */
+func (a *App) ListActiveCalls() ([]gossip_common.CallSummary, error) {
+	callListLock.Lock()
+	defer callListLock.Unlock()
+
+	// Drop a reply left over from an earlier request that timed out
+	select {
+	case <-callListReplies:
+	default:
+	}
+
+	listPacket := gossip_common.NewSignalPacketFromData("lsc", "", gossip_common.GetClientID(), nil)
+	if err := sendSignal(listPacket); err != nil {
+		gossip_common.Err("Failed to send list calls packet: %v", err)
+		return nil, err
+	}
+
+	select {
+	case calls := <-callListReplies:
+		return calls, nil
+	case <-time.After(listCallsTimeout):
+		return nil, errors.New("timed out waiting for the call list")
+	}
+}
+
+/**
+ * handleCallList passes a "calls" packet to a waiting ListActiveCalls.
+ * @param payload The JSON encoded []gossip_common.CallSummary.
+ */
+func handleCallList(payload []byte) {
+	var calls []gossip_common.CallSummary
+	if err := json.Unmarshal(payload, &calls); err != nil {
+		gossip_common.Err("Failed to unmarshal call list: %v", err)
+		return
+	}
+
+	select {
+	case callListReplies <- calls:
+	default:
+	}
+}
+
+/**
+ * startCallHeartbeat periodically tells the server we are still in the call,
+ * so it can drop us if the client dies without hanging up.
+ */
+func startCallHeartbeat() {
+	heartbeatLock.Lock()
+	defer heartbeatLock.Unlock()
+
+	if heartbeatStop != nil {
+		close(heartbeatStop)
+	}
+	stop := make(chan struct{})
+	heartbeatStop = stop
+
+	go func() {
+		ticker := time.NewTicker(callHeartbeatInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+				if !inCall || callID == "" {
+					continue
+				}
+				pingPacket := gossip_common.NewSignalPacketFromData("call_ping", callID, gossip_common.GetClientID(), nil)
+				if err := sendSignal(pingPacket); err != nil {
+					gossip_common.Err("Failed to send call heartbeat: %v", err)
+				}
+			}
+		}
+	}()
+}
+
+// stopCallHeartbeat stops the heartbeat started by startCallHeartbeat.
+func stopCallHeartbeat() {
+	heartbeatLock.Lock()
+	defer heartbeatLock.Unlock()
+
+	if heartbeatStop != nil {
+		close(heartbeatStop)
+		heartbeatStop = nil
+	}
+}
@@ -0,0 +1,492 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"gossip_common"
+
+	"github.com/pion/webrtc/v4"
+)
+
+// Audio is captured and played as 48 kHz mono S16, the native rate of Opus.
+const (
+	audioSampleRate = 48000
+	audioChannels   = 1
+
+	defaultOpusBitrate   = 32000 // Bits per second
+	defaultOpusFrameSize = 20    // Milliseconds
+	opusExpectedLoss     = 10    // Packet loss percentage the encoder adds FEC for
+	maxFrameSamples      = audioSampleRate * 120 / 1000
+)
+
+// Codec names advertised in offers and answers.
+const (
+	codecNamePCM  = "pcm"
+	codecNameOpus = "opus"
+)
+
+// Every audio frame starts with a codec ID and a sequence number before it is sealed with the call key.
+const (
+	codecPCM         byte = 0
+	codecOpus        byte = 1
+	audioFrameHeader      = 3
+)
+
+var errOpusUnavailable = errors.New("opus support is not built in, rebuild with -tags opus")
+
+/**
+ * callDescription is a WebRTC session description together with the audio codecs the sender can use.
+ * Clients that do not know about codecs ignore the extra fields and fall back to PCM.
+ * @param Codecs The supported codec names in order of preference.
+ * @param FrameEncryption Whether the sender seals its media track frames with its call key.
+ * @param Format The sample rate and channels of the sender's PCM frames.
+ */
+type callDescription struct {
+	webrtc.SessionDescription
+	Codecs          []string     `json:"codecs,omitempty"`
+	FrameEncryption bool         `json:"frameEncryption,omitempty"`
+	Format          *audioFormat `json:"format,omitempty"`
+}
+
+/**
+ * audioFormat describes a PCM stream. Opus always decodes at the call rate, so it only
+ * matters for PCM frames.
+ * @param SampleRate Samples per second.
+ * @param Channels Interleaved channels per sample.
+ */
+type audioFormat struct {
+	SampleRate int `json:"sampleRate"`
+	Channels   int `json:"channels"`
+}
+
+// callFormat is the format this client sends and mixes in, whatever the devices use.
+var callFormat = audioFormat{SampleRate: audioSampleRate, Channels: audioChannels}
+
+// audioConfig holds the encoder settings for a call.
+type audioConfig struct {
+	bitrate        int
+	frameSize      int
+	fec            bool
+	encryptFrames  bool
+	inputMode      string
+	vadSensitivity int
+	pushToTalkKey  string
+	releaseDelay   time.Duration
+
+	highPass         bool
+	noiseSuppression bool
+	echoCancellation bool
+}
+
+// audioEncoder turns one frame of PCM samples into a codec packet.
+type audioEncoder interface {
+	Encode(pcm []int16) ([]byte, error)
+}
+
+// audioDecoder turns codec packets back into PCM samples.
+type audioDecoder interface {
+	Decode(packet []byte) ([]int16, error)
+	// Recover rebuilds a lost frame of the given length from the packet that followed it.
+	Recover(next []byte, samples int) ([]int16, error)
+}
+
+// decodedFrame is one frame of PCM samples and the sequence number it plays at.
+type decodedFrame struct {
+	seq uint16
+	pcm []int16
+}
+
+// peerDecoder is the decoding state for one participant.
+type peerDecoder struct {
+	codec       byte
+	decoder     audioDecoder
+	format      audioFormat // Format of the participant's PCM frames
+	resampler   *resampler  // Converts their PCM to the call rate, nil when it already matches
+	lastSeq     uint16
+	lastSamples int
+	started     bool
+}
+
+var (
+	codecLock     sync.Mutex
+	captureConfig audioConfig
+	encoders      = make(map[byte]audioEncoder)
+	pendingPCM    []int16
+	captureSeq    uint16
+	peerCodecs    = make(map[string]byte)
+	peerFormats   = make(map[string]audioFormat)
+	peerDecoders  = make(map[string]*peerDecoder)
+)
+
+/**
+ * loadAudioConfig reads the encoder settings, falling back to defaults for missing or invalid values.
+ * @return The audio configuration.
+ */
+func loadAudioConfig() audioConfig {
+	config := audioConfig{
+		bitrate:        defaultOpusBitrate,
+		frameSize:      defaultOpusFrameSize,
+		fec:            true,
+		encryptFrames:  true,
+		inputMode:      inputModeVoice,
+		vadSensitivity: vadDefaultSensitivity,
+		pushToTalkKey:  defaultPushToTalkKey,
+		releaseDelay:   defaultPushToTalkRelease * time.Millisecond,
+
+		highPass:         true,
+		noiseSuppression: true,
+		echoCancellation: true,
+	}
+
+	settings, err := LoadSettings()
+	if err != nil {
+		gossip_common.Err("Failed to load audio settings, using defaults: %v", err)
+		return config
+	}
+
+	if settings.OpusBitrate >= 6000 && settings.OpusBitrate <= 510000 {
+		config.bitrate = settings.OpusBitrate
+	}
+	switch settings.OpusFrameSize {
+	case 10, 20, 40, 60:
+		config.frameSize = settings.OpusFrameSize
+	}
+	config.fec = settings.OpusFEC
+	config.encryptFrames = settings.EncryptMediaFrames
+	config.highPass = settings.HighPassFilter
+	config.noiseSuppression = settings.NoiseSuppression
+	config.echoCancellation = settings.EchoCancellation
+	switch settings.InputMode {
+	case inputModeOpen, inputModePTT:
+		config.inputMode = settings.InputMode
+	}
+	if settings.VADSensitivity >= 1 && settings.VADSensitivity <= 100 {
+		config.vadSensitivity = settings.VADSensitivity
+	}
+	if settings.PushToTalkKey != "" {
+		config.pushToTalkKey = settings.PushToTalkKey
+	}
+	if settings.PushToTalkRelease >= 0 && settings.PushToTalkRelease <= 2000 {
+		config.releaseDelay = time.Duration(settings.PushToTalkRelease) * time.Millisecond
+	}
+	return config
+}
+
+/**
+ * startAudioCodecs prepares the encoders for a new call. PCM is always available;
+ * Opus is added when the client was built with it.
+ * @return The audio configuration for the call.
+ */
+func startAudioCodecs() audioConfig {
+	config := loadAudioConfig()
+
+	codecLock.Lock()
+	defer codecLock.Unlock()
+
+	captureConfig = config
+	pendingPCM = nil
+	captureSeq = 0
+	encoders = map[byte]audioEncoder{codecPCM: pcmCodec{}}
+
+	encoder, err := newOpusEncoder(config)
+	if err != nil {
+		if debugLogging {
+			gossip_common.Dbg("Opus encoder unavailable, sending PCM: %v", err)
+		}
+		return config
+	}
+	encoders[codecOpus] = encoder
+	return config
+}
+
+// stopAudioCodecs drops all encoder and decoder state at the end of a call.
+func stopAudioCodecs() {
+	codecLock.Lock()
+	defer codecLock.Unlock()
+
+	encoders = make(map[byte]audioEncoder)
+	pendingPCM = nil
+	peerCodecs = make(map[string]byte)
+	peerFormats = make(map[string]audioFormat)
+	peerDecoders = make(map[string]*peerDecoder)
+}
+
+/**
+ * supportedCodecs lists the codecs this client can encode and decode, best first.
+ * @return The codec names.
+ */
+func supportedCodecs() []string {
+	if opusAvailable {
+		return []string{codecNameOpus, codecNamePCM}
+	}
+	return []string{codecNamePCM}
+}
+
+/**
+ * negotiateCodec picks the codec we send to a participant from the codecs they advertised.
+ * @param id The participant.
+ * @param offered The codec names from their offer or answer.
+ */
+func negotiateCodec(id string, offered []string) {
+	codec := codecPCM
+	if opusAvailable {
+		for _, name := range offered {
+			if name == codecNameOpus {
+				codec = codecOpus
+				break
+			}
+		}
+	}
+
+	codecLock.Lock()
+	peerCodecs[id] = codec
+	codecLock.Unlock()
+
+	if debugLogging {
+		gossip_common.Dbg("Sending %s audio to %s", codecName(codec), id)
+	}
+}
+
+/**
+ * negotiateFormat records the PCM format a participant described. Participants that
+ * describe none send at the call rate.
+ * @param id The participant.
+ * @param format The format from their offer or answer, or nil.
+ */
+func negotiateFormat(id string, format *audioFormat) {
+	peerFormat := callFormat
+	if format != nil && format.SampleRate >= 8000 && format.SampleRate <= 192000 && format.Channels >= 1 && format.Channels <= 2 {
+		peerFormat = *format
+	}
+
+	codecLock.Lock()
+	peerFormats[id] = peerFormat
+	codecLock.Unlock()
+
+	if debugLogging && peerFormat != callFormat {
+		gossip_common.Dbg("Resampling PCM from %s: %d Hz, %d channels", id, peerFormat.SampleRate, peerFormat.Channels)
+	}
+}
+
+/**
+ * forgetCodec drops the negotiated codec and decoder of a participant that left.
+ * @param id The participant.
+ */
+func forgetCodec(id string) {
+	codecLock.Lock()
+	defer codecLock.Unlock()
+
+	delete(peerCodecs, id)
+	delete(peerFormats, id)
+	delete(peerDecoders, id)
+}
+
+/**
+ * encodeCapturedAudio splits captured PCM into fixed-size frames, drops the ones the VAD
+ * considers silent and encodes the rest once for every codec a participant needs.
+ * @param chunk Captured S16 little-endian samples.
+ * @param peers The participants the audio goes to.
+ * @return One map from codec ID to encoded frame for every complete frame, without the codecs
+ * that produced no output for it.
+ */
+func encodeCapturedAudio(chunk []byte, peers []string) []map[byte][]byte {
+	codecLock.Lock()
+	defer codecLock.Unlock()
+
+	pendingPCM = append(pendingPCM, bytesToSamples(chunk)...)
+	frameSamples := audioSampleRate * captureConfig.frameSize / 1000
+	if frameSamples == 0 {
+		return nil
+	}
+
+	needed := make(map[byte]bool)
+	for _, id := range peers {
+		codec := peerCodecs[id]
+		if _, ok := encoders[codec]; !ok {
+			codec = codecPCM
+		}
+		needed[codec] = true
+	}
+
+	var frames []map[byte][]byte
+	for len(pendingPCM) >= frameSamples {
+		pcm := pendingPCM[:frameSamples]
+		if !detectLocalSpeech(pcm, captureConfig.inputMode) {
+			pendingPCM = pendingPCM[frameSamples:]
+			continue
+		}
+		encoded := make(map[byte][]byte)
+		for codec := range needed {
+			packet, err := encoders[codec].Encode(pcm)
+			if err != nil {
+				gossip_common.Err("Failed to encode %s audio: %v", codecName(codec), err)
+				continue
+			}
+			if len(packet) == 0 {
+				// Nothing to send for this frame, such as Opus skipping silence
+				continue
+			}
+			frame := make([]byte, audioFrameHeader, audioFrameHeader+len(packet))
+			frame[0] = codec
+			binary.BigEndian.PutUint16(frame[1:3], captureSeq)
+			encoded[codec] = append(frame, packet...)
+		}
+		frames = append(frames, encoded)
+		pendingPCM = pendingPCM[frameSamples:]
+		captureSeq++
+	}
+	return frames
+}
+
+/**
+ * sendCodec returns the codec ID a participant's audio is encoded with.
+ * @param id The participant.
+ * @return The codec ID, PCM if nothing was negotiated.
+ */
+func sendCodec(id string) byte {
+	codecLock.Lock()
+	defer codecLock.Unlock()
+
+	codec := peerCodecs[id]
+	if _, ok := encoders[codec]; !ok {
+		return codecPCM
+	}
+	return codec
+}
+
+/**
+ * decodeAudioFrame decodes a frame from a participant. If the frame before it is missing
+ * and the codec carries forward error correction, the missing frame is rebuilt as well.
+ * Frames arriving out of order are still decoded; the jitter buffer puts them back in order.
+ * @param id The participant the frame came from.
+ * @param frame The decrypted audio frame.
+ * @return The decoded frames with their sequence numbers.
+ */
+func decodeAudioFrame(id string, frame []byte) ([]decodedFrame, error) {
+	if len(frame) < audioFrameHeader {
+		return nil, errors.New("audio frame too short")
+	}
+	codec := frame[0]
+	seq := binary.BigEndian.Uint16(frame[1:3])
+	packet := frame[audioFrameHeader:]
+
+	codecLock.Lock()
+	defer codecLock.Unlock()
+
+	state, exists := peerDecoders[id]
+	if !exists || state.codec != codec {
+		decoder, err := newAudioDecoder(codec)
+		if err != nil {
+			return nil, err
+		}
+		state = &peerDecoder{codec: codec, decoder: decoder, format: callFormat}
+		if format, exists := peerFormats[id]; exists && codec == codecPCM {
+			state.format = format
+		}
+		if state.format.SampleRate != audioSampleRate {
+			state.resampler = newResampler(state.format.SampleRate, audioSampleRate)
+		}
+		peerDecoders[id] = state
+	}
+
+	// A jump this large means the frames now come over another path, so start over from this one
+	if state.started && seqDistance(seq, state.lastSeq) > jitterResyncFrames {
+		state.started = false
+	}
+
+	var out []decodedFrame
+	newest := !state.started || seqBefore(state.lastSeq, seq)
+	if state.started {
+		if seq == state.lastSeq {
+			return nil, fmt.Errorf("duplicate audio frame %d from %s", seq, id)
+		}
+		if seq-state.lastSeq == 2 {
+			if recovered, err := state.decoder.Recover(packet, state.lastSamples); err == nil {
+				out = append(out, decodedFrame{seq: seq - 1, pcm: recovered})
+			}
+		}
+	}
+
+	pcm, err := state.decoder.Decode(packet)
+	if err != nil {
+		return out, err
+	}
+	pcm = state.convert(pcm)
+	if newest {
+		state.lastSeq = seq
+		state.lastSamples = len(pcm)
+		state.started = true
+	}
+	return append(out, decodedFrame{seq: seq, pcm: pcm}), nil
+}
+
+// convert brings decoded samples to the call format.
+func (state *peerDecoder) convert(pcm []int16) []int16 {
+	if state.format.Channels == 2 {
+		mono := make([]int16, len(pcm)/2)
+		for i := range mono {
+			mono[i] = int16((int32(pcm[i*2]) + int32(pcm[i*2+1])) / 2)
+		}
+		pcm = mono
+	}
+	if state.resampler != nil {
+		pcm = state.resampler.Process(pcm)
+	}
+	return pcm
+}
+
+// newAudioDecoder creates a decoder for a codec ID.
+func newAudioDecoder(codec byte) (audioDecoder, error) {
+	switch codec {
+	case codecPCM:
+		return pcmCodec{}, nil
+	case codecOpus:
+		return newOpusDecoder()
+	}
+	return nil, fmt.Errorf("unknown audio codec %d", codec)
+}
+
+// codecName returns the advertised name of a codec ID.
+func codecName(codec byte) string {
+	if codec == codecOpus {
+		return codecNameOpus
+	}
+	return codecNamePCM
+}
+
+// pcmCodec sends samples unchanged. Every client supports it.
+type pcmCodec struct{}
+
+func (pcmCodec) Encode(pcm []int16) ([]byte, error) {
+	return samplesToBytes(pcm), nil
+}
+
+func (pcmCodec) Decode(packet []byte) ([]int16, error) {
+	return bytesToSamples(packet), nil
+}
+
+func (pcmCodec) Recover(next []byte, samples int) ([]int16, error) {
+	return nil, errors.New("pcm has no forward error correction")
+}
+
+// bytesToSamples converts S16 little-endian audio to samples.
+func bytesToSamples(data []byte) []int16 {
+	samples := make([]int16, len(data)/2)
+	for i := range samples {
+		samples[i] = int16(binary.LittleEndian.Uint16(data[i*2:]))
+	}
+	return samples
+}
+
+// samplesToBytes converts samples to S16 little-endian audio.
+func samplesToBytes(samples []int16) []byte {
+	data := make([]byte, len(samples)*2)
+	for i, sample := range samples {
+		binary.LittleEndian.PutUint16(data[i*2:], uint16(sample))
+	}
+	return data
+}
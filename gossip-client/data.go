@@ -1,6 +1,8 @@
 package main
 
 import (
+	"encoding/json"
+
 	"github.com/wailsapp/wails/v2/pkg/runtime"
 
 	"gossip_common"
@@ -23,25 +25,53 @@ func handleDataPacket(packet gossip_common.GMDataPacket, a *App) {
 	switch packet.OpCmd {
 	case "cht":
 
-		decryptedMsg, err := gossip_common.GWDecrypt(packet.Payload) // Decrypt the message
+		decryptedMsg, err := decryptChannelMessage(packet) // Decrypt the message with the sender's key
 		if err != nil {
 			gossip_common.Err("Failed to decrypt PLD: %v", err)
 			break
 		}
-
-		decryptedUID, err := gossip_common.GWDecrypt(packet.UID) // Decrypt the message
-		if err != nil {
-			gossip_common.Err("Failed to decrypt UID: %v", err)
+		if decryptedMsg == nil {
+			if debugLogging {
+				gossip_common.Dbg("Holding CHT from %s until their sender key arrives", packet.Sender)
+			}
 			break
 		}
 
-		formattedMsg := string(decryptedMsg) // Format the message for display
+		var body chatBody
+		if err := json.Unmarshal(decryptedMsg, &body); err != nil {
+			gossip_common.Err("Failed to unmarshal PLD: %v", err)
+			break
+		}
 
 		if debugLogging {
 			gossip_common.Dbg("CHT from %s", packet.Sender)
 		}
 
 		// send update to UI
-		runtime.EventsEmit(a.ctx, "message-received", packet.Destination, string(decryptedUID), formattedMsg, packet.Expiration, packet.Timestamp, packet.Sender)
+		runtime.EventsEmit(a.ctx, "message-received", packet.Destination, body.UID, body.Message, packet.Expiration, packet.Timestamp, packet.Sender)
+
+	case "dri": // ratchet handshake init
+		if packet.Destination != gossip_common.GetClientID() {
+			break
+		}
+		if err := handleHandshakeInit(packet); err != nil {
+			gossip_common.Err("Failed to accept ratchet session from %s: %v", packet.Sender, err)
+		}
+
+	case "drr": // ratchet handshake reply
+		if packet.Destination != gossip_common.GetClientID() {
+			break
+		}
+		if err := handleHandshakeReply(packet); err != nil {
+			gossip_common.Err("Failed to complete ratchet session with %s: %v", packet.Sender, err)
+		}
+
+	case "drm": // ratchet message
+		if packet.Destination != gossip_common.GetClientID() {
+			break
+		}
+		if err := handleRatchetMessage(packet, a); err != nil {
+			gossip_common.Err("Failed to decrypt ratchet message from %s: %v", packet.Sender, err)
+		}
 	}
 }
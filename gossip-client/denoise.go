@@ -0,0 +1,153 @@
+package main
+
+import (
+	"math"
+	"math/cmplx"
+)
+
+const (
+	denoiseFrame    = 512   // Samples per analysis window
+	denoiseHop      = 256   // Samples between windows, half overlap
+	denoiseSmooth   = 0.7   // Weight of the previous frame in the smoothed power
+	denoiseWarmup   = 40    // Windows averaged into the first noise estimate, about 200 ms
+	denoiseFall     = 0.05  // Per-frame step of the noise estimate towards a quieter signal
+	denoiseRise     = 1.005 // Per-frame growth of the noise estimate while the signal stays above it
+	denoiseOverSub  = 3.0   // How much of the noise estimate is subtracted, the floor sits below the average noise
+	denoiseGainMin  = 0.1   // Strongest attenuation of a band, about -20 dB, to avoid musical noise
+	denoiseGainHold = 0.6   // Weight of the previous gain, smooths attenuation over time
+)
+
+// noiseSuppressor removes stationary background noise such as fans and hum by spectral
+// subtraction. It tracks the noise in each frequency band as a slowly rising floor under the
+// smoothed power and attenuates bands whose power is close to it.
+type noiseSuppressor struct {
+	window []float64
+	input  []float64
+	output []float64
+	power  []float64
+	noise  []float64
+	gains  []float64
+	bins   []complex128
+	frames int
+}
+
+// newNoiseSuppressor creates a suppressor that adds one window of latency.
+func newNoiseSuppressor() *noiseSuppressor {
+	n := &noiseSuppressor{
+		window: make([]float64, denoiseFrame),
+		input:  make([]float64, denoiseFrame-denoiseHop),
+		output: make([]float64, denoiseFrame),
+		power:  make([]float64, denoiseFrame/2+1),
+		noise:  make([]float64, denoiseFrame/2+1),
+		gains:  make([]float64, denoiseFrame/2+1),
+		bins:   make([]complex128, denoiseFrame),
+	}
+	// Square-root Hann on analysis and synthesis sums to one at half overlap
+	for i := range n.window {
+		n.window[i] = math.Sqrt(0.5 - 0.5*math.Cos(2*math.Pi*float64(i)/denoiseFrame))
+	}
+	for i := range n.gains {
+		n.gains[i] = 1
+	}
+	return n
+}
+
+// Process suppresses noise in a frame. Output is produced a hop at a time.
+func (n *noiseSuppressor) Process(pcm []int16) []int16 {
+	for _, sample := range pcm {
+		n.input = append(n.input, float64(sample))
+	}
+
+	var out []int16
+	for len(n.input) >= denoiseFrame {
+		n.processWindow()
+		for _, x := range n.output[:denoiseHop] {
+			out = append(out, clampSample(x))
+		}
+		copy(n.output, n.output[denoiseHop:])
+		for i := denoiseFrame - denoiseHop; i < denoiseFrame; i++ {
+			n.output[i] = 0
+		}
+		n.input = n.input[denoiseHop:]
+	}
+	return out
+}
+
+// processWindow filters one analysis window and overlap-adds it into the output.
+func (n *noiseSuppressor) processWindow() {
+	for i := range n.bins {
+		n.bins[i] = complex(n.input[i]*n.window[i], 0)
+	}
+	fft(n.bins, false)
+
+	for k := 0; k <= denoiseFrame/2; k++ {
+		p := real(n.bins[k])*real(n.bins[k]) + imag(n.bins[k])*imag(n.bins[k])
+		n.power[k] = denoiseSmooth*n.power[k] + (1-denoiseSmooth)*p
+
+		// Follow the noise down quickly and up slowly, so speech does not become the noise
+		if n.frames < denoiseWarmup {
+			n.noise[k] += (p - n.noise[k]) / float64(n.frames+1)
+		} else if n.power[k] < n.noise[k] {
+			n.noise[k] += (n.power[k] - n.noise[k]) * denoiseFall
+		} else {
+			n.noise[k] *= denoiseRise
+		}
+
+		gain := denoiseGainMin
+		if n.power[k] > 0 {
+			gain = math.Max(denoiseGainMin, 1-denoiseOverSub*n.noise[k]/n.power[k])
+		}
+		n.gains[k] = denoiseGainHold*n.gains[k] + (1-denoiseGainHold)*gain
+
+		n.bins[k] *= complex(n.gains[k], 0)
+		if k > 0 && k < denoiseFrame/2 {
+			n.bins[denoiseFrame-k] = cmplx.Conj(n.bins[k])
+		}
+	}
+
+	n.frames++
+
+	fft(n.bins, true)
+	for i := range n.output {
+		n.output[i] += real(n.bins[i]) * n.window[i]
+	}
+}
+
+// fft is an in-place radix-2 fast Fourier transform. The inverse is scaled by 1/len.
+func fft(x []complex128, inverse bool) {
+	size := len(x)
+	for i, j := 1, 0; i < size; i++ {
+		bit := size >> 1
+		for ; j&bit != 0; bit >>= 1 {
+			j ^= bit
+		}
+		j |= bit
+		if i < j {
+			x[i], x[j] = x[j], x[i]
+		}
+	}
+
+	sign := -1.0
+	if inverse {
+		sign = 1
+	}
+	for length := 2; length <= size; length <<= 1 {
+		step := cmplx.Rect(1, sign*2*math.Pi/float64(length))
+		for start := 0; start < size; start += length {
+			w := complex(1, 0)
+			for k := 0; k < length/2; k++ {
+				u := x[start+k]
+				v := x[start+k+length/2] * w
+				x[start+k] = u + v
+				x[start+k+length/2] = u - v
+				w *= step
+			}
+		}
+	}
+
+	if inverse {
+		for i := range x {
+			x[i] /= complex(float64(size), 0)
+		}
+	}
+}
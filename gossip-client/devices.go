@@ -0,0 +1,232 @@
+package main
+
+import (
+	"fmt"
+	"runtime"
+	"sync"
+	"unsafe"
+
+	"gossip_common"
+
+	"github.com/gen2brain/malgo"
+)
+
+var (
+	audioContext     *malgo.AllocatedContext // Shared by the recorder and the playback mixer
+	audioContextLock sync.Mutex
+)
+
+/**
+ * AudioDevice describes a capture or playback device.
+ * @param ID The device identifier, stable across restarts.
+ * @param Name The name shown to the user.
+ * @param Default Whether the system uses this device by default.
+ */
+type AudioDevice struct {
+	ID      string `json:"id"`
+	Name    string `json:"name"`
+	Default bool   `json:"default"`
+}
+
+/**
+ * AudioDevices lists the available devices and the ones chosen in Settings.
+ * @param Capture The microphones.
+ * @param Playback The speakers and headsets.
+ * @param SelectedCapture The chosen capture device ID, empty for the system default.
+ * @param SelectedPlayback The chosen playback device ID, empty for the system default.
+ */
+type AudioDevices struct {
+	Capture          []AudioDevice `json:"capture"`
+	Playback         []AudioDevice `json:"playback"`
+	SelectedCapture  string        `json:"selectedCapture"`
+	SelectedPlayback string        `json:"selectedPlayback"`
+}
+
+// sharedAudioContext returns the malgo context, creating it on first use.
+func sharedAudioContext() (*malgo.AllocatedContext, error) {
+	audioContextLock.Lock()
+	defer audioContextLock.Unlock()
+
+	if audioContext != nil {
+		return audioContext, nil
+	}
+
+	allocatedCtx, err := malgo.InitContext(nil, malgo.ContextConfig{}, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to initialize context: %v", err)
+	}
+	audioContext = allocatedCtx
+	return audioContext, nil
+}
+
+// closeAudioContext releases the malgo context once every device is gone.
+func closeAudioContext() {
+	audioContextLock.Lock()
+	defer audioContextLock.Unlock()
+
+	if audioContext == nil {
+		return
+	}
+	audioContext.Uninit()
+	audioContext.Free()
+	audioContext = nil
+}
+
+/**
+ * ListAudioDevices returns the capture and playback devices the system offers
+ * @return AudioDevices The devices and the current selection
+ * @return error Error if the devices could not be enumerated
+ */
+func (a *App) ListAudioDevices() (AudioDevices, error) {
+	var devices AudioDevices
+
+	ctx, err := sharedAudioContext()
+	if err != nil {
+		return devices, err
+	}
+
+	for _, kind := range []malgo.DeviceType{malgo.Capture, malgo.Playback} {
+		infos, err := ctx.Devices(kind)
+		if err != nil {
+			return devices, fmt.Errorf("failed to list devices: %v", err)
+		}
+		list := []AudioDevice{}
+		for _, info := range infos {
+			list = append(list, AudioDevice{ID: info.ID.String(), Name: info.Name(), Default: info.IsDefault != 0})
+		}
+		if kind == malgo.Capture {
+			devices.Capture = list
+		} else {
+			devices.Playback = list
+		}
+	}
+
+	settings, err := LoadSettings()
+	if err == nil {
+		devices.SelectedCapture = settings.CaptureDevice
+		devices.SelectedPlayback = settings.PlaybackDevice
+	}
+	return devices, nil
+}
+
+/**
+ * SetCaptureDevice chooses the microphone, saves the choice and switches to it if a call is running
+ * @param id The device ID from ListAudioDevices, or an empty string for the system default
+ * @return error Error if the choice could not be saved or the new device could not be started
+ */
+func (a *App) SetCaptureDevice(id string) error {
+	settings, err := LoadSettings()
+	if err != nil {
+		return err
+	}
+	settings.CaptureDevice = id
+	if err := SaveSettings(settings); err != nil {
+		return err
+	}
+
+	if recordDevice == nil || recordDevice.device == nil || !recordDevice.device.IsStarted() {
+		return nil
+	}
+
+	// Swap the recorder for one on the new device without leaving the call
+	recordDevice.Stop()
+	recordDevice.device.Uninit()
+	recordDevice = NewRecorder()
+	if err := recordDevice.Start(); err != nil {
+		gossip_common.Err("Error starting recorder: %v", err)
+		return err
+	}
+	return nil
+}
+
+/**
+ * SetPlaybackDevice chooses the speaker or headset, saves the choice and moves playback to it
+ * @param id The device ID from ListAudioDevices, or an empty string for the system default
+ * @return error Error if the choice could not be saved or playback could not be moved
+ */
+func (a *App) SetPlaybackDevice(id string) error {
+	settings, err := LoadSettings()
+	if err != nil {
+		return err
+	}
+	settings.PlaybackDevice = id
+	if err := SaveSettings(settings); err != nil {
+		return err
+	}
+
+	mixer := currentMixer()
+	if mixer == nil {
+		return nil
+	}
+	if err := mixer.switchDevice(); err != nil {
+		gossip_common.Err("Failed to move playback to the new device: %v", err)
+		return err
+	}
+	return nil
+}
+
+/**
+ * initSelectedDevice initializes a malgo device on the device chosen in Settings. malgo only
+ * reads the ID while the device is initialized, so it stays in Go memory, pinned for the call,
+ * instead of the C copy DeviceID.Pointer() leaks.
+ * @param ctx The malgo context.
+ * @param kind malgo.Capture or malgo.Playback.
+ * @param config The device configuration; its device ID is replaced with the selected one.
+ * @param callbacks The device callbacks.
+ * @return *malgo.Device The initialized device.
+ * @return error Error if the device could not be initialized.
+ */
+func initSelectedDevice(ctx malgo.Context, kind malgo.DeviceType, config malgo.DeviceConfig, callbacks malgo.DeviceCallbacks) (*malgo.Device, error) {
+	id := selectedDevice(kind)
+	if id != nil {
+		var pinner runtime.Pinner
+		pinner.Pin(id)
+		defer pinner.Unpin()
+	}
+
+	if kind == malgo.Capture {
+		config.Capture.DeviceID = unsafe.Pointer(id)
+	} else {
+		config.Playback.DeviceID = unsafe.Pointer(id)
+	}
+	return malgo.InitDevice(ctx, config, callbacks)
+}
+
+/**
+ * selectedDevice looks up the device chosen in Settings.
+ * @param kind malgo.Capture or malgo.Playback.
+ * @return *malgo.DeviceID The device ID, or nil to use the system default.
+ */
+func selectedDevice(kind malgo.DeviceType) *malgo.DeviceID {
+	settings, err := LoadSettings()
+	if err != nil {
+		return nil
+	}
+	id := settings.PlaybackDevice
+	if kind == malgo.Capture {
+		id = settings.CaptureDevice
+	}
+	if id == "" {
+		return nil
+	}
+
+	ctx, err := sharedAudioContext()
+	if err != nil {
+		return nil
+	}
+	infos, err := ctx.Devices(kind)
+	if err != nil {
+		return nil
+	}
+	for _, info := range infos {
+		if info.ID.String() == id {
+			deviceID := info.ID
+			return &deviceID
+		}
+	}
+
+	if debugLogging {
+		gossip_common.Dbg("Audio device %s is gone, using the default", id)
+	}
+	return nil
+}
@@ -0,0 +1,260 @@
+package main
+
+import (
+	"math"
+	"sync"
+
+	"gossip_common"
+)
+
+const (
+	echoTaps         = 1024                 // Echo path length the canceller models, about 21 ms after the estimated delay
+	echoStep         = 0.2                  // NLMS step size
+	echoReferenceLen = audioSampleRate      // Samples of playback kept for the canceller
+	echoMaxLead      = audioSampleRate / 20 // How far playback may run ahead of capture before it is realigned
+	echoDoubleTalk   = 2.0                  // Microphone to speaker power ratio above which the local user is talking
+
+	echoMaxDelay       = audioSampleRate / 4    // Longest speaker to microphone delay we look for, 250 ms
+	echoBlock          = audioSampleRate / 1000 // Samples per envelope block used to estimate the delay, 1 ms
+	echoEnvelopeBlocks = 1000                   // Envelope blocks correlated for each estimate, 1 s
+	echoEstimateBlocks = 250                    // Blocks between delay estimates
+	echoDelayMargin    = 4 * echoBlock          // Samples the filter window starts before the estimated delay
+	echoMinCorrelation = 0.3                    // Weakest envelope correlation trusted as the echo delay
+)
+
+// echoReference collects what the mixer sends to the speaker so the capture path can
+// subtract it. Capture reads and clears the samples in step with the microphone.
+type echoReference struct {
+	ring     []float64
+	readPos  int64
+	writePos int64
+	lock     sync.Mutex
+}
+
+var playbackReference = &echoReference{ring: make([]float64, echoReferenceLen)}
+
+// resetEchoReference clears the reference at the start of a call.
+func resetEchoReference() {
+	playbackReference.lock.Lock()
+	defer playbackReference.lock.Unlock()
+
+	for i := range playbackReference.ring {
+		playbackReference.ring[i] = 0
+	}
+	playbackReference.writePos = playbackReference.readPos
+}
+
+/**
+ * addEchoReference records the mixer output in the echo reference.
+ * @param mix The samples sent to the speaker at the call rate, full scale being 1.
+ */
+func addEchoReference(mix []float64) {
+	r := playbackReference
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	// Realign when playback and capture drift apart or one of them stalled
+	pos := r.writePos
+	if pos < r.readPos || pos > r.readPos+echoMaxLead {
+		pos = r.readPos
+	}
+	for _, x := range mix {
+		r.ring[pos%echoReferenceLen] = x * 32767
+		pos++
+	}
+	r.writePos = pos
+}
+
+// takeEchoReference returns the next n mixed playback samples and frees their slots.
+func takeEchoReference(n int) []float64 {
+	r := playbackReference
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	out := make([]float64, n)
+	for i := range out {
+		slot := (r.readPos + int64(i)) % echoReferenceLen
+		out[i] = r.ring[slot]
+		r.ring[slot] = 0
+	}
+	r.readPos += int64(n)
+	return out
+}
+
+// echoCanceller removes the speaker signal picked up by the microphone with a
+// normalised least mean squares adaptive filter. The device latency between playing a
+// sample and hearing it is estimated by cross-correlating the signal envelopes, and the
+// reference is delayed by it so the filter only has to model the room.
+type echoCanceller struct {
+	weights   []float64
+	history   []float64 // Reference samples, stored twice so the newest echoTaps are contiguous
+	pos       int
+	energy    float64 // Sum of squares of the reference in the filter window
+	nearPow   float64 // Smoothed microphone power
+	farPow    float64 // Smoothed reference power
+	smoothing float64
+
+	delayLine []float64 // Reference samples waiting out the estimated delay
+	delayPos  int
+	delay     int // Samples the reference is delayed by
+
+	nearEnv, farEnv []float64 // Mean magnitude of each block of microphone and reference samples
+	envPos          int
+	blockNear       float64
+	blockFar        float64
+	blockFill       int
+	sinceEstimate   int
+	candidate       int // Delay in blocks found by the previous estimate, adopted once the next agrees
+}
+
+// newEchoCanceller creates an echo canceller with an empty echo path.
+func newEchoCanceller() *echoCanceller {
+	return &echoCanceller{
+		weights:   make([]float64, echoTaps),
+		history:   make([]float64, 2*echoTaps),
+		smoothing: smoothingCoefficient(0.02),
+		delayLine: make([]float64, echoMaxDelay+1),
+		nearEnv:   make([]float64, echoEnvelopeBlocks),
+		farEnv:    make([]float64, echoEnvelopeBlocks),
+		candidate: -1,
+	}
+}
+
+// Process subtracts the estimated echo from a frame in place.
+func (e *echoCanceller) Process(pcm []int16) []int16 {
+	reference := takeEchoReference(len(pcm))
+
+	for i, sample := range pcm {
+		d := float64(sample)
+		e.trackDelay(d, reference[i])
+
+		// Hold the reference back by the time it takes from the speaker to the microphone
+		e.delayLine[e.delayPos] = reference[i]
+		x := e.delayLine[(e.delayPos-e.delay+len(e.delayLine))%len(e.delayLine)]
+		e.delayPos = (e.delayPos + 1) % len(e.delayLine)
+
+		// Slide the reference window, newest sample first
+		e.pos = (e.pos + echoTaps - 1) % echoTaps
+		oldest := e.history[e.pos]
+		e.history[e.pos] = x
+		e.history[e.pos+echoTaps] = x
+		e.energy += x*x - oldest*oldest
+		if e.energy < 0 {
+			e.energy = 0
+		}
+
+		e.nearPow += (d*d - e.nearPow) * e.smoothing
+		e.farPow += (x*x - e.farPow) * e.smoothing
+
+		// Nothing is playing, so there is no echo to remove
+		if e.energy < 1 {
+			continue
+		}
+
+		window := e.history[e.pos : e.pos+echoTaps]
+		var estimate float64
+		for j, w := range e.weights {
+			estimate += w * window[j]
+		}
+		residual := d - estimate
+		pcm[i] = clampSample(residual)
+
+		// Freeze adaptation while the local user talks over the far end
+		if e.nearPow > echoDoubleTalk*e.farPow {
+			continue
+		}
+		step := echoStep * residual / e.energy
+		for j := range e.weights {
+			e.weights[j] += step * window[j]
+		}
+	}
+	return pcm
+}
+
+// trackDelay adds a sample pair to the envelopes and re-estimates the delay every echoEstimateBlocks.
+func (e *echoCanceller) trackDelay(near, far float64) {
+	e.blockNear += math.Abs(near)
+	e.blockFar += math.Abs(far)
+	e.blockFill++
+	if e.blockFill < echoBlock {
+		return
+	}
+
+	e.nearEnv[e.envPos] = e.blockNear / echoBlock
+	e.farEnv[e.envPos] = e.blockFar / echoBlock
+	e.envPos = (e.envPos + 1) % echoEnvelopeBlocks
+	e.blockNear, e.blockFar, e.blockFill = 0, 0, 0
+
+	e.sinceEstimate++
+	if e.sinceEstimate >= echoEstimateBlocks {
+		e.sinceEstimate = 0
+		e.estimateDelay()
+	}
+}
+
+/**
+ * estimateDelay finds the lag at which the microphone envelope best follows the speaker
+ * envelope. A lag is adopted once two estimates in a row agree on it, and the filter starts
+ * over since its weights were learned for the old alignment.
+ */
+func (e *echoCanceller) estimateDelay() {
+	near := make([]float64, echoEnvelopeBlocks)
+	far := make([]float64, echoEnvelopeBlocks)
+	var nearMean, farMean float64
+	for k := range near {
+		near[k] = e.nearEnv[(e.envPos+k)%echoEnvelopeBlocks]
+		far[k] = e.farEnv[(e.envPos+k)%echoEnvelopeBlocks]
+		nearMean += near[k]
+		farMean += far[k]
+	}
+	nearMean /= echoEnvelopeBlocks
+	farMean /= echoEnvelopeBlocks
+	for k := range near {
+		near[k] -= nearMean
+		far[k] -= farMean
+	}
+
+	bestLag, bestCorrelation := 0, 0.0
+	for lag := 0; lag <= echoMaxDelay/echoBlock; lag++ {
+		var sum, nearPow, farPow float64
+		for k := lag; k < echoEnvelopeBlocks; k++ {
+			sum += near[k] * far[k-lag]
+			nearPow += near[k] * near[k]
+			farPow += far[k-lag] * far[k-lag]
+		}
+		// Nothing, or nothing that changes, was played at this lag
+		if nearPow < 1 || farPow < 1 {
+			continue
+		}
+		if correlation := sum / math.Sqrt(nearPow*farPow); correlation > bestCorrelation {
+			bestLag, bestCorrelation = lag, correlation
+		}
+	}
+	if bestCorrelation < echoMinCorrelation {
+		return
+	}
+	if bestLag < e.candidate-1 || bestLag > e.candidate+1 {
+		e.candidate = bestLag
+		return
+	}
+
+	delay := bestLag*echoBlock - echoDelayMargin
+	if delay < 0 {
+		delay = 0
+	}
+	if delay >= e.delay-echoBlock && delay <= e.delay+echoBlock {
+		return
+	}
+
+	e.delay = delay
+	for j := range e.weights {
+		e.weights[j] = 0
+	}
+	for j := range e.history {
+		e.history[j] = 0
+	}
+	e.energy = 0
+	if debugLogging {
+		gossip_common.Dbg("Echo delay estimated at %d ms", bestLag*echoBlock*1000/audioSampleRate)
+	}
+}
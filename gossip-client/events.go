@@ -3,8 +3,9 @@ package main
 import (
 	"bufio"
 	"encoding/base64"
-	"fmt"
+	"encoding/json"
 	"net"
+	"strconv"
 
 	"gossip_common"
 
@@ -13,6 +14,8 @@ import (
 
 var (
 	serverPublicKey []byte
+	streamCipher    *gossip_common.StreamCipher // Seals stream packets with the session key we sent the server
+	loginChallenge  string                      // Challenge the server sent this connection, signed in our login proof
 )
 
 /**
@@ -22,7 +25,7 @@ var (
  * @return writer The buffered writer for the connection.
  */
 func bootstrap(a *App) (net.Conn, *bufio.Writer) {
-	addr := fmt.Sprintf("%s:%d", host, port)
+	addr := net.JoinHostPort(host, strconv.Itoa(port))
 	conn, err := net.Dial("tcp", addr)
 	if err != nil {
 		gossip_common.Err("Failed to connect to gossip server: %v", err)
@@ -36,7 +39,7 @@ func bootstrap(a *App) (net.Conn, *bufio.Writer) {
 	// Send greeting packet
 	greetingPacket := gossip_common.NewSignalPacketFromData("grtng", "", gossip_common.GetClientID(), gossip_common.RetrievePublicKey())
 
-	err = gossip_common.SendSignalPacket(writer, greetingPacket)
+	err = sendSignal(greetingPacket)
 	if err != nil {
 		gossip_common.Err("Failed to send greeting packet: %v", err)
 		return nil, nil
@@ -45,13 +48,42 @@ func bootstrap(a *App) (net.Conn, *bufio.Writer) {
 	return conn, writer
 }
 
+// sendSignal writes a signal packet to the server. Every packet goes through writerLock, so
+// packets sent from background goroutines never interleave on the connection.
+func sendSignal(packet gossip_common.GMSigPacket) error {
+	writerLock.Lock()
+	defer writerLock.Unlock()
+
+	return gossip_common.SendSignalPacket(writer, packet)
+}
+
+// sendData writes a data packet, encrypted to the given public key, to the server.
+func sendData(packet gossip_common.GMDataPacket, publicKey []byte) error {
+	writerLock.Lock()
+	defer writerLock.Unlock()
+
+	return gossip_common.SendDataPacket(writer, packet, publicKey)
+}
+
+// sendStream writes a stream packet, sealed with our session key, to the server.
+func sendStream(packet gossip_common.GMStreamPacket, cipher *gossip_common.StreamCipher) error {
+	writerLock.Lock()
+	defer writerLock.Unlock()
+
+	return gossip_common.SendStreamPacket(writer, packet, cipher)
+}
+
 /**
  * handleResponses reads and processes responses from the signaling server.
  * @param conn The connection to the signaling server.
- * @param writer The buffered writer for the connection.
  * @param a The application instance.
  */
-func handleResponses(conn net.Conn, writer *bufio.Writer, a *App) {
+func handleResponses(conn net.Conn, a *App) {
+	// Retry or give up on pairwise handshakes and held channel messages while connected
+	done := make(chan struct{})
+	defer close(done)
+	go watchPendingSessions(a, done)
+
 	scanner := bufio.NewScanner(conn)
 	for scanner.Scan() {
 		message := scanner.Text()
@@ -93,25 +125,16 @@ func handleResponses(conn net.Conn, writer *bufio.Writer, a *App) {
 			continue
 
 		} else if message[0] == '2' {
-			// decode the packet
-			// decodedPacket, err := base64.StdEncoding.DecodeString(string(message[1:]))
-			// if err != nil {
-			// 	gossip_common.Err("Failed to decode base64 GMStreamPacket: %v", err)
-			// 	continue
-			// }
-			// // decrypt the data packet
-			// decryptedPacket, err := gossip_common.GWDecrypt([]byte(decodedPacket))
-			// if err != nil {
-			// 	gossip_common.Err("Failed to decrypt GMStreamPacket: %v", err)
-			// 	continue
-			// }
-
-			// streamPacket, err := gossip_common.DeserializeGMStreamPacket(string(decryptedPacket))
-			// if err != nil {
-			// 	gossip_common.Err("Failed to deserialize GMStreamPacket: %v", err)
-			// 	continue
-			// }
-			//HandleStreamPacket(*streamPacket, a)
+			if streamCipher == nil {
+				gossip_common.Err("Ignoring GMStreamPacket received before the session key was sent")
+				continue
+			}
+			streamPacket, err := gossip_common.ReadStreamPacket(message[1:], streamCipher)
+			if err != nil {
+				gossip_common.Err("Failed to read GMStreamPacket: %v", err)
+				continue
+			}
+			handleStreamPacket(*streamPacket, a)
 			continue
 		} else {
 			gossip_common.Err("Unknown packet type prefix: %v", message[0])
@@ -120,6 +143,9 @@ func handleResponses(conn net.Conn, writer *bufio.Writer, a *App) {
 
 		// Handle received packet based on operation command
 		switch packet.OpCmd {
+		case "chlg": // login challenge packet, sent just before hru
+			loginChallenge = string(packet.Payload)
+
 		case "hru": // how are you packet
 
 			serverPublicKey = packet.Payload
@@ -127,8 +153,13 @@ func handleResponses(conn net.Conn, writer *bufio.Writer, a *App) {
 				gossip_common.Dbg("Server's public key retrieved and stored.")
 			}
 
-			// Encrypt the message with the server's public key
-			encryptedMsg, err := gossip_common.GWEncrypt([]byte(password), serverPublicKey)
+			// Sign the password and the challenge with our key and encrypt them with the server's public key
+			proof, err := json.Marshal(gossip_common.LoginProof{Password: password, Challenge: loginChallenge})
+			if err != nil {
+				gossip_common.Err("Failed to marshal login proof: %v", err)
+				continue
+			}
+			encryptedMsg, err := gossip_common.GWEncryptSigned(proof, serverPublicKey)
 			if err != nil {
 				gossip_common.Err("Failed to encrypt message: %v", err)
 				continue
@@ -138,7 +169,7 @@ func handleResponses(conn net.Conn, writer *bufio.Writer, a *App) {
 
 			// Create and send the encrypted message packet
 			msgPacket := gossip_common.NewSignalPacketFromData("ighru", "", gossip_common.GetClientID(), encryptedMsg)
-			err = gossip_common.SendSignalPacket(writer, msgPacket)
+			err = sendSignal(msgPacket)
 			if err != nil {
 				gossip_common.Err("Failed to send encrypted message packet: %v", err)
 				continue
@@ -168,9 +199,14 @@ func handleResponses(conn net.Conn, writer *bufio.Writer, a *App) {
 
 			gossip_common.Log("Securely connected to server!")
 
+			// Agree on a session key for stream packets, so audio relayed through the server needs no public key operations
+			if err := sendSessionKey(); err != nil {
+				gossip_common.Err("Failed to send session key: %v", err)
+			}
+
 			// Create and send a "give me keys" packet
 			msgPacket := gossip_common.NewSignalPacketFromData("gmk", "", gossip_common.GetClientID(), []byte(""))
-			err = gossip_common.SendSignalPacket(writer, msgPacket)
+			err = sendSignal(msgPacket)
 			if err != nil {
 				gossip_common.Err("Failed to send encrypted message packet: %v", err)
 				continue
@@ -188,10 +224,17 @@ func handleResponses(conn net.Conn, writer *bufio.Writer, a *App) {
 				continue
 			}
 
+			// The sender's ID must be the fingerprint of the key we were given
+			keyID, err := gossip_common.ClientIDFromPublicKey(decryptedKey)
+			if err != nil || keyID != packet.Sender {
+				gossip_common.Err("Rejected public key for %s: it does not match the client ID", packet.Sender)
+				continue
+			}
+
 			// Store the decrypted public key in the publicKeys map
 			publicKeys[packet.Sender] = decryptedKey
 
-			runtime.EventsEmit(a.ctx, "update-loading-status", "Received key #"+string(len(publicKeys))+"...")
+			runtime.EventsEmit(a.ctx, "update-loading-status", "Received key #"+strconv.Itoa(len(publicKeys))+"...")
 
 		case "cup": // channel update packet
 			// Decrypt the channel from the payload
@@ -207,6 +250,11 @@ func handleResponses(conn net.Conn, writer *bufio.Writer, a *App) {
 
 			runtime.EventsEmit(a.ctx, "channel-update", string(decryptedChannel))
 
+		case "ice_servers": // STUN and TURN servers to use for calls
+			if err := handleICEServers(packet.Payload); err != nil {
+				gossip_common.Err("Failed to handle ICE servers: %v", err)
+			}
+
 		case "eok": // end of keys packet
 			gossip_common.Log("Client keys received. Booting...")
 			runtime.EventsEmit(a.ctx, "finish-loading-status")
@@ -215,14 +263,20 @@ func handleResponses(conn net.Conn, writer *bufio.Writer, a *App) {
 			runtime.EventsEmit(a.ctx, "call_active", callID)
 
 		case "participent":
+			rosterJoin(a, packet.Destination)
+
 			// send offer to the destination
 			runtime.EventsEmit(a.ctx, "call_sending_offer")
-			SendOfferToClient(packet.Destination, a, writer)
+			if err := SendOfferToClient(packet.Destination, a); err != nil {
+				gossip_common.Err("Failed to send offer to %s: %v", packet.Destination, err)
+			}
 
 		case "offer":
 			// Send the offer to the signaling server
 			runtime.EventsEmit(a.ctx, "call_received_offer")
-			HandleOffer(packet.Sender, packet.Payload, writer, a)
+			if err := HandleOffer(packet.Sender, packet.Payload, a); err != nil {
+				gossip_common.Err("Failed to handle offer from %s: %v", packet.Sender, err)
+			}
 
 		case "answer":
 			runtime.EventsEmit(a.ctx, "call_received_answer")
@@ -232,6 +286,58 @@ func handleResponses(conn net.Conn, writer *bufio.Writer, a *App) {
 			runtime.EventsEmit(a.ctx, "call_received_ice", callID)
 			HandleICECandidate(packet.Sender, packet.Payload)
 
+		case "ckey": // call key packet
+			if err := HandleCallKey(packet.Sender, packet.Payload); err != nil {
+				gossip_common.Err("Failed to handle call key: %v", err)
+			}
+
+		case "cack": // a participant stored our call key
+			if err := HandleCallKeyAck(packet.Sender, packet.Payload); err != nil {
+				gossip_common.Err("Failed to handle call key acknowledgement: %v", err)
+			}
+
+		case "call_join": // a participant joined our call
+			rosterJoin(a, packet.Sender)
+			runtime.EventsEmit(a.ctx, "call-participant-joined", packet.Sender)
+
+			// Newcomers only learn our state if it differs from the default
+			if muted || deafened {
+				sendCallState(a)
+			}
+
+		case "call_leave": // a participant left our call
+			closeParticipant(packet.Sender)
+			rosterLeave(a, packet.Sender)
+			runtime.EventsEmit(a.ctx, "call-participant-left", packet.Sender)
+
+		case "call_ended": // the call ended because nobody else is left in it
+			a.endCall(string(packet.Payload))
+			runtime.EventsEmit(a.ctx, "call-ended", string(packet.Payload))
+
+		case "calls": // active call list
+			handleCallList(packet.Payload)
+
+		case "call_state": // a participant muted or deafened
+			handleCallState(a, packet.Sender, packet.Payload)
+
+		case "ring": // incoming call invitation
+			runtime.EventsEmit(a.ctx, "call-incoming", string(packet.Payload), packet.Sender)
+
+		case "invite_accepted":
+			runtime.EventsEmit(a.ctx, "call-accepted", string(packet.Payload), packet.Sender)
+
+		case "invite_declined":
+			runtime.EventsEmit(a.ctx, "call-declined", string(packet.Payload), packet.Sender)
+
+		case "invite_missed": // an invitee did not answer our call
+			runtime.EventsEmit(a.ctx, "call-missed", string(packet.Payload), packet.Sender, false)
+
+		case "call_missed": // we did not answer an incoming call
+			runtime.EventsEmit(a.ctx, "call-missed", string(packet.Payload), packet.Sender, true)
+
+		case "ring_cancel": // the call we were rung for has ended
+			runtime.EventsEmit(a.ctx, "call-cancelled", string(packet.Payload), packet.Sender)
+
 		case "c404": // call not found packet
 			runtime.EventsEmit(a.ctx, "call_not_found", callID)
 
@@ -245,6 +351,20 @@ func handleResponses(conn net.Conn, writer *bufio.Writer, a *App) {
 			runtime.EventsEmit(a.ctx, "unauthorized")
 			continue
 
+		case "403": // client ID not bound to key, or login proof rejected packet
+			gossip_common.Err("Server rejected our client ID or our login proof for our public key!")
+			conn.Close()
+
+			runtime.EventsEmit(a.ctx, "server-disconnect")
+			continue
+
+		case "409": // client ID conflict packet
+			gossip_common.Err("Client ID is already registered on the server!")
+			conn.Close()
+
+			runtime.EventsEmit(a.ctx, "server-disconnect")
+			continue
+
 		case "rmk": // remove key packet
 			if debugLogging {
 				gossip_common.Dbg("RMK received from %s. Removing their key.", packet.Sender)
@@ -252,6 +372,7 @@ func handleResponses(conn net.Conn, writer *bufio.Writer, a *App) {
 
 			// Remove the key from the publicKeys map
 			delete(publicKeys, packet.Sender)
+			forgetPeer(packet.Sender)
 
 		default:
 			gossip_common.Err("Unknown operation command: %s", packet.OpCmd)
@@ -263,3 +384,27 @@ func handleResponses(conn net.Conn, writer *bufio.Writer, a *App) {
 		gossip_common.Err("Error reading from connection: %v", err)
 	}
 }
+
+/**
+ * sendSessionKey generates the symmetric key stream packets to and from the server are sealed
+ * with, and sends it to the server encrypted with its public key.
+ * @return error Error if the key could not be generated or sent.
+ */
+func sendSessionKey() error {
+	sessionKey, err := gossip_common.GenerateSessionKey()
+	if err != nil {
+		return err
+	}
+	cipher, err := gossip_common.NewStreamCipher(sessionKey, true)
+	if err != nil {
+		return err
+	}
+	encryptedKey, err := gossip_common.GWEncrypt(sessionKey, serverPublicKey)
+	if err != nil {
+		return err
+	}
+
+	streamCipher = cipher
+	keyPacket := gossip_common.NewSignalPacketFromData("skey", "", gossip_common.GetClientID(), encryptedKey)
+	return sendSignal(keyPacket)
+}
@@ -1,21 +1,78 @@
 // Cynhyrchwyd y ffeil hon yn awtomatig. PEIDIWCH Â MODIWL
 // This file is automatically generated. DO NOT EDIT
+import {gossip_common} from '../models';
 import {main} from '../models';
 
+export function AcceptCall(arg1:string):Promise<void>;
+
 export function Boot(arg1:string,arg2:number,arg3:string,arg4:string):Promise<void>;
 
+export function DeclineCall(arg1:string):Promise<void>;
+
 export function Disconnect():Promise<void>;
 
+export function GetCallRoster():Promise<Array<main.RosterEntry>>;
+
+export function GetCallStats():Promise<Array<main.CallStats>>;
+
+export function GetICEServers():Promise<Array<gossip_common.ICEServer>>;
+
+export function GetParticipantVolume(arg1:string):Promise<number>;
+
+export function GetPlaybackStats():Promise<Array<main.PlaybackStats>>;
+
+export function GetScreenShareConfig():Promise<main.ScreenShareConfig>;
+
+export function GetVideoConfig():Promise<main.VideoConfig>;
+
+export function InviteToCall(arg1:Array<string>):Promise<void>;
+
+export function IsParticipantMuted(arg1:string):Promise<boolean>;
+
+export function ListActiveCalls():Promise<Array<gossip_common.CallSummary>>;
+
+export function ListAudioDevices():Promise<main.AudioDevices>;
+
 export function LoadSettings():Promise<main.Settings>;
 
+export function PushToTalkPressed():Promise<void>;
+
+export function PushToTalkReleased():Promise<void>;
+
 export function SaveSettings(arg1:main.Settings):Promise<void>;
 
+export function SendDirectMessage(arg1:string,arg2:number,arg3:string):Promise<void>;
+
 export function SendMessage(arg1:string,arg2:number,arg3:string):Promise<void>;
 
+export function SendScreenFrame(arg1:string):Promise<void>;
+
+export function SendVideoFrame(arg1:string):Promise<void>;
+
+export function SetCaptureDevice(arg1:string):Promise<void>;
+
+export function SetParticipantMuted(arg1:string,arg2:boolean):Promise<void>;
+
+export function SetParticipantVolume(arg1:string,arg2:number):Promise<void>;
+
+export function SetPlaybackDevice(arg1:string):Promise<void>;
+
+export function SetScreenShareLimits(arg1:number,arg2:number,arg3:number):Promise<void>;
+
+export function SetVideoQuality(arg1:number,arg2:number,arg3:number):Promise<void>;
+
+export function StartCamera():Promise<void>;
+
 export function StartRecording():Promise<void>;
 
+export function StartScreenShare(arg1:string):Promise<void>;
+
+export function StopCamera():Promise<void>;
+
 export function StopRecording():Promise<void>;
 
+export function StopScreenShare():Promise<void>;
+
 export function ToggleGoDeaf():Promise<void>;
 
 export function ToggleGoMute():Promise<void>;
@@ -2,34 +2,146 @@
 // Cynhyrchwyd y ffeil hon yn awtomatig. PEIDIWCH Â MODIWL
 // This file is automatically generated. DO NOT EDIT
 
+export function AcceptCall(arg1) {
+  return window['go']['main']['App']['AcceptCall'](arg1);
+}
+
 export function Boot(arg1, arg2, arg3, arg4) {
   return window['go']['main']['App']['Boot'](arg1, arg2, arg3, arg4);
 }
 
+export function DeclineCall(arg1) {
+  return window['go']['main']['App']['DeclineCall'](arg1);
+}
+
 export function Disconnect() {
   return window['go']['main']['App']['Disconnect']();
 }
 
+export function GetCallRoster() {
+  return window['go']['main']['App']['GetCallRoster']();
+}
+
+export function GetCallStats() {
+  return window['go']['main']['App']['GetCallStats']();
+}
+
+export function GetICEServers() {
+  return window['go']['main']['App']['GetICEServers']();
+}
+
+export function GetParticipantVolume(arg1) {
+  return window['go']['main']['App']['GetParticipantVolume'](arg1);
+}
+
+export function GetPlaybackStats() {
+  return window['go']['main']['App']['GetPlaybackStats']();
+}
+
+export function GetScreenShareConfig() {
+  return window['go']['main']['App']['GetScreenShareConfig']();
+}
+
+export function GetVideoConfig() {
+  return window['go']['main']['App']['GetVideoConfig']();
+}
+
+export function InviteToCall(arg1) {
+  return window['go']['main']['App']['InviteToCall'](arg1);
+}
+
+export function IsParticipantMuted(arg1) {
+  return window['go']['main']['App']['IsParticipantMuted'](arg1);
+}
+
+export function ListActiveCalls() {
+  return window['go']['main']['App']['ListActiveCalls']();
+}
+
+export function ListAudioDevices() {
+  return window['go']['main']['App']['ListAudioDevices']();
+}
+
 export function LoadSettings() {
   return window['go']['main']['App']['LoadSettings']();
 }
 
+export function PushToTalkPressed() {
+  return window['go']['main']['App']['PushToTalkPressed']();
+}
+
+export function PushToTalkReleased() {
+  return window['go']['main']['App']['PushToTalkReleased']();
+}
+
 export function SaveSettings(arg1) {
   return window['go']['main']['App']['SaveSettings'](arg1);
 }
 
+export function SendDirectMessage(arg1, arg2, arg3) {
+  return window['go']['main']['App']['SendDirectMessage'](arg1, arg2, arg3);
+}
+
 export function SendMessage(arg1, arg2, arg3) {
   return window['go']['main']['App']['SendMessage'](arg1, arg2, arg3);
 }
 
+export function SendScreenFrame(arg1) {
+  return window['go']['main']['App']['SendScreenFrame'](arg1);
+}
+
+export function SendVideoFrame(arg1) {
+  return window['go']['main']['App']['SendVideoFrame'](arg1);
+}
+
+export function SetCaptureDevice(arg1) {
+  return window['go']['main']['App']['SetCaptureDevice'](arg1);
+}
+
+export function SetParticipantMuted(arg1, arg2) {
+  return window['go']['main']['App']['SetParticipantMuted'](arg1, arg2);
+}
+
+export function SetParticipantVolume(arg1, arg2) {
+  return window['go']['main']['App']['SetParticipantVolume'](arg1, arg2);
+}
+
+export function SetPlaybackDevice(arg1) {
+  return window['go']['main']['App']['SetPlaybackDevice'](arg1);
+}
+
+export function SetScreenShareLimits(arg1, arg2, arg3) {
+  return window['go']['main']['App']['SetScreenShareLimits'](arg1, arg2, arg3);
+}
+
+export function SetVideoQuality(arg1, arg2, arg3) {
+  return window['go']['main']['App']['SetVideoQuality'](arg1, arg2, arg3);
+}
+
+export function StartCamera() {
+  return window['go']['main']['App']['StartCamera']();
+}
+
 export function StartRecording() {
   return window['go']['main']['App']['StartRecording']();
 }
 
+export function StartScreenShare(arg1) {
+  return window['go']['main']['App']['StartScreenShare'](arg1);
+}
+
+export function StopCamera() {
+  return window['go']['main']['App']['StopCamera']();
+}
+
 export function StopRecording() {
   return window['go']['main']['App']['StopRecording']();
 }
 
+export function StopScreenShare() {
+  return window['go']['main']['App']['StopScreenShare']();
+}
+
 export function ToggleGoDeaf() {
   return window['go']['main']['App']['ToggleGoDeaf']();
 }
@@ -1,10 +1,274 @@
+export namespace gossip_common {
+	
+	export class CallParticipantSummary {
+	    id: string;
+	    joined: number;
+	
+	    static createFrom(source: any = {}) {
+	        return new CallParticipantSummary(source);
+	    }
+	
+	    constructor(source: any = {}) {
+	        if ('string' === typeof source) source = JSON.parse(source);
+	        this.id = source["id"];
+	        this.joined = source["joined"];
+	    }
+	}
+	
+	export class CallSummary {
+	    call?: string;
+	    participants: Array<CallParticipantSummary>;
+	    started: number;
+	    duration: number;
+	
+	    static createFrom(source: any = {}) {
+	        return new CallSummary(source);
+	    }
+	
+	    constructor(source: any = {}) {
+	        if ('string' === typeof source) source = JSON.parse(source);
+	        this.call = source["call"];
+	        this.participants = this.convertValues(source["participants"], CallParticipantSummary);
+	        this.started = source["started"];
+	        this.duration = source["duration"];
+	    }
+	
+		convertValues(a: any, classs: any, asMap: boolean = false): any {
+		    if (!a) {
+		        return a;
+		    }
+		    if (a.slice && a.map) {
+		        return (a as any[]).map(elem => this.convertValues(elem, classs));
+		    } else if ("object" === typeof a) {
+		        if (asMap) {
+		            for (const key of Object.keys(a)) {
+		                a[key] = new classs(a[key]);
+		            }
+		            return a;
+		        }
+		        return new classs(a);
+		    }
+		    return a;
+		}
+	}
+	
+	export class ICEServer {
+	    urls: Array<string>;
+	    username?: string;
+	    credential?: string;
+	
+	    static createFrom(source: any = {}) {
+	        return new ICEServer(source);
+	    }
+	
+	    constructor(source: any = {}) {
+	        if ('string' === typeof source) source = JSON.parse(source);
+	        this.urls = source["urls"];
+	        this.username = source["username"];
+	        this.credential = source["credential"];
+	    }
+	}
+
+}
+
 export namespace main {
 	
+	export class AudioDevice {
+	    id: string;
+	    name: string;
+	    default: boolean;
+	
+	    static createFrom(source: any = {}) {
+	        return new AudioDevice(source);
+	    }
+	
+	    constructor(source: any = {}) {
+	        if ('string' === typeof source) source = JSON.parse(source);
+	        this.id = source["id"];
+	        this.name = source["name"];
+	        this.default = source["default"];
+	    }
+	}
+	
+	export class AudioDevices {
+	    capture: Array<AudioDevice>;
+	    playback: Array<AudioDevice>;
+	    selectedCapture: string;
+	    selectedPlayback: string;
+	
+	    static createFrom(source: any = {}) {
+	        return new AudioDevices(source);
+	    }
+	
+	    constructor(source: any = {}) {
+	        if ('string' === typeof source) source = JSON.parse(source);
+	        this.capture = this.convertValues(source["capture"], AudioDevice);
+	        this.playback = this.convertValues(source["playback"], AudioDevice);
+	        this.selectedCapture = source["selectedCapture"];
+	        this.selectedPlayback = source["selectedPlayback"];
+	    }
+	
+		convertValues(a: any, classs: any, asMap: boolean = false): any {
+		    if (!a) {
+		        return a;
+		    }
+		    if (a.slice && a.map) {
+		        return (a as any[]).map(elem => this.convertValues(elem, classs));
+		    } else if ("object" === typeof a) {
+		        if (asMap) {
+		            for (const key of Object.keys(a)) {
+		                a[key] = new classs(a[key]);
+		            }
+		            return a;
+		        }
+		        return new classs(a);
+		    }
+		    return a;
+		}
+	}
+	
+	export class CallStats {
+	    id: string;
+	    roundTripTime: number;
+	    packetLoss: number;
+	    jitter: number;
+	    sendBitrate: number;
+	    receiveBitrate: number;
+	    bufferDepth: number;
+	    candidateType: string;
+	    codec: string;
+	
+	    static createFrom(source: any = {}) {
+	        return new CallStats(source);
+	    }
+	
+	    constructor(source: any = {}) {
+	        if ('string' === typeof source) source = JSON.parse(source);
+	        this.id = source["id"];
+	        this.roundTripTime = source["roundTripTime"];
+	        this.packetLoss = source["packetLoss"];
+	        this.jitter = source["jitter"];
+	        this.sendBitrate = source["sendBitrate"];
+	        this.receiveBitrate = source["receiveBitrate"];
+	        this.bufferDepth = source["bufferDepth"];
+	        this.candidateType = source["candidateType"];
+	        this.codec = source["codec"];
+	    }
+	}
+	
+	export class PlaybackStats {
+	    id: string;
+	    depth: number;
+	    target: number;
+	    jitter: number;
+	    received: number;
+	    late: number;
+	    lost: number;
+	    dropped: number;
+	    underruns: number;
+	
+	    static createFrom(source: any = {}) {
+	        return new PlaybackStats(source);
+	    }
+	
+	    constructor(source: any = {}) {
+	        if ('string' === typeof source) source = JSON.parse(source);
+	        this.id = source["id"];
+	        this.depth = source["depth"];
+	        this.target = source["target"];
+	        this.jitter = source["jitter"];
+	        this.received = source["received"];
+	        this.late = source["late"];
+	        this.lost = source["lost"];
+	        this.dropped = source["dropped"];
+	        this.underruns = source["underruns"];
+	    }
+	}
+	
+	export class RosterEntry {
+	    id: string;
+	    self: boolean;
+	    muted: boolean;
+	    deafened: boolean;
+	    talking: boolean;
+	    camera: boolean;
+	    screen: boolean;
+	    connected: boolean;
+	    relayed: boolean;
+	    quality: string;
+	    joined: number;
+	
+	    static createFrom(source: any = {}) {
+	        return new RosterEntry(source);
+	    }
+	
+	    constructor(source: any = {}) {
+	        if ('string' === typeof source) source = JSON.parse(source);
+	        this.id = source["id"];
+	        this.self = source["self"];
+	        this.muted = source["muted"];
+	        this.deafened = source["deafened"];
+	        this.talking = source["talking"];
+	        this.camera = source["camera"];
+	        this.screen = source["screen"];
+	        this.connected = source["connected"];
+	        this.relayed = source["relayed"];
+	        this.quality = source["quality"];
+	        this.joined = source["joined"];
+	    }
+	}
+	
+	export class ScreenShareConfig {
+	    surface: string;
+	    width: number;
+	    height: number;
+	    framerate: number;
+	    codec: string;
+	
+	    static createFrom(source: any = {}) {
+	        return new ScreenShareConfig(source);
+	    }
+	
+	    constructor(source: any = {}) {
+	        if ('string' === typeof source) source = JSON.parse(source);
+	        this.surface = source["surface"];
+	        this.width = source["width"];
+	        this.height = source["height"];
+	        this.framerate = source["framerate"];
+	        this.codec = source["codec"];
+	    }
+	}
+	
 	export class Settings {
 	    selectedTheme: string;
 	    defaultUsername: string;
 	    defaultHost: string;
 	    defaultPort: string;
+	    opusBitrate: number;
+	    opusFrameSize: number;
+	    opusFec: boolean;
+	    encryptMediaFrames: boolean;
+	    inputMode: string;
+	    vadSensitivity: number;
+	    pushToTalkKey: string;
+	    pushToTalkRelease: number;
+	    highPassFilter: boolean;
+	    noiseSuppression: boolean;
+	    echoCancellation: boolean;
+	    captureDevice: string;
+	    playbackDevice: string;
+	    videoCodec: string;
+	    videoWidth: number;
+	    videoHeight: number;
+	    videoFramerate: number;
+	    screenWidth: number;
+	    screenHeight: number;
+	    screenFramerate: number;
+	    iceServers: Array<gossip_common.ICEServer>;
+	    relayOnly: boolean;
+	    usePublicStun: boolean;
+	    callMode: string;
+	    peerGracePeriod: number;
 	
 	    static createFrom(source: any = {}) {
 	        return new Settings(source);
@@ -16,6 +280,68 @@ export namespace main {
 	        this.defaultUsername = source["defaultUsername"];
 	        this.defaultHost = source["defaultHost"];
 	        this.defaultPort = source["defaultPort"];
+	        this.opusBitrate = source["opusBitrate"];
+	        this.opusFrameSize = source["opusFrameSize"];
+	        this.opusFec = source["opusFec"];
+	        this.encryptMediaFrames = source["encryptMediaFrames"];
+	        this.inputMode = source["inputMode"];
+	        this.vadSensitivity = source["vadSensitivity"];
+	        this.pushToTalkKey = source["pushToTalkKey"];
+	        this.pushToTalkRelease = source["pushToTalkRelease"];
+	        this.highPassFilter = source["highPassFilter"];
+	        this.noiseSuppression = source["noiseSuppression"];
+	        this.echoCancellation = source["echoCancellation"];
+	        this.captureDevice = source["captureDevice"];
+	        this.playbackDevice = source["playbackDevice"];
+	        this.videoCodec = source["videoCodec"];
+	        this.videoWidth = source["videoWidth"];
+	        this.videoHeight = source["videoHeight"];
+	        this.videoFramerate = source["videoFramerate"];
+	        this.screenWidth = source["screenWidth"];
+	        this.screenHeight = source["screenHeight"];
+	        this.screenFramerate = source["screenFramerate"];
+	        this.iceServers = this.convertValues(source["iceServers"], gossip_common.ICEServer);
+	        this.relayOnly = source["relayOnly"];
+	        this.usePublicStun = source["usePublicStun"];
+	        this.callMode = source["callMode"];
+	        this.peerGracePeriod = source["peerGracePeriod"];
+	    }
+	
+		convertValues(a: any, classs: any, asMap: boolean = false): any {
+		    if (!a) {
+		        return a;
+		    }
+		    if (a.slice && a.map) {
+		        return (a as any[]).map(elem => this.convertValues(elem, classs));
+		    } else if ("object" === typeof a) {
+		        if (asMap) {
+		            for (const key of Object.keys(a)) {
+		                a[key] = new classs(a[key]);
+		            }
+		            return a;
+		        }
+		        return new classs(a);
+		    }
+		    return a;
+		}
+	}
+	
+	export class VideoConfig {
+	    width: number;
+	    height: number;
+	    framerate: number;
+	    codec: string;
+	
+	    static createFrom(source: any = {}) {
+	        return new VideoConfig(source);
+	    }
+	
+	    constructor(source: any = {}) {
+	        if ('string' === typeof source) source = JSON.parse(source);
+	        this.width = source["width"];
+	        this.height = source["height"];
+	        this.framerate = source["framerate"];
+	        this.codec = source["codec"];
 	    }
 	}
 
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"errors"
+	"math"
+	"sync"
+)
+
+const (
+	agcTargetLevel  = 0.25  // Level the AGC steers speech towards, as a fraction of full scale (about -12 dBFS)
+	agcNoiseFloor   = 0.015 // Below this level the gain is held so background noise is not pumped up
+	agcMaxGain      = 8.0
+	agcMinGain      = 0.1
+	agcAttackTime   = 0.005 // Seconds for the level follower to catch a rising signal
+	agcReleaseTime  = 0.300 // Seconds for the level follower to fall back after a peak
+	agcGainDownTime = 0.010 // Seconds for the gain to drop when the signal gets louder
+	agcGainUpTime   = 1.500 // Seconds for the gain to recover when the signal gets quieter
+	limiterKnee     = 0.8   // Mixed level above which the soft limiter starts compressing
+	maxVolume       = 2.0   // Largest per-participant volume
+)
+
+var (
+	participantVolumes = make(map[string]float64) // Volume chosen by the user for each participant, 1 when unset
+	participantMutes   = make(map[string]bool)    // Participants the user silenced locally
+	volumeLock         sync.Mutex
+)
+
+// gainControl is a streaming automatic gain control. Its output is limited after mixing.
+// It only looks at each sample once, so its cost does not grow with the call length.
+type gainControl struct {
+	envelope float64
+	gain     float64
+
+	envAttack  float64
+	envRelease float64
+	gainDown   float64
+	gainUp     float64
+}
+
+// newGainControl creates a gain control with unity gain.
+func newGainControl() *gainControl {
+	return &gainControl{
+		gain:       1,
+		envAttack:  smoothingCoefficient(agcAttackTime),
+		envRelease: smoothingCoefficient(agcReleaseTime),
+		gainDown:   smoothingCoefficient(agcGainDownTime),
+		gainUp:     smoothingCoefficient(agcGainUpTime),
+	}
+}
+
+// smoothingCoefficient returns the one-pole filter coefficient for a time constant.
+func smoothingCoefficient(seconds float64) float64 {
+	return 1 - math.Exp(-1/(seconds*audioSampleRate))
+}
+
+// process levels a frame and applies the user volume, returning samples scaled to full scale 1.
+func (g *gainControl) process(pcm []int16, volume float64) []float64 {
+	out := make([]float64, len(pcm))
+	for i, sample := range pcm {
+		x := float64(sample) / 32768
+
+		// Follow the signal level with a fast attack and slow release
+		level := math.Abs(x)
+		if level > g.envelope {
+			g.envelope += (level - g.envelope) * g.envAttack
+		} else {
+			g.envelope += (level - g.envelope) * g.envRelease
+		}
+
+		// Steer the gain towards the target, dropping quickly and recovering slowly
+		if g.envelope > agcNoiseFloor {
+			desired := math.Max(agcMinGain, math.Min(agcMaxGain, agcTargetLevel/g.envelope))
+			if desired < g.gain {
+				g.gain += (desired - g.gain) * g.gainDown
+			} else {
+				g.gain += (desired - g.gain) * g.gainUp
+			}
+		}
+
+		out[i] = x * g.gain * volume
+	}
+	return out
+}
+
+// softLimit passes levels below the knee unchanged and bends louder ones smoothly towards full scale.
+func softLimit(x float64) float64 {
+	level := math.Abs(x)
+	if level <= limiterKnee {
+		return x
+	}
+	limited := limiterKnee + (1-limiterKnee)*math.Tanh((level-limiterKnee)/(1-limiterKnee))
+	return math.Copysign(limited, x)
+}
+
+/**
+ * SetParticipantVolume sets how loud a participant is played, applied after the AGC
+ * @param id The participant's client ID
+ * @param volume The volume from 0 (silent) to 2 (double), 1 being normal
+ * @return error Error if the volume is out of range
+ */
+func (a *App) SetParticipantVolume(id string, volume float64) error {
+	if volume < 0 || volume > maxVolume || math.IsNaN(volume) {
+		return errors.New("volume must be between 0 and 2")
+	}
+
+	volumeLock.Lock()
+	participantVolumes[id] = volume
+	volumeLock.Unlock()
+
+	if mixer := currentMixer(); mixer != nil {
+		mixer.SetVolume(id, volume)
+	}
+	return nil
+}
+
+/**
+ * GetParticipantVolume returns the volume set for a participant
+ * @param id The participant's client ID
+ * @return float64 The volume, 1 if it was never changed
+ */
+func (a *App) GetParticipantVolume(id string) float64 {
+	return participantVolume(id)
+}
+
+/**
+ * SetParticipantMuted silences or restores a participant for the local user only
+ * @param id The participant's client ID
+ * @param muted Whether the participant should be silenced
+ */
+func (a *App) SetParticipantMuted(id string, muted bool) {
+	volumeLock.Lock()
+	if muted {
+		participantMutes[id] = true
+	} else {
+		delete(participantMutes, id)
+	}
+	volumeLock.Unlock()
+
+	if mixer := currentMixer(); mixer != nil {
+		mixer.SetMuted(id, muted)
+	}
+}
+
+/**
+ * IsParticipantMuted reports whether a participant was silenced with SetParticipantMuted
+ * @param id The participant's client ID
+ * @return bool Whether the participant is silenced
+ */
+func (a *App) IsParticipantMuted(id string) bool {
+	return participantMuted(id)
+}
+
+// participantMuted reports whether the user silenced a participant.
+func participantMuted(id string) bool {
+	volumeLock.Lock()
+	defer volumeLock.Unlock()
+
+	return participantMutes[id]
+}
+
+// participantVolume returns the volume set for a participant, 1 if it was never changed.
+func participantVolume(id string) float64 {
+	volumeLock.Lock()
+	defer volumeLock.Unlock()
+
+	if volume, exists := participantVolumes[id]; exists {
+		return volume
+	}
+	return 1
+}
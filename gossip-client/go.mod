@@ -8,8 +8,13 @@ replace gossip_common => ../gossip-common
 
 require (
 	github.com/gen2brain/malgo v0.11.22
+	github.com/pion/interceptor v0.1.29
+	github.com/pion/rtcp v1.2.14
+	github.com/pion/rtp v1.8.6
 	github.com/pion/webrtc/v4 v4.0.0-beta.18
 	github.com/wailsapp/wails/v2 v2.8.1
+	golang.design/x/hotkey v0.4.1
+	gopkg.in/hraban/opus.v2 v2.0.0-20230925203106-0188a62cb302
 	gossip_common v0.0.0-00010101000000-000000000000
 )
 
@@ -32,12 +37,9 @@ require (
 	github.com/pion/datachannel v1.5.6 // indirect
 	github.com/pion/dtls/v2 v2.2.10 // indirect
 	github.com/pion/ice/v3 v3.0.6 // indirect
-	github.com/pion/interceptor v0.1.29 // indirect
 	github.com/pion/logging v0.2.2 // indirect
 	github.com/pion/mdns/v2 v2.0.7 // indirect
 	github.com/pion/randutil v0.1.0 // indirect
-	github.com/pion/rtcp v1.2.14 // indirect
-	github.com/pion/rtp v1.8.6 // indirect
 	github.com/pion/sctp v1.8.16 // indirect
 	github.com/pion/sdp/v3 v3.0.9 // indirect
 	github.com/pion/srtp/v3 v3.0.1 // indirect
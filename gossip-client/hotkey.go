@@ -0,0 +1,118 @@
+//go:build hotkey
+
+package main
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+
+	"golang.design/x/hotkey"
+)
+
+var (
+	globalHotkey     *hotkey.Hotkey
+	globalHotkeyLock sync.Mutex
+	globalHotkeyDone chan struct{}
+)
+
+// hotkeyKeys maps key names used in Settings to hotkey key codes.
+var hotkeyKeys = map[string]hotkey.Key{
+	"SPACE": hotkey.KeySpace, "TAB": hotkey.KeyTab, "RETURN": hotkey.KeyReturn, "ENTER": hotkey.KeyReturn,
+	"ESCAPE": hotkey.KeyEscape, "DELETE": hotkey.KeyDelete,
+	"LEFT": hotkey.KeyLeft, "RIGHT": hotkey.KeyRight, "UP": hotkey.KeyUp, "DOWN": hotkey.KeyDown,
+	"F1": hotkey.KeyF1, "F2": hotkey.KeyF2, "F3": hotkey.KeyF3, "F4": hotkey.KeyF4,
+	"F5": hotkey.KeyF5, "F6": hotkey.KeyF6, "F7": hotkey.KeyF7, "F8": hotkey.KeyF8,
+	"F9": hotkey.KeyF9, "F10": hotkey.KeyF10, "F11": hotkey.KeyF11, "F12": hotkey.KeyF12,
+	"0": hotkey.Key0, "1": hotkey.Key1, "2": hotkey.Key2, "3": hotkey.Key3, "4": hotkey.Key4,
+	"5": hotkey.Key5, "6": hotkey.Key6, "7": hotkey.Key7, "8": hotkey.Key8, "9": hotkey.Key9,
+	"A": hotkey.KeyA, "B": hotkey.KeyB, "C": hotkey.KeyC, "D": hotkey.KeyD, "E": hotkey.KeyE,
+	"F": hotkey.KeyF, "G": hotkey.KeyG, "H": hotkey.KeyH, "I": hotkey.KeyI, "J": hotkey.KeyJ,
+	"K": hotkey.KeyK, "L": hotkey.KeyL, "M": hotkey.KeyM, "N": hotkey.KeyN, "O": hotkey.KeyO,
+	"P": hotkey.KeyP, "Q": hotkey.KeyQ, "R": hotkey.KeyR, "S": hotkey.KeyS, "T": hotkey.KeyT,
+	"U": hotkey.KeyU, "V": hotkey.KeyV, "W": hotkey.KeyW, "X": hotkey.KeyX, "Y": hotkey.KeyY,
+	"Z": hotkey.KeyZ,
+}
+
+/**
+ * parseHotkey turns a key such as "Ctrl+Shift+T" into modifiers and a key code.
+ * Only Ctrl and Shift are accepted as modifiers since they exist on every platform.
+ * @param key The key from Settings.
+ * @return The modifiers, the key code and an error if the key is not recognised.
+ */
+func parseHotkey(key string) ([]hotkey.Modifier, hotkey.Key, error) {
+	var mods []hotkey.Modifier
+	parts := strings.Split(key, "+")
+	for _, part := range parts[:len(parts)-1] {
+		switch strings.ToUpper(strings.TrimSpace(part)) {
+		case "CTRL", "CONTROL":
+			mods = append(mods, hotkey.ModCtrl)
+		case "SHIFT":
+			mods = append(mods, hotkey.ModShift)
+		default:
+			return nil, 0, fmt.Errorf("unsupported modifier %q", part)
+		}
+	}
+
+	name := strings.ToUpper(strings.TrimSpace(parts[len(parts)-1]))
+	code, exists := hotkeyKeys[name]
+	if !exists {
+		return nil, 0, fmt.Errorf("unsupported key %q", name)
+	}
+	return mods, code, nil
+}
+
+/**
+ * registerPushToTalkHotkey grabs the push-to-talk key system wide, so it works while
+ * the window is in the background.
+ * @param a The application instance.
+ * @param key The key from Settings.
+ * @return An error if the key is invalid or already taken.
+ */
+func registerPushToTalkHotkey(a *App, key string) error {
+	mods, code, err := parseHotkey(key)
+	if err != nil {
+		return err
+	}
+
+	unregisterPushToTalkHotkey()
+
+	hk := hotkey.New(mods, code)
+	if err := hk.Register(); err != nil {
+		return fmt.Errorf("failed to register %s: %v", key, err)
+	}
+
+	done := make(chan struct{})
+	globalHotkeyLock.Lock()
+	globalHotkey = hk
+	globalHotkeyDone = done
+	globalHotkeyLock.Unlock()
+
+	go func() {
+		for {
+			select {
+			case <-hk.Keydown():
+				a.PushToTalkPressed()
+			case <-hk.Keyup():
+				a.PushToTalkReleased()
+			case <-done:
+				return
+			}
+		}
+	}()
+	return nil
+}
+
+// unregisterPushToTalkHotkey releases the global push-to-talk key.
+func unregisterPushToTalkHotkey() {
+	globalHotkeyLock.Lock()
+	defer globalHotkeyLock.Unlock()
+
+	if globalHotkey == nil {
+		return
+	}
+	close(globalHotkeyDone)
+	globalHotkey.Unregister()
+	globalHotkey = nil
+	globalHotkeyDone = nil
+}
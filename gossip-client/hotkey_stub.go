@@ -0,0 +1,15 @@
+//go:build !hotkey
+
+package main
+
+import "errors"
+
+var errHotkeyUnavailable = errors.New("global hotkeys are not built in, rebuild with -tags hotkey")
+
+// registerPushToTalkHotkey reports that this build has no global hotkey support.
+func registerPushToTalkHotkey(a *App, key string) error {
+	return errHotkeyUnavailable
+}
+
+// unregisterPushToTalkHotkey does nothing without global hotkey support.
+func unregisterPushToTalkHotkey() {}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"strings"
+	"sync"
+
+	"gossip_common"
+
+	"github.com/pion/webrtc/v4"
+)
+
+const publicSTUNServer = "stun:stun.l.google.com:19302" // Used only when usePublicStun is set and no other ICE server is known
+
+var (
+	serverICEServers []gossip_common.ICEServer // Pushed by the server at login
+	iceLock          sync.Mutex
+)
+
+/**
+ * handleICEServers stores the ICE servers the server pushed in an "ice_servers" packet.
+ * @param payload The list encrypted with our public key.
+ * @return error Error if the list could not be decrypted or parsed.
+ */
+func handleICEServers(payload []byte) error {
+	decrypted, err := gossip_common.GWDecrypt(payload)
+	if err != nil {
+		return err
+	}
+
+	var servers []gossip_common.ICEServer
+	if err := json.Unmarshal(decrypted, &servers); err != nil {
+		return err
+	}
+
+	iceLock.Lock()
+	serverICEServers = servers
+	iceLock.Unlock()
+
+	if debugLogging {
+		gossip_common.Dbg("Received %d ICE server(s) from the server", len(servers))
+	}
+	return nil
+}
+
+// requestICEServers asks the server for fresh ICE servers, renewing any relay credentials before a call.
+func requestICEServers() {
+	requestPacket := gossip_common.NewSignalPacketFromData("ice_request", "", gossip_common.GetClientID(), []byte(""))
+	if err := sendSignal(requestPacket); err != nil {
+		gossip_common.Err("Failed to request ICE servers: %v", err)
+	}
+}
+
+// clearServerICEServers forgets the previous server's ICE servers before connecting to a server.
+func clearServerICEServers() {
+	iceLock.Lock()
+	serverICEServers = nil
+	iceLock.Unlock()
+}
+
+/**
+ * iceServers returns the ICE servers calls use: those in Settings followed by those pushed by
+ * the server. No third party is contacted unless the user opted in with usePublicStun, in which
+ * case a public STUN server is used when neither list has any.
+ * @param settings The client settings.
+ * @return The ICE servers.
+ */
+func iceServers(settings Settings) []gossip_common.ICEServer {
+	iceLock.Lock()
+	pushed := serverICEServers
+	iceLock.Unlock()
+
+	servers := append([]gossip_common.ICEServer{}, settings.ICEServers...)
+	servers = append(servers, pushed...)
+	if len(servers) == 0 && settings.UsePublicSTUN {
+		servers = append(servers, gossip_common.ICEServer{URLs: []string{publicSTUNServer}})
+	}
+	return servers
+}
+
+// isTURNServer reports whether an ICE server has a TURN URL.
+func isTURNServer(server gossip_common.ICEServer) bool {
+	for _, url := range server.URLs {
+		if strings.HasPrefix(url, "turn:") || strings.HasPrefix(url, "turns:") {
+			return true
+		}
+	}
+	return false
+}
+
+/**
+ * peerConnectionConfig builds the configuration of a call's peer connection from the ICE
+ * servers and the relay-only setting. In relay-only mode only TURN relay candidates are
+ * gathered, so participants never learn each other's addresses.
+ * @return webrtc.Configuration The peer connection configuration.
+ * @return error Error if relay-only mode is on but no TURN server is configured.
+ */
+func peerConnectionConfig() (webrtc.Configuration, error) {
+	settings, err := LoadSettings()
+	if err != nil {
+		gossip_common.Err("Failed to load ICE settings, using defaults: %v", err)
+	}
+
+	config := webrtc.Configuration{}
+	haveTURN := false
+	for _, server := range iceServers(settings) {
+		config.ICEServers = append(config.ICEServers, webrtc.ICEServer{
+			URLs:       server.URLs,
+			Username:   server.Username,
+			Credential: server.Credential,
+		})
+		haveTURN = haveTURN || isTURNServer(server)
+	}
+
+	if settings.RelayOnly {
+		if !haveTURN {
+			return config, errors.New("relay-only mode needs a TURN server")
+		}
+		config.ICETransportPolicy = webrtc.ICETransportPolicyRelay
+	}
+	return config, nil
+}
+
+/**
+ * GetICEServers returns the STUN and TURN servers calls currently use, including any pushed by the server
+ * @return []gossip_common.ICEServer The ICE servers
+ */
+func (a *App) GetICEServers() []gossip_common.ICEServer {
+	settings, err := LoadSettings()
+	if err != nil {
+		gossip_common.Err("Failed to load ICE settings: %v", err)
+	}
+	return iceServers(settings)
+}
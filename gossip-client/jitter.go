@@ -0,0 +1,229 @@
+package main
+
+import (
+	"math"
+	"time"
+)
+
+const (
+	jitterMinDelay     = 20 * time.Millisecond  // Smallest target delay
+	jitterMaxDelay     = 300 * time.Millisecond // Largest target delay
+	jitterMaxConcealed = 5                      // Lost frames in a row we fill with a fading copy of the last frame
+	jitterResyncFrames = 50                     // Frames a sequence number may jump before we treat it as a new stream
+)
+
+// PlaybackStats describes the jitter buffer of one participant.
+type PlaybackStats struct {
+	ID        string  `json:"id"`
+	Depth     float64 `json:"depth"`     // Buffered audio in milliseconds
+	Target    float64 `json:"target"`    // Current target delay in milliseconds
+	Jitter    float64 `json:"jitter"`    // Interarrival jitter estimate in milliseconds
+	Received  uint64  `json:"received"`  // Frames accepted into the buffer
+	Late      uint64  `json:"late"`      // Frames that arrived after their playout time and were dropped
+	Lost      uint64  `json:"lost"`      // Frames that never arrived and were concealed
+	Dropped   uint64  `json:"dropped"`   // Frames discarded to shrink an overfull buffer
+	Underruns uint64  `json:"underruns"` // Times the buffer ran dry and had to refill
+}
+
+// jitterBuffer reorders frames by sequence number and holds them for an adaptive delay
+// so that network jitter does not reach the speaker.
+type jitterBuffer struct {
+	frames       map[uint16][]int16
+	nextSeq      uint16
+	started      bool
+	buffering    bool
+	frameSamples int
+	targetFrames int
+
+	last      []int16
+	concealed int
+
+	jitter      float64 // Seconds
+	lastArrival time.Time
+	lastSeq     uint16
+	hasArrival  bool
+
+	stats PlaybackStats
+}
+
+// newJitterBuffer creates an empty jitter buffer.
+func newJitterBuffer() *jitterBuffer {
+	return &jitterBuffer{frames: make(map[uint16][]int16), targetFrames: 1}
+}
+
+// seqBefore reports whether sequence number a comes before b, allowing for wraparound.
+func seqBefore(a, b uint16) bool {
+	return a != b && b-a < 0x8000
+}
+
+// seqDistance returns how far apart two sequence numbers are in either direction, allowing for wraparound.
+func seqDistance(a, b uint16) uint16 {
+	if seqBefore(a, b) {
+		return b - a
+	}
+	return a - b
+}
+
+// frameDuration returns the length of one frame.
+func (j *jitterBuffer) frameDuration() time.Duration {
+	if j.frameSamples == 0 {
+		return time.Duration(defaultOpusFrameSize) * time.Millisecond
+	}
+	return time.Duration(j.frameSamples) * time.Second / audioSampleRate
+}
+
+// push adds a decoded frame to the buffer.
+func (j *jitterBuffer) push(seq uint16, pcm []int16, now time.Time) {
+	if len(pcm) == 0 {
+		return
+	}
+	// The sender's audio moved to another path, which numbers its frames differently
+	if j.started && seqDistance(seq, j.nextSeq) > jitterResyncFrames {
+		j.resync()
+	}
+	j.frameSamples = len(pcm)
+	frameDuration := j.frameDuration()
+
+	// RFC 3550 interarrival jitter, measured against the frame schedule
+	if j.hasArrival && seqBefore(j.lastSeq, seq) {
+		expected := time.Duration(seq-j.lastSeq) * frameDuration
+		d := now.Sub(j.lastArrival) - expected
+		// A long gap is a pause the sender's VAD left out, not network jitter
+		if d < jitterMaxDelay {
+			j.jitter += (math.Abs(d.Seconds()) - j.jitter) / 16
+		}
+	}
+	if !j.hasArrival || seqBefore(j.lastSeq, seq) {
+		j.lastArrival = now
+		j.lastSeq = seq
+		j.hasArrival = true
+	}
+	j.adaptTarget()
+
+	if j.started && seqBefore(seq, j.nextSeq) {
+		if j.last != nil {
+			j.stats.Late++
+			return
+		}
+		// Nothing has been played yet, so start from the earlier frame
+		j.nextSeq = seq
+	}
+	if _, exists := j.frames[seq]; exists {
+		return
+	}
+
+	j.frames[seq] = pcm
+	j.stats.Received++
+	if !j.started {
+		j.nextSeq = seq
+		j.started = true
+		j.buffering = true
+	}
+
+	// Skip ahead if a burst left us far behind the target
+	if len(j.frames) > j.targetFrames*3+2 {
+		for len(j.frames) > j.targetFrames {
+			if _, exists := j.frames[j.nextSeq]; exists {
+				delete(j.frames, j.nextSeq)
+				j.stats.Dropped++
+			}
+			j.nextSeq++
+		}
+	}
+}
+
+// resync drops the buffered frames so the buffer starts over from the next frame that arrives.
+func (j *jitterBuffer) resync() {
+	j.frames = make(map[uint16][]int16)
+	j.started = false
+	j.hasArrival = false
+	j.last = nil
+	j.concealed = 0
+}
+
+// adaptTarget sets the target delay to cover twice the measured jitter.
+func (j *jitterBuffer) adaptTarget() {
+	target := time.Duration(2 * j.jitter * float64(time.Second))
+	if target < jitterMinDelay {
+		target = jitterMinDelay
+	}
+	if target > jitterMaxDelay {
+		target = jitterMaxDelay
+	}
+	frameDuration := j.frameDuration()
+	j.targetFrames = int((target + frameDuration - 1) / frameDuration)
+	if j.targetFrames < 1 {
+		j.targetFrames = 1
+	}
+}
+
+// pop returns the next frame to play, a concealment frame if it was lost, or nil when
+// the buffer is empty or still filling up.
+func (j *jitterBuffer) pop() []int16 {
+	if !j.started {
+		return nil
+	}
+	if j.buffering {
+		if len(j.frames) < j.targetFrames {
+			return nil
+		}
+		j.buffering = false
+	}
+
+	if frame, exists := j.frames[j.nextSeq]; exists {
+		delete(j.frames, j.nextSeq)
+		j.nextSeq++
+		j.last = frame
+		j.concealed = 0
+		return frame
+	}
+
+	if len(j.frames) == 0 {
+		j.stats.Underruns++
+		j.buffering = true
+		return nil
+	}
+
+	// The frame is missing but later ones are here, so it was lost
+	j.stats.Lost++
+	j.nextSeq++
+	return j.conceal()
+}
+
+// conceal fills a lost frame with a fading copy of the last frame, then silence.
+func (j *jitterBuffer) conceal() []int16 {
+	out := make([]int16, j.frameSamples)
+	if j.last == nil || j.concealed >= jitterMaxConcealed {
+		return out
+	}
+	j.concealed++
+	gain := 1 - float64(j.concealed)/float64(jitterMaxConcealed+1)
+	for i := range out {
+		if i < len(j.last) {
+			out[i] = int16(float64(j.last[i]) * gain)
+		}
+	}
+	return out
+}
+
+// snapshot returns the current statistics.
+func (j *jitterBuffer) snapshot() PlaybackStats {
+	stats := j.stats
+	frameMs := float64(j.frameDuration()) / float64(time.Millisecond)
+	stats.Depth = float64(len(j.frames)) * frameMs
+	stats.Target = float64(j.targetFrames) * frameMs
+	stats.Jitter = j.jitter * 1000
+	return stats
+}
+
+/**
+ * GetPlaybackStats returns the jitter buffer statistics of every participant we are playing
+ * @return []PlaybackStats One entry per participant
+ */
+func (a *App) GetPlaybackStats() []PlaybackStats {
+	mixer := currentMixer()
+	if mixer == nil {
+		return []PlaybackStats{}
+	}
+	return mixer.Stats()
+}
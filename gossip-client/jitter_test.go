@@ -0,0 +1,180 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+const testFrameSamples = audioSampleRate / 50 // 20 ms frames
+
+// testFrame returns a frame whose samples all hold the given value, so played frames can be told apart.
+func testFrame(value int16) []int16 {
+	frame := make([]int16, testFrameSamples)
+	for i := range frame {
+		frame[i] = value
+	}
+	return frame
+}
+
+// pushFrames pushes frames marked with their sequence numbers, arriving on the 20 ms schedule.
+func pushFrames(j *jitterBuffer, start time.Time, seqs ...uint16) {
+	for i, seq := range seqs {
+		j.push(seq, testFrame(int16(seq)), start.Add(time.Duration(i)*20*time.Millisecond))
+	}
+}
+
+// expectPop pops a frame and checks its marker value.
+func expectPop(t *testing.T, j *jitterBuffer, want int16) {
+	t.Helper()
+
+	frame := j.pop()
+	if frame == nil {
+		t.Fatalf("got no frame, want %d", want)
+	}
+	if frame[0] != want {
+		t.Fatalf("got frame %d, want %d", frame[0], want)
+	}
+}
+
+func TestJitterBufferReorders(t *testing.T) {
+	j := newJitterBuffer()
+	pushFrames(j, time.Now(), 10, 12, 11, 13)
+
+	for _, want := range []int16{10, 11, 12, 13} {
+		expectPop(t, j, want)
+	}
+	if frame := j.pop(); frame != nil {
+		t.Fatalf("got frame %d from an empty buffer", frame[0])
+	}
+
+	stats := j.snapshot()
+	if stats.Received != 4 || stats.Lost != 0 || stats.Late != 0 || stats.Underruns != 1 {
+		t.Fatalf("stats %+v, want 4 received and 1 underrun", stats)
+	}
+}
+
+func TestJitterBufferEarlierFirstFrame(t *testing.T) {
+	j := newJitterBuffer()
+	pushFrames(j, time.Now(), 21, 20, 22)
+
+	// Nothing was played when 20 arrived, so playback starts from it
+	for _, want := range []int16{20, 21, 22} {
+		expectPop(t, j, want)
+	}
+}
+
+func TestJitterBufferConcealsLoss(t *testing.T) {
+	j := newJitterBuffer()
+	pushFrames(j, time.Now(), 1, 2, 4, 5)
+
+	expectPop(t, j, 1)
+	expectPop(t, j, 2)
+
+	concealed := j.pop()
+	if len(concealed) != testFrameSamples {
+		t.Fatalf("concealment frame has %d samples, want %d", len(concealed), testFrameSamples)
+	}
+	if concealed[0] == 0 || concealed[0] >= 2 {
+		t.Fatalf("concealment sample %d, want a faded copy of the last frame", concealed[0])
+	}
+
+	expectPop(t, j, 4)
+	expectPop(t, j, 5)
+	if stats := j.snapshot(); stats.Lost != 1 {
+		t.Fatalf("%d frames lost, want 1", stats.Lost)
+	}
+}
+
+func TestJitterBufferConcealmentFadesToSilence(t *testing.T) {
+	j := newJitterBuffer()
+	start := time.Now()
+	missing := jitterMaxConcealed + 2
+	j.push(0, testFrame(1000), start)
+	j.push(uint16(missing+1), testFrame(1), start.Add(20*time.Millisecond))
+	expectPop(t, j, 1000)
+
+	previous := int16(1000)
+	for i := 1; i <= missing; i++ {
+		frame := j.pop()
+		if i > jitterMaxConcealed {
+			if frame[0] != 0 {
+				t.Fatalf("concealment %d is %d, want silence", i, frame[0])
+			}
+			continue
+		}
+		if frame[0] <= 0 || frame[0] >= previous {
+			t.Fatalf("concealment %d is %d, want quieter than %d", i, frame[0], previous)
+		}
+		previous = frame[0]
+	}
+	expectPop(t, j, 1)
+}
+
+func TestJitterBufferDropsLateFrames(t *testing.T) {
+	j := newJitterBuffer()
+	start := time.Now()
+	pushFrames(j, start, 1, 2, 3)
+
+	expectPop(t, j, 1)
+	expectPop(t, j, 2)
+	j.push(1, testFrame(1), start.Add(100*time.Millisecond))
+	expectPop(t, j, 3)
+
+	if stats := j.snapshot(); stats.Late != 1 {
+		t.Fatalf("%d late frames, want 1", stats.Late)
+	}
+}
+
+func TestJitterBufferWraparound(t *testing.T) {
+	j := newJitterBuffer()
+	pushFrames(j, time.Now(), 65534, 0, 65535, 1)
+
+	for _, want := range []uint16{65534, 65535, 0, 1} {
+		expectPop(t, j, int16(want))
+	}
+	if stats := j.snapshot(); stats.Lost != 0 || stats.Late != 0 {
+		t.Fatalf("stats %+v, want nothing lost or late across the wraparound", stats)
+	}
+}
+
+func TestJitterBufferResyncsOnJump(t *testing.T) {
+	j := newJitterBuffer()
+	start := time.Now()
+	pushFrames(j, start, 100, 101)
+	expectPop(t, j, 100)
+
+	// A far jump in either direction is a new stream, not a burst of loss or late frames
+	j.push(100+jitterResyncFrames*10, testFrame(7), start.Add(time.Second))
+	expectPop(t, j, 7)
+	j.push(3, testFrame(8), start.Add(2*time.Second))
+	expectPop(t, j, 8)
+
+	if stats := j.snapshot(); stats.Lost != 0 || stats.Late != 0 {
+		t.Fatalf("stats %+v, want nothing lost or late after a resync", stats)
+	}
+}
+
+func TestJitterBufferTargetFollowsJitter(t *testing.T) {
+	j := newJitterBuffer()
+	start := time.Now()
+
+	// Frames alternate between arriving early and 60 ms late
+	at := start
+	for seq := uint16(0); seq < 200; seq++ {
+		arrival := at
+		if seq%2 == 1 {
+			arrival = at.Add(60 * time.Millisecond)
+		}
+		j.push(seq, testFrame(1), arrival)
+		j.pop()
+		at = at.Add(20 * time.Millisecond)
+	}
+
+	stats := j.snapshot()
+	if stats.Jitter < 30 {
+		t.Fatalf("jitter %.1f ms, want it to reflect the 60 ms swings", stats.Jitter)
+	}
+	if stats.Target < 2*stats.Jitter-20 || stats.Target > float64(jitterMaxDelay/time.Millisecond) {
+		t.Fatalf("target %.0f ms for %.1f ms of jitter", stats.Target, stats.Jitter)
+	}
+}
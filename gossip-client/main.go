@@ -4,6 +4,7 @@ import (
 	"bufio"
 	"embed"
 	"net"
+	"sync"
 
 	"gossip_common"
 
@@ -29,7 +30,8 @@ var (
 	acceptedCallers   = make(map[string]bool)   // Map of accepted callers
 	inCall            = false                   // Flag to check if the client is in a call
 	conn              net.Conn                  // Connection to the signaling server
-	writer            *bufio.Writer             // Writer for the connection
+	writer            *bufio.Writer             // Writer for the connection, only used through sendSignal, sendData and sendStream
+	writerLock        sync.Mutex                // Serializes every packet written to the connection
 	password          string                    // Password for the server
 	serverName        string                    // Name of the server
 	muted             = false                   // Flag to check if the client is muted
@@ -40,8 +42,8 @@ func main() {
 	// Create an instance of the app structure
 	app := NewApp()
 
-	gossip_common.GenerateID(36)
 	gossip_common.GenerateKeys()
+	gossip_common.DeriveClientID()
 
 	if debugLogging {
 		gossip_common.Dbg("Client ID: %s", gossip_common.GetClientID())
@@ -0,0 +1,80 @@
+//go:build opus
+
+package main
+
+import (
+	"fmt"
+
+	"gopkg.in/hraban/opus.v2"
+)
+
+const opusAvailable = true
+
+// opusEncoder encodes voice frames with libopus.
+type opusEncoder struct {
+	encoder *opus.Encoder
+	buffer  []byte
+}
+
+/**
+ * newOpusEncoder creates a VoIP Opus encoder with the configured bitrate and FEC.
+ * @param config The audio configuration.
+ * @return The encoder.
+ */
+func newOpusEncoder(config audioConfig) (audioEncoder, error) {
+	encoder, err := opus.NewEncoder(audioSampleRate, audioChannels, opus.AppVoIP)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create opus encoder: %w", err)
+	}
+	if err := encoder.SetBitrate(config.bitrate); err != nil {
+		return nil, fmt.Errorf("failed to set opus bitrate: %w", err)
+	}
+	if err := encoder.SetInBandFEC(config.fec); err != nil {
+		return nil, fmt.Errorf("failed to set opus FEC: %w", err)
+	}
+	if config.fec {
+		if err := encoder.SetPacketLossPerc(opusExpectedLoss); err != nil {
+			return nil, fmt.Errorf("failed to set opus packet loss: %w", err)
+		}
+	}
+	return &opusEncoder{encoder: encoder, buffer: make([]byte, 4000)}, nil
+}
+
+func (e *opusEncoder) Encode(pcm []int16) ([]byte, error) {
+	n, err := e.encoder.Encode(pcm, e.buffer)
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte(nil), e.buffer[:n]...), nil
+}
+
+// opusDecoder decodes Opus packets from one participant.
+type opusDecoder struct {
+	decoder *opus.Decoder
+}
+
+// newOpusDecoder creates a decoder for one participant's stream.
+func newOpusDecoder() (audioDecoder, error) {
+	decoder, err := opus.NewDecoder(audioSampleRate, audioChannels)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create opus decoder: %w", err)
+	}
+	return &opusDecoder{decoder: decoder}, nil
+}
+
+func (d *opusDecoder) Decode(packet []byte) ([]int16, error) {
+	pcm := make([]int16, maxFrameSamples*audioChannels)
+	n, err := d.decoder.Decode(packet, pcm)
+	if err != nil {
+		return nil, err
+	}
+	return pcm[:n*audioChannels], nil
+}
+
+func (d *opusDecoder) Recover(next []byte, samples int) ([]int16, error) {
+	pcm := make([]int16, samples)
+	if err := d.decoder.DecodeFEC(next, pcm); err != nil {
+		return nil, err
+	}
+	return pcm, nil
+}
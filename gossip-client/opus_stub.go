@@ -0,0 +1,15 @@
+//go:build !opus
+
+package main
+
+const opusAvailable = false
+
+// newOpusEncoder reports that this build has no Opus support.
+func newOpusEncoder(config audioConfig) (audioEncoder, error) {
+	return nil, errOpusUnavailable
+}
+
+// newOpusDecoder reports that this build has no Opus support.
+func newOpusDecoder() (audioDecoder, error) {
+	return nil, errOpusUnavailable
+}
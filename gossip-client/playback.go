@@ -3,119 +3,141 @@ package main
 import (
 	"fmt"
 	"sync"
+	"time"
 
 	"gossip_common"
 
 	"github.com/gen2brain/malgo"
 )
 
-// Player encapsulates the audio playback logic.
-type Player struct {
+const mixerBlock = audioSampleRate / 100 // Samples mixed at a time when the device needs resampling
+
+// Mixer plays every participant through a single playback device.
+type Mixer struct {
 	deviceConfig malgo.DeviceConfig
 	device       *malgo.Device
-	buffer       [][]byte
-	currentIndex int
+	sources      map[string]*mixerSource
+	resampler    *resampler // Converts the call rate to the device rate, nil when they match
+	pending      []float64  // Resampled samples not yet handed to the device
 	mutex        sync.Mutex
 }
 
-// NewPlayer creates a new Player with the specified sample rate.
-func NewPlayer() *Player {
-	return &Player{
+// mixerSource is one participant's stream inside the mixer.
+type mixerSource struct {
+	jitter  *jitterBuffer
+	gain    *gainControl
+	volume  float64
+	muted   bool
+	current []float64
+}
+
+// NewMixer creates a new Mixer with no sources.
+func NewMixer() *Mixer {
+	return &Mixer{
 		deviceConfig: malgo.DefaultDeviceConfig(malgo.Playback),
+		sources:      make(map[string]*mixerSource),
 	}
 }
 
 // initDevice initializes the malgo device for audio playback.
-func (p *Player) initDevice(buffer [][]byte) error {
-	p.deviceConfig.Playback.Format = malgo.FormatS16
-	p.deviceConfig.Playback.Channels = 1
-	p.deviceConfig.SampleRate = 44100
-	p.deviceConfig.Alsa.NoMMap = 1
-	p.buffer = buffer
-
-	// Create a malgo context
-	allocatedCtx, err := malgo.InitContext(nil, malgo.ContextConfig{}, nil)
+func (m *Mixer) initDevice() error {
+	m.deviceConfig.Playback.Format = malgo.FormatS16
+	m.deviceConfig.Playback.Channels = audioChannels
+	m.deviceConfig.SampleRate = 0 // Play at the device's native rate and resample ourselves
+	m.deviceConfig.Alsa.NoMMap = 1
+
+	// Use the malgo context shared with the recorder
+	allocatedCtx, err := sharedAudioContext()
 	if err != nil {
-		return fmt.Errorf("failed to initialize context: %v", err)
+		return err
 	}
-	defer allocatedCtx.Uninit()
-
-	var maxSample int16 = 0 // Running maximum sample value
-	var normalizationFactor float64 = 1.0
-	const silenceThreshold int16 = 500 // Threshold below which we consider the audio as silent
 
 	// Define the callback using malgo.DeviceCallbacks
 	callbacks := malgo.DeviceCallbacks{
 		Data: func(output, input []byte, framecount uint32) {
-			p.mutex.Lock()
-			defer p.mutex.Unlock()
-
-			var totalBytesCopied int = 0
-
-			// Update running maximum sample value
-			for _, data := range p.buffer {
-				for i := 0; i < len(data); i += 2 {
-					sample := int16(data[i]) | int16(data[i+1])<<8
-					if abs(sample) > maxSample {
-						maxSample = abs(sample)
-					}
-				}
-			}
+			samples := len(output) / 2
 
-			// Apply normalization only if the max sample is above the silence threshold
-			if maxSample > silenceThreshold {
-				normalizationFactor = 32767.0 / float64(maxSample) * 0.78
+			m.mutex.Lock()
+			var mix []float64
+			if m.resampler == nil {
+				mix = m.mixBlock(samples)
 			} else {
-				normalizationFactor = 1.0 // No normalization if below threshold
-			}
-
-			// Normalize and copy data
-			for totalBytesCopied < len(output) {
-				if p.currentIndex >= len(p.buffer) {
-					// Fill the rest of the output with silence if no more data
-					for i := totalBytesCopied; i < len(output); i++ {
-						output[i] = 0
-					}
-					break
-				}
-
-				data := p.buffer[p.currentIndex]
-				remainingOutputSpace := len(output) - totalBytesCopied
-				bytesToCopy := min(len(data), remainingOutputSpace)
-
-				for i := 0; i < bytesToCopy; i += 2 {
-					sample := int16(data[i]) | int16(data[i+1])<<8
-					normalizedSample := int16(float64(sample) * normalizationFactor)
-					output[totalBytesCopied+i] = byte(normalizedSample & 0xFF)
-					output[totalBytesCopied+i+1] = byte((normalizedSample >> 8) & 0xFF)
+				for len(m.pending) < samples {
+					m.pending = append(m.pending, m.resampler.process(m.mixBlock(mixerBlock))...)
 				}
+				mix = m.pending[:samples]
+				m.pending = append([]float64(nil), m.pending[samples:]...)
+			}
+			m.mutex.Unlock()
 
-				totalBytesCopied += bytesToCopy
-
-				if bytesToCopy < len(data) {
-					p.buffer[p.currentIndex] = data[bytesToCopy:]
-				} else {
-					p.currentIndex++
-				}
+			for i, x := range mix {
+				sample := clampSample(x * 32767)
+				output[i*2] = byte(sample & 0xFF)
+				output[i*2+1] = byte((sample >> 8) & 0xFF)
 			}
 		},
 	}
 
-	// Initialize the device with the correct parameters using the Context field of AllocatedContext
-	p.device, err = malgo.InitDevice(allocatedCtx.Context, p.deviceConfig, callbacks)
+	// Initialize the device on the selected device with the correct parameters using the Context field of AllocatedContext
+	m.device, err = initSelectedDevice(allocatedCtx.Context, malgo.Playback, m.deviceConfig, callbacks)
 	if err != nil {
 		return fmt.Errorf("failed to initialize device: %v", err)
 	}
 
+	m.mutex.Lock()
+	m.resampler = nil
+	m.pending = nil
+	if rate := int(m.device.SampleRate()); rate != audioSampleRate {
+		m.resampler = newResampler(audioSampleRate, rate)
+		if debugLogging {
+			gossip_common.Dbg("Playback device runs at %d Hz, resampling from %d Hz", rate, audioSampleRate)
+		}
+	}
+	m.mutex.Unlock()
+
 	return nil
 }
 
-// Helper function to find the absolute value of an int16
-func abs(x int16) int16 {
-	if x < 0 {
-		return -x
+// mixBlock mixes the next samples of every source at the call rate and limits the sum,
+// so several loud participants bend instead of clipping.
+func (m *Mixer) mixBlock(samples int) []float64 {
+	mix := make([]float64, samples)
+	for _, source := range m.sources {
+		source.mixInto(mix)
+	}
+	for i, x := range mix {
+		mix[i] = softLimit(x)
+	}
+
+	// Let the echo canceller know what is about to come out of the speaker
+	addEchoReference(mix)
+	return mix
+}
+
+// mixInto adds the source's next samples to the mix, in playout order from the jitter buffer.
+// A muted source is still drained so it does not fall behind.
+func (s *mixerSource) mixInto(mix []float64) {
+	filled := 0
+	for filled < len(mix) {
+		if len(s.current) == 0 {
+			frame := s.jitter.pop()
+			if frame == nil {
+				// Nothing is due, the rest of this source is silence
+				return
+			}
+			s.current = s.gain.process(frame, s.volume)
+		}
+
+		samplesToCopy := min(len(s.current), len(mix)-filled)
+		if !s.muted {
+			for i := 0; i < samplesToCopy; i++ {
+				mix[filled+i] += s.current[i]
+			}
+		}
+
+		filled += samplesToCopy
+		s.current = s.current[samplesToCopy:]
 	}
-	return x
 }
 
 // Helper function to find minimum of two integers
@@ -127,35 +149,145 @@ func min(a, b int) int {
 }
 
 // Start begins the audio playback process.
-func (p *Player) Start() error {
-	if err := p.device.Start(); err != nil {
+func (m *Mixer) Start() error {
+	if err := m.device.Start(); err != nil {
 		return fmt.Errorf("failed to start device: %v", err)
 	}
 	return nil
 }
 
 // Stop halts the audio playback process.
-func (p *Player) Stop() error {
-	if err := p.device.Stop(); err != nil {
+func (m *Mixer) Stop() error {
+	if err := m.device.Stop(); err != nil {
 		return fmt.Errorf("failed to stop device: %v", err)
 	}
 	return nil
 }
 
-func (p *Player) AddToBuffer(buffer []byte) {
-	p.mutex.Lock()
-	defer p.mutex.Unlock()
+// source returns a participant's source, creating it with their saved volume and mute state.
+func (m *Mixer) source(id string) *mixerSource {
+	source, exists := m.sources[id]
+	if !exists {
+		source = &mixerSource{
+			jitter: newJitterBuffer(),
+			gain:   newGainControl(),
+			volume: participantVolume(id),
+			muted:  participantMuted(id),
+		}
+		m.sources[id] = source
+	}
+	return source
+}
+
+// AddFrame queues a participant's decoded audio frame in their jitter buffer.
+func (m *Mixer) AddFrame(id string, seq uint16, pcm []int16) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
 
 	if deafened {
 		return
 	}
 
-	// Decrypt the incoming buffer before adding it to the player's buffer
-	decryptedBuffer, err := gossip_common.GWDecrypt(buffer)
-	if err != nil {
-		gossip_common.Err("Failed to decrypt buffer: %v", err)
-		return
+	m.source(id).jitter.push(seq, pcm, time.Now())
+}
+
+// RemoveSource drops a participant that left the call.
+func (m *Mixer) RemoveSource(id string) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	delete(m.sources, id)
+}
+
+// switchDevice moves playback to the device chosen in Settings, keeping the buffered audio.
+func (m *Mixer) switchDevice() error {
+	if m.device != nil {
+		m.device.Stop()
+		m.device.Uninit()
+	}
+	if err := m.initDevice(); err != nil {
+		return err
+	}
+	return m.Start()
+}
+
+// SetVolume sets a participant's playback volume applied after the AGC.
+func (m *Mixer) SetVolume(id string, volume float64) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if source, exists := m.sources[id]; exists {
+		source.volume = volume
+	}
+}
+
+// SetMuted silences or restores a participant in the mix.
+func (m *Mixer) SetMuted(id string, muted bool) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if source, exists := m.sources[id]; exists {
+		source.muted = muted
+	}
+}
+
+// Stats returns the jitter buffer statistics of every source.
+func (m *Mixer) Stats() []PlaybackStats {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	stats := []PlaybackStats{}
+	for id, source := range m.sources {
+		entry := source.jitter.snapshot()
+		entry.ID = id
+		stats = append(stats, entry)
+	}
+	return stats
+}
+
+/**
+ * startMixer returns the playback mixer, opening the playback device on first use.
+ * @return The mixer, or an error if the device could not be started.
+ */
+func startMixer() (*Mixer, error) {
+	mixerLock.Lock()
+	defer mixerLock.Unlock()
+
+	if playbackMixer != nil {
+		return playbackMixer, nil
+	}
+
+	mixer := NewMixer()
+	if err := mixer.initDevice(); err != nil {
+		return nil, err
+	}
+	if err := mixer.Start(); err != nil {
+		mixer.device.Uninit()
+		return nil, err
 	}
+	playbackMixer = mixer
+	return playbackMixer, nil
+}
+
+// currentMixer returns the playback mixer, or nil when nothing is playing.
+func currentMixer() *Mixer {
+	mixerLock.Lock()
+	defer mixerLock.Unlock()
+
+	return playbackMixer
+}
 
-	p.buffer = append(p.buffer, decryptedBuffer)
+// stopMixer closes the playback device and drops every source.
+func stopMixer() {
+	mixerLock.Lock()
+	defer mixerLock.Unlock()
+
+	if playbackMixer == nil {
+		return
+	}
+	if playbackMixer.device.IsStarted() {
+		playbackMixer.Stop()
+	}
+	playbackMixer.device.Uninit()
+	playbackMixer = nil
 }
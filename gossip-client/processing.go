@@ -0,0 +1,134 @@
+package main
+
+import (
+	"math"
+	"sync"
+)
+
+const highPassCutoff = 100.0 // Hz, removes rumble, handling noise and DC offset below speech
+
+// audioProcessor is one stage of the capture pipeline. Stages may buffer internally,
+// so the returned frame can be shorter or longer than the input.
+type audioProcessor interface {
+	Process(pcm []int16) []int16
+}
+
+var (
+	capturePipeline []audioProcessor // Stages the microphone signal passes through, in order
+	pipelineLock    sync.Mutex
+)
+
+/**
+ * startCapturePipeline builds the processing stages enabled in the audio configuration.
+ * The echo canceller runs before noise suppression so the suppressor does not smear the echo.
+ * @param config The audio configuration.
+ */
+func startCapturePipeline(config audioConfig) {
+	var stages []audioProcessor
+	if config.highPass {
+		stages = append(stages, newHighPassFilter(highPassCutoff))
+	}
+	if config.echoCancellation {
+		resetEchoReference()
+		stages = append(stages, newEchoCanceller())
+	}
+	if config.noiseSuppression {
+		stages = append(stages, newNoiseSuppressor())
+	}
+
+	pipelineLock.Lock()
+	capturePipeline = stages
+	pipelineLock.Unlock()
+}
+
+// stopCapturePipeline drops the processing state at the end of a call.
+func stopCapturePipeline() {
+	pipelineLock.Lock()
+	capturePipeline = nil
+	pipelineLock.Unlock()
+}
+
+/**
+ * processCapture runs captured audio through the capture pipeline.
+ * @param input Captured S16 little-endian samples. The slice is not kept.
+ * @return The processed samples in the same format.
+ */
+func processCapture(input []byte) []byte {
+	pipelineLock.Lock()
+	defer pipelineLock.Unlock()
+
+	if len(capturePipeline) == 0 {
+		chunk := make([]byte, len(input))
+		copy(chunk, input)
+		return chunk
+	}
+
+	pcm := bytesToSamples(input)
+	for _, stage := range capturePipeline {
+		pcm = stage.Process(pcm)
+	}
+	return samplesToBytes(pcm)
+}
+
+// biquadFilter is a second order Butterworth filter.
+type biquadFilter struct {
+	b0, b1, b2, a1, a2 float64
+	x1, x2, y1, y2     float64
+}
+
+// newHighPassFilter creates a high-pass filter for the call rate with the given cutoff in Hz.
+func newHighPassFilter(cutoff float64) *biquadFilter {
+	w := 2 * math.Pi * cutoff / audioSampleRate
+	alpha := math.Sin(w) / math.Sqrt2 // Q of 1/√2 for a flat passband
+	cos := math.Cos(w)
+	a0 := 1 + alpha
+	return &biquadFilter{
+		b0: (1 + cos) / 2 / a0,
+		b1: -(1 + cos) / a0,
+		b2: (1 + cos) / 2 / a0,
+		a1: -2 * cos / a0,
+		a2: (1 - alpha) / a0,
+	}
+}
+
+// newLowPassFilter creates a low-pass filter with the given cutoff in Hz.
+func newLowPassFilter(cutoff float64, sampleRate int) *biquadFilter {
+	w := 2 * math.Pi * cutoff / float64(sampleRate)
+	alpha := math.Sin(w) / math.Sqrt2
+	cos := math.Cos(w)
+	a0 := 1 + alpha
+	return &biquadFilter{
+		b0: (1 - cos) / 2 / a0,
+		b1: (1 - cos) / a0,
+		b2: (1 - cos) / 2 / a0,
+		a1: -2 * cos / a0,
+		a2: (1 - alpha) / a0,
+	}
+}
+
+// filter runs one sample through the filter.
+func (f *biquadFilter) filter(x float64) float64 {
+	y := f.b0*x + f.b1*f.x1 + f.b2*f.x2 - f.a1*f.y1 - f.a2*f.y2
+	f.x2, f.x1 = f.x1, x
+	f.y2, f.y1 = f.y1, y
+	return y
+}
+
+// Process filters a frame in place.
+func (f *biquadFilter) Process(pcm []int16) []int16 {
+	for i, sample := range pcm {
+		pcm[i] = clampSample(f.filter(float64(sample)))
+	}
+	return pcm
+}
+
+// clampSample rounds a sample to 16 bits, saturating instead of wrapping.
+func clampSample(x float64) int16 {
+	if x > math.MaxInt16 {
+		return math.MaxInt16
+	}
+	if x < math.MinInt16 {
+		return math.MinInt16
+	}
+	return int16(math.Round(x))
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	"gossip_common"
+
+	"github.com/wailsapp/wails/v2/pkg/runtime"
+)
+
+const (
+	defaultPushToTalkKey     = "F8"
+	defaultPushToTalkRelease = 200 // Milliseconds the microphone stays open after the key is released
+)
+
+var (
+	pttLock         sync.Mutex
+	pttHeld         bool          // Whether the key or button is down
+	pttOpen         bool          // Whether audio is transmitted, true until the release delay runs out
+	pttReleaseDelay time.Duration // How long to keep transmitting after release
+	pttReleaseTimer *time.Timer
+)
+
+/**
+ * startPushToTalk resets push-to-talk for a new call and registers the global hotkey when
+ * the input mode asks for it.
+ * @param a The application instance that receives push-to-talk events.
+ * @param config The audio configuration.
+ */
+func startPushToTalk(a *App, config audioConfig) {
+	pttLock.Lock()
+	pttHeld = false
+	pttOpen = false
+	pttReleaseDelay = config.releaseDelay
+	if pttReleaseTimer != nil {
+		pttReleaseTimer.Stop()
+		pttReleaseTimer = nil
+	}
+	pttLock.Unlock()
+
+	if config.inputMode != inputModePTT {
+		return
+	}
+	if err := registerPushToTalkHotkey(a, config.pushToTalkKey); err != nil {
+		// The frontend still handles the key while the window has focus
+		if debugLogging {
+			gossip_common.Dbg("Global push-to-talk hotkey unavailable: %v", err)
+		}
+	}
+}
+
+// stopPushToTalk closes the microphone and releases the global hotkey at the end of a call.
+func stopPushToTalk() {
+	unregisterPushToTalkHotkey()
+
+	pttLock.Lock()
+	pttHeld = false
+	pttOpen = false
+	if pttReleaseTimer != nil {
+		pttReleaseTimer.Stop()
+		pttReleaseTimer = nil
+	}
+	pttLock.Unlock()
+}
+
+// pushToTalkActive reports whether push-to-talk currently lets audio through.
+func pushToTalkActive() bool {
+	pttLock.Lock()
+	defer pttLock.Unlock()
+	return pttOpen
+}
+
+/**
+ * PushToTalkPressed opens the microphone in push-to-talk mode until PushToTalkReleased is called
+ */
+func (a *App) PushToTalkPressed() {
+	pttLock.Lock()
+	if pttReleaseTimer != nil {
+		pttReleaseTimer.Stop()
+		pttReleaseTimer = nil
+	}
+	wasOpen := pttOpen
+	pttHeld = true
+	pttOpen = true
+	pttLock.Unlock()
+
+	if !wasOpen {
+		runtime.EventsEmit(a.ctx, "push-to-talk", true)
+	}
+}
+
+/**
+ * PushToTalkReleased closes the microphone once the configured release delay has passed
+ */
+func (a *App) PushToTalkReleased() {
+	pttLock.Lock()
+	defer pttLock.Unlock()
+
+	if !pttHeld {
+		return
+	}
+	pttHeld = false
+	if pttReleaseTimer != nil {
+		pttReleaseTimer.Stop()
+	}
+	pttReleaseTimer = time.AfterFunc(pttReleaseDelay, func() { closePushToTalk(a) })
+}
+
+// closePushToTalk ends transmission after the release delay unless the key went down again.
+func closePushToTalk(a *App) {
+	pttLock.Lock()
+	if pttHeld || !pttOpen {
+		pttLock.Unlock()
+		return
+	}
+	pttOpen = false
+	pttReleaseTimer = nil
+	pttLock.Unlock()
+
+	runtime.EventsEmit(a.ctx, "push-to-talk", false)
+	stopLocalSpeaking()
+}
@@ -0,0 +1,348 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	"gossip_common"
+
+	"github.com/pion/webrtc/v4"
+	"github.com/wailsapp/wails/v2/pkg/runtime"
+)
+
+const (
+	defaultPeerGracePeriod = 30 // Seconds to keep trying to reconnect a participant before dropping them
+
+	iceRestartDelay        = 2 * time.Second // Time ICE gets to recover by itself after a disconnect before we restart it
+	iceRestartInterval     = 5 * time.Second // Time between restart attempts while a participant stays unreachable
+	connectionQualityCheck = 3 * time.Second // How often the quality of each connection is measured
+
+	qualityGood         = "good"
+	qualityFair         = "fair"
+	qualityPoor         = "poor"
+	qualityConnecting   = "connecting"
+	qualityReconnecting = "reconnecting"
+	qualityRelayed      = "relayed"
+
+	goodRoundTrip = 150 * time.Millisecond // Round trips up to this are good, twice as long still fair
+)
+
+// peerRecovery tracks the reconnection attempts of one participant.
+type peerRecovery struct {
+	stop  chan struct{}
+	since time.Time
+}
+
+var (
+	watchedPeers = make(map[string]*webrtc.PeerConnection) // Peer connections whose state we follow
+	recoveries   = make(map[string]*peerRecovery)          // Participants we are trying to reconnect
+	peerQuality  = make(map[string]string)                 // Last connection quality reported for each participant
+	qualityStop  chan struct{}
+	recoveryLock sync.Mutex
+)
+
+/**
+ * watchPeerConnection follows a participant's connection. When ICE disconnects or fails we
+ * restart it until it recovers or the grace period runs out, relaying their audio through
+ * the server until then.
+ * @param a The application instance.
+ * @param id The participant.
+ * @param pc Their peer connection.
+ */
+func watchPeerConnection(a *App, id string, pc *webrtc.PeerConnection) {
+	recoveryLock.Lock()
+	watchedPeers[id] = pc
+	recoveryLock.Unlock()
+
+	pc.OnICEConnectionStateChange(func(state webrtc.ICEConnectionState) {
+		if debugLogging {
+			gossip_common.Dbg("ICE connection to %s is %s", id, state)
+		}
+
+		switch state {
+		case webrtc.ICEConnectionStateDisconnected:
+			beginRecovery(a, id, pc)
+		case webrtc.ICEConnectionStateFailed:
+			beginRecovery(a, id, pc)
+			relayPeer(a, id)
+		case webrtc.ICEConnectionStateConnected, webrtc.ICEConnectionStateCompleted:
+			if endRecovery(id) {
+				gossip_common.Log("Reconnected to %s", id)
+				runtime.EventsEmit(a.ctx, "caller_reconnected", id)
+			}
+			if stopRelayingPeer(id) {
+				rosterUpdate(a, id, func(entry *RosterEntry) { entry.Relayed = false })
+			}
+		}
+		updateConnectionQuality(a, id, pc)
+	})
+
+	pc.OnConnectionStateChange(func(state webrtc.PeerConnectionState) {
+		switch state {
+		case webrtc.PeerConnectionStateFailed:
+			relayPeer(a, id)
+		case webrtc.PeerConnectionStateConnected:
+			if stopRelayingPeer(id) {
+				rosterUpdate(a, id, func(entry *RosterEntry) { entry.Relayed = false })
+			}
+		}
+		updateConnectionQuality(a, id, pc)
+	})
+}
+
+/**
+ * beginRecovery starts reconnecting a participant unless we already are. ICE gets a moment to
+ * recover by itself, then their audio is relayed through the server and ICE is restarted every
+ * iceRestartInterval until the grace period runs out.
+ * @param a The application instance.
+ * @param id The participant.
+ * @param pc Their peer connection.
+ */
+func beginRecovery(a *App, id string, pc *webrtc.PeerConnection) {
+	recoveryLock.Lock()
+	if _, recovering := recoveries[id]; recovering || watchedPeers[id] != pc {
+		recoveryLock.Unlock()
+		return
+	}
+	recovery := &peerRecovery{stop: make(chan struct{}), since: time.Now()}
+	recoveries[id] = recovery
+	recoveryLock.Unlock()
+
+	grace := loadPeerGracePeriod()
+	gossip_common.Log("Lost the connection to %s, reconnecting for up to %s", id, grace)
+	runtime.EventsEmit(a.ctx, "caller_reconnecting", id)
+
+	go func() {
+		firstRestart := time.NewTimer(iceRestartDelay)
+		defer firstRestart.Stop()
+		deadline := time.NewTimer(grace)
+		defer deadline.Stop()
+		var retries <-chan time.Time
+
+		for {
+			select {
+			case <-recovery.stop:
+				return
+			case <-firstRestart.C:
+				// A short blip has recovered by now, so keep the audio going through the server in the meantime
+				relayPeer(a, id)
+				ticker := time.NewTicker(iceRestartInterval)
+				defer ticker.Stop()
+				retries = ticker.C
+				restartICE(id, pc)
+			case <-retries:
+				restartICE(id, pc)
+			case <-deadline.C:
+				giveUpPeer(a, id, recovery)
+				return
+			}
+		}
+	}()
+}
+
+// endRecovery stops reconnecting a participant, reporting whether we were.
+func endRecovery(id string) bool {
+	recoveryLock.Lock()
+	defer recoveryLock.Unlock()
+
+	recovery, recovering := recoveries[id]
+	if recovering {
+		close(recovery.stop)
+		delete(recoveries, id)
+	}
+	return recovering
+}
+
+/**
+ * restartICE sends a participant an offer with fresh ICE credentials, so both sides gather new
+ * candidates on whatever network they are on now. Only the participant with the lower client ID
+ * restarts, so the two sides never offer at once; the other answers through HandleOffer.
+ * @param id The participant.
+ * @param pc Their peer connection.
+ */
+func restartICE(id string, pc *webrtc.PeerConnection) {
+	if gossip_common.GetClientID() > id {
+		return
+	}
+	if pc.SignalingState() != webrtc.SignalingStateStable {
+		// An earlier offer is still waiting for its answer
+		return
+	}
+
+	if err := sendOffer(id, pc, &webrtc.OfferOptions{ICERestart: true}); err != nil {
+		gossip_common.Err("Failed to send ICE restart offer to %s: %v", id, err)
+		return
+	}
+
+	if debugLogging {
+		gossip_common.Dbg("Sent ICE restart offer to %s", id)
+	}
+}
+
+/**
+ * giveUpPeer closes a participant's peer connection once the grace period is over. If their
+ * audio is relayed through the server they stay in the call without video; anyone else is dropped.
+ * @param a The application instance.
+ * @param id The participant.
+ * @param recovery The attempts being given up.
+ */
+func giveUpPeer(a *App, id string, recovery *peerRecovery) {
+	recoveryLock.Lock()
+	current := recoveries[id] == recovery
+	if current {
+		delete(recoveries, id)
+	}
+	recoveryLock.Unlock()
+	if !current {
+		return
+	}
+
+	if isRelayedPeer(id) {
+		gossip_common.Log("Could not reconnect to %s after %s, keeping their audio on the server", id, time.Since(recovery.since).Round(time.Second))
+		closePeerConnection(id)
+		return
+	}
+
+	gossip_common.Log("Dropped %s after %s without a connection", id, time.Since(recovery.since).Round(time.Second))
+	closeParticipant(id)
+	rosterLeave(a, id)
+	runtime.EventsEmit(a.ctx, "caller_dropped", id)
+	runtime.EventsEmit(a.ctx, "caller_hung_up", id)
+}
+
+// forgetPeerConnection stops following a participant's connection once it is closed.
+func forgetPeerConnection(id string) {
+	endRecovery(id)
+	forgetCallStats(id)
+
+	recoveryLock.Lock()
+	delete(watchedPeers, id)
+	delete(peerQuality, id)
+	recoveryLock.Unlock()
+}
+
+/**
+ * loadPeerGracePeriod reads how long to keep reconnecting a participant from the settings.
+ * @return time.Duration The grace period.
+ */
+func loadPeerGracePeriod() time.Duration {
+	seconds := defaultPeerGracePeriod
+	settings, err := LoadSettings()
+	if err != nil {
+		gossip_common.Err("Failed to load the reconnect grace period, using the default: %v", err)
+	} else if settings.PeerGracePeriod >= 5 && settings.PeerGracePeriod <= 600 {
+		seconds = settings.PeerGracePeriod
+	}
+	return time.Duration(seconds) * time.Second
+}
+
+/**
+ * connectionQuality rates a participant's connection from its state and the round trip time
+ * measured over it.
+ * @param id The participant.
+ * @param pc Their peer connection.
+ * @return string The quality, or "" once the connection is closed.
+ */
+func connectionQuality(id string, pc *webrtc.PeerConnection) string {
+	if isRelayedPeer(id) {
+		return qualityRelayed
+	}
+
+	switch pc.ICEConnectionState() {
+	case webrtc.ICEConnectionStateNew, webrtc.ICEConnectionStateChecking:
+		return qualityConnecting
+	case webrtc.ICEConnectionStateDisconnected, webrtc.ICEConnectionStateFailed:
+		return qualityReconnecting
+	case webrtc.ICEConnectionStateClosed:
+		return ""
+	}
+
+	roundTrip := time.Duration(linkRoundTrip(id, pc) * float64(time.Millisecond))
+
+	switch {
+	case roundTrip <= goodRoundTrip:
+		return qualityGood
+	case roundTrip <= 2*goodRoundTrip:
+		return qualityFair
+	}
+	return qualityPoor
+}
+
+/**
+ * updateConnectionQuality measures a participant's connection and emits connection-quality
+ * with their ID and the quality when it changed.
+ * @param a The application instance.
+ * @param id The participant.
+ * @param pc Their peer connection.
+ */
+func updateConnectionQuality(a *App, id string, pc *webrtc.PeerConnection) {
+	quality := connectionQuality(id, pc)
+
+	recoveryLock.Lock()
+	changed := watchedPeers[id] == pc && peerQuality[id] != quality
+	if changed {
+		peerQuality[id] = quality
+	}
+	recoveryLock.Unlock()
+	if !changed || quality == "" {
+		return
+	}
+
+	runtime.EventsEmit(a.ctx, "connection-quality", id, quality)
+	rosterUpdate(a, id, func(entry *RosterEntry) { entry.Quality = quality })
+}
+
+/**
+ * startConnectionMonitor measures every participant's connection quality until the call ends.
+ * @param a The application instance.
+ */
+func startConnectionMonitor(a *App) {
+	recoveryLock.Lock()
+	defer recoveryLock.Unlock()
+
+	if qualityStop != nil {
+		close(qualityStop)
+	}
+	stop := make(chan struct{})
+	qualityStop = stop
+
+	go func() {
+		ticker := time.NewTicker(connectionQualityCheck)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+				recoveryLock.Lock()
+				peers := make(map[string]*webrtc.PeerConnection, len(watchedPeers))
+				for id, pc := range watchedPeers {
+					peers[id] = pc
+				}
+				recoveryLock.Unlock()
+
+				for id, pc := range peers {
+					updateConnectionQuality(a, id, pc)
+				}
+			}
+		}
+	}()
+}
+
+// stopConnectionMonitor stops measuring connections and abandons any reconnection attempts.
+func stopConnectionMonitor() {
+	recoveryLock.Lock()
+	defer recoveryLock.Unlock()
+
+	if qualityStop != nil {
+		close(qualityStop)
+		qualityStop = nil
+	}
+	for id, recovery := range recoveries {
+		close(recovery.stop)
+		delete(recoveries, id)
+	}
+	watchedPeers = make(map[string]*webrtc.PeerConnection)
+	peerQuality = make(map[string]string)
+}
@@ -0,0 +1,69 @@
+package main
+
+// resampler converts a stream between sample rates by linear interpolation. When the
+// rate goes down, the input is low-passed first so content above the new Nyquist
+// frequency does not fold back as noise.
+type resampler struct {
+	step    float64 // Input samples per output sample
+	pos     float64 // Position of the next output sample, 0 being the last sample of the previous chunk
+	prev    float64
+	lowPass *biquadFilter
+}
+
+/**
+ * newResampler creates a resampler.
+ * @param inRate The input sample rate in Hz.
+ * @param outRate The output sample rate in Hz.
+ * @return The resampler.
+ */
+func newResampler(inRate, outRate int) *resampler {
+	r := &resampler{step: float64(inRate) / float64(outRate)}
+	if outRate < inRate {
+		r.lowPass = newLowPassFilter(0.45*float64(outRate), inRate)
+	}
+	return r
+}
+
+// process resamples the next chunk of the stream.
+func (r *resampler) process(in []float64) []float64 {
+	out := make([]float64, 0, int(float64(len(in))/r.step)+2)
+	if r.lowPass != nil {
+		filtered := make([]float64, len(in))
+		for i, x := range in {
+			filtered[i] = r.lowPass.filter(x)
+		}
+		in = filtered
+	}
+
+	// Sample i of the chunk sits at position i+1, after the one kept from the last chunk
+	for int(r.pos) < len(in) {
+		i := int(r.pos)
+		frac := r.pos - float64(i)
+		a := r.prev
+		if i > 0 {
+			a = in[i-1]
+		}
+		out = append(out, a+(in[i]-a)*frac)
+		r.pos += r.step
+	}
+
+	if len(in) > 0 {
+		r.pos -= float64(len(in))
+		r.prev = in[len(in)-1]
+	}
+	return out
+}
+
+// Process resamples 16-bit samples.
+func (r *resampler) Process(pcm []int16) []int16 {
+	in := make([]float64, len(pcm))
+	for i, sample := range pcm {
+		in[i] = float64(sample)
+	}
+	resampled := r.process(in)
+	out := make([]int16, len(resampled))
+	for i, x := range resampled {
+		out[i] = clampSample(x)
+	}
+	return out
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"math"
+	"testing"
+)
+
+// sine returns n samples of a tone at the given frequency and sample rate.
+func sine(frequency float64, rate, n int) []float64 {
+	out := make([]float64, n)
+	for i := range out {
+		out[i] = 10000 * math.Sin(2*math.Pi*frequency*float64(i)/float64(rate))
+	}
+	return out
+}
+
+// rms returns the root mean square of samples, skipping the filter's warm-up at the start.
+func rms(samples []float64) float64 {
+	samples = samples[len(samples)/4:]
+	sum := 0.0
+	for _, x := range samples {
+		sum += x * x
+	}
+	return math.Sqrt(sum / float64(len(samples)))
+}
+
+// resampleChunks runs a stream through a resampler in uneven chunks, as device callbacks deliver it.
+func resampleChunks(r *resampler, in []float64) []float64 {
+	var out []float64
+	for start, size := 0, 1; start < len(in); start, size = start+size, size%480+7 {
+		end := min(start+size, len(in))
+		out = append(out, r.process(in[start:end])...)
+	}
+	return out
+}
+
+func TestResamplerLength(t *testing.T) {
+	for _, tc := range []struct{ in, out int }{
+		{44100, 48000},
+		{48000, 44100},
+		{16000, 48000},
+		{96000, 48000},
+	} {
+		in := make([]float64, tc.in*3)
+		out := resampleChunks(newResampler(tc.in, tc.out), in)
+		want := float64(len(in)) * float64(tc.out) / float64(tc.in)
+		if math.Abs(float64(len(out))-want) > 2 {
+			t.Errorf("%d to %d Hz: %d samples, want %.0f", tc.in, tc.out, len(out), want)
+		}
+	}
+}
+
+func TestResamplerKeepsTone(t *testing.T) {
+	for _, tc := range []struct{ in, out int }{
+		{44100, 48000},
+		{48000, 44100},
+		{96000, 48000},
+	} {
+		in := sine(1000, tc.in, tc.in)
+		out := resampleChunks(newResampler(tc.in, tc.out), in)
+
+		if ratio := rms(out) / rms(in); ratio < 0.95 || ratio > 1.05 {
+			t.Errorf("%d to %d Hz: a 1 kHz tone kept %.2f of its level", tc.in, tc.out, ratio)
+		}
+
+		// Compare against the same tone generated at the output rate, allowing for the filter's delay
+		want := sine(1000, tc.out, len(out))
+		best := math.Inf(1)
+		for lag := 0; lag < 20; lag++ {
+			diff := make([]float64, 0, len(out))
+			for i := lag; i < len(out); i++ {
+				diff = append(diff, out[i]-want[i-lag])
+			}
+			best = math.Min(best, rms(diff))
+		}
+		if best > 0.05*rms(want) {
+			t.Errorf("%d to %d Hz: output differs from the tone by %.0f", tc.in, tc.out, best)
+		}
+	}
+}
+
+func TestResamplerFiltersAliasing(t *testing.T) {
+	// 20 kHz does not exist at 16 kHz and would fold back to 4 kHz without the low-pass filter
+	in := sine(20000, 48000, 48000)
+	out := resampleChunks(newResampler(48000, 16000), in)
+
+	if ratio := rms(out) / rms(in); ratio > 0.3 {
+		t.Fatalf("a 20 kHz tone kept %.2f of its level at 16 kHz", ratio)
+	}
+}
+
+func TestResamplerProcessClamps(t *testing.T) {
+	r := newResampler(48000, 44100)
+	out := r.Process([]int16{math.MaxInt16, math.MinInt16, math.MaxInt16, 0})
+	for _, sample := range out {
+		if sample < math.MinInt16 || sample > math.MaxInt16 {
+			t.Fatalf("sample %d out of range", sample)
+		}
+	}
+	if len(out) == 0 {
+		t.Fatal("no output")
+	}
+}
@@ -0,0 +1,242 @@
+package main
+
+import (
+	"encoding/json"
+	"sort"
+	"sync"
+	"time"
+
+	"gossip_common"
+
+	"github.com/wailsapp/wails/v2/pkg/runtime"
+)
+
+const talkingHoldTime = 400 * time.Millisecond // How long a participant stays "talking" after their last loud frame
+
+/**
+ * RosterEntry describes one participant of the current call for the UI.
+ * @param ID The participant's client ID.
+ * @param Self Whether the entry is the local user.
+ * @param Muted Whether the participant's microphone is muted.
+ * @param Deafened Whether the participant has deafened themselves.
+ * @param Talking Whether the participant is currently speaking.
+ * @param Connected Whether audio is flowing to or from the participant.
+ * @param Joined When the participant joined, in Unix milliseconds.
+ */
+type RosterEntry struct {
+	ID        string `json:"id"`
+	Self      bool   `json:"self"`
+	Muted     bool   `json:"muted"`
+	Deafened  bool   `json:"deafened"`
+	Talking   bool   `json:"talking"`
+	Camera    bool   `json:"camera"`
+	Screen    bool   `json:"screen"`
+	Connected bool   `json:"connected"`
+	Relayed   bool   `json:"relayed"` // Audio goes through the server because a direct connection failed
+	Quality   string `json:"quality"` // Connection quality: good, fair, poor, connecting, reconnecting or relayed
+	Joined    int64  `json:"joined"`
+}
+
+var (
+	callRoster   = make(map[string]*RosterEntry)
+	lastTalking  = make(map[string]time.Time)
+	rosterLock   sync.Mutex
+	talkingTimer *time.Ticker
+)
+
+/**
+ * GetCallRoster returns the participants of the current call, ourselves included
+ * @return []RosterEntry The participants ordered by join time
+ */
+func (a *App) GetCallRoster() []RosterEntry {
+	rosterLock.Lock()
+	defer rosterLock.Unlock()
+
+	return rosterSnapshot()
+}
+
+// rosterSnapshot copies the roster. The caller must hold rosterLock.
+func rosterSnapshot() []RosterEntry {
+	entries := make([]RosterEntry, 0, len(callRoster))
+	for _, entry := range callRoster {
+		entries = append(entries, *entry)
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].Joined == entries[j].Joined {
+			return entries[i].ID < entries[j].ID
+		}
+		return entries[i].Joined < entries[j].Joined
+	})
+	return entries
+}
+
+// emitRoster pushes the current roster to the UI.
+func emitRoster(a *App) {
+	rosterLock.Lock()
+	entries := rosterSnapshot()
+	rosterLock.Unlock()
+
+	runtime.EventsEmit(a.ctx, "call-roster-updated", entries)
+}
+
+// resetRoster starts a new roster containing only ourselves.
+func resetRoster(a *App) {
+	rosterLock.Lock()
+	callRoster = map[string]*RosterEntry{
+		gossip_common.GetClientID(): {
+			ID:        gossip_common.GetClientID(),
+			Self:      true,
+			Muted:     muted,
+			Deafened:  deafened,
+			Connected: true,
+			Joined:    time.Now().UnixMilli(),
+		},
+	}
+	lastTalking = make(map[string]time.Time)
+	if talkingTimer == nil {
+		talkingTimer = time.NewTicker(talkingHoldTime / 2)
+		go expireTalking(a, talkingTimer)
+	}
+	rosterLock.Unlock()
+
+	emitRoster(a)
+}
+
+// clearRoster empties the roster when we leave a call.
+func clearRoster(a *App) {
+	rosterLock.Lock()
+	callRoster = make(map[string]*RosterEntry)
+	lastTalking = make(map[string]time.Time)
+	if talkingTimer != nil {
+		talkingTimer.Stop()
+		talkingTimer = nil
+	}
+	rosterLock.Unlock()
+
+	emitRoster(a)
+}
+
+// rosterJoin adds a participant, keeping their state if they are already listed.
+func rosterJoin(a *App, id string) {
+	rosterLock.Lock()
+	if _, exists := callRoster[id]; !exists {
+		callRoster[id] = &RosterEntry{ID: id, Joined: time.Now().UnixMilli()}
+	}
+	rosterLock.Unlock()
+
+	emitRoster(a)
+}
+
+// rosterLeave removes a participant.
+func rosterLeave(a *App, id string) {
+	rosterLock.Lock()
+	delete(callRoster, id)
+	delete(lastTalking, id)
+	rosterLock.Unlock()
+
+	emitRoster(a)
+}
+
+// rosterUpdate applies a change to a listed participant and pushes the roster if anything changed.
+func rosterUpdate(a *App, id string, update func(entry *RosterEntry)) {
+	rosterLock.Lock()
+	entry, exists := callRoster[id]
+	if !exists {
+		rosterLock.Unlock()
+		return
+	}
+	before := *entry
+	update(entry)
+	changed := before != *entry
+	rosterLock.Unlock()
+
+	if changed {
+		emitRoster(a)
+	}
+}
+
+// markTalking records that a participant just produced audible sound.
+func markTalking(a *App, id string) {
+	rosterLock.Lock()
+	_, alreadyTalking := lastTalking[id]
+	lastTalking[id] = time.Now()
+	rosterLock.Unlock()
+
+	if !alreadyTalking {
+		runtime.EventsEmit(a.ctx, "participant-speaking-started", id)
+	}
+	rosterUpdate(a, id, func(entry *RosterEntry) { entry.Talking = true })
+}
+
+// expireTalking clears the talking flag of participants that have gone quiet.
+func expireTalking(a *App, ticker *time.Ticker) {
+	for range ticker.C {
+		rosterLock.Lock()
+		quiet := []string{}
+		for id, last := range lastTalking {
+			if time.Since(last) > talkingHoldTime {
+				quiet = append(quiet, id)
+				delete(lastTalking, id)
+			}
+		}
+		rosterLock.Unlock()
+
+		for _, id := range quiet {
+			runtime.EventsEmit(a.ctx, "participant-speaking-stopped", id)
+			rosterUpdate(a, id, func(entry *RosterEntry) { entry.Talking = false })
+		}
+	}
+}
+
+/**
+ * sendCallState tells the other participants whether we are muted, deafened, sending video or sharing our screen.
+ * @param a The application instance.
+ */
+func sendCallState(a *App) {
+	videoLock.Lock()
+	camera := cameraOn
+	screen := screenSharing
+	videoLock.Unlock()
+
+	rosterUpdate(a, gossip_common.GetClientID(), func(entry *RosterEntry) {
+		entry.Muted = muted
+		entry.Deafened = deafened
+		entry.Camera = camera
+		entry.Screen = screen
+	})
+
+	if !inCall || callID == "" {
+		return
+	}
+
+	payload, err := json.Marshal(gossip_common.CallParticipantState{Muted: muted, Deafened: deafened, Camera: camera, Screen: screen})
+	if err != nil {
+		gossip_common.Err("Failed to marshal call state: %v", err)
+		return
+	}
+	statePacket := gossip_common.NewSignalPacketFromData("call_state", callID, gossip_common.GetClientID(), payload)
+	if err := sendSignal(statePacket); err != nil {
+		gossip_common.Err("Failed to send call state: %v", err)
+	}
+}
+
+/**
+ * handleCallState applies a "call_state" packet from another participant.
+ * @param a The application instance.
+ * @param sender The participant the state belongs to.
+ * @param payload The JSON encoded gossip_common.CallParticipantState.
+ */
+func handleCallState(a *App, sender string, payload []byte) {
+	var state gossip_common.CallParticipantState
+	if err := json.Unmarshal(payload, &state); err != nil {
+		gossip_common.Err("Failed to unmarshal call state from %s: %v", sender, err)
+		return
+	}
+
+	rosterUpdate(a, sender, func(entry *RosterEntry) {
+		entry.Muted = state.Muted
+		entry.Deafened = state.Deafened
+		entry.Camera = state.Camera
+		entry.Screen = state.Screen
+	})
+}
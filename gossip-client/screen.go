@@ -0,0 +1,250 @@
+package main
+
+import (
+	"errors"
+	"time"
+
+	"gossip_common"
+
+	"github.com/pion/webrtc/v4"
+	"github.com/wailsapp/wails/v2/pkg/runtime"
+)
+
+// Surfaces the frontend can ask the platform picker to offer.
+const (
+	screenSurfaceMonitor = "screen"
+	screenSurfaceWindow  = "window"
+)
+
+const (
+	screenTrackID               = "screen"
+	defaultScreenShareWidth     = 1920
+	defaultScreenShareHeight    = 1080
+	defaultScreenShareFramerate = 15
+)
+
+/**
+ * ScreenShareConfig describes the screen share the frontend captures and encodes.
+ * @param Surface "screen" for a whole display or "window" for a single window.
+ * @param Width The largest frame width in pixels, frames are scaled down to fit.
+ * @param Height The largest frame height in pixels.
+ * @param Framerate The most frames per second to send.
+ * @param Codec "vp8" or "h264", the same as the camera.
+ */
+type ScreenShareConfig struct {
+	Surface   string `json:"surface"`
+	Width     int    `json:"width"`
+	Height    int    `json:"height"`
+	Framerate int    `json:"framerate"`
+	Codec     string `json:"codec"`
+}
+
+var (
+	localScreenTrack *webrtc.TrackLocalStaticSample // Shared by every peer connection, guarded by videoLock
+	screenConfig     ScreenShareConfig
+	screenSharing    bool
+	lastScreenFrame  time.Time
+)
+
+/**
+ * loadScreenShareConfig reads the screen share limits, falling back to defaults for missing or invalid values.
+ * @return The screen share configuration without a surface.
+ */
+func loadScreenShareConfig() ScreenShareConfig {
+	config := ScreenShareConfig{
+		Width:     defaultScreenShareWidth,
+		Height:    defaultScreenShareHeight,
+		Framerate: defaultScreenShareFramerate,
+	}
+
+	settings, err := LoadSettings()
+	if err != nil {
+		gossip_common.Err("Failed to load screen share settings, using defaults: %v", err)
+		return config
+	}
+
+	if validVideoSize(settings.ScreenWidth, settings.ScreenHeight, settings.ScreenFramerate) == nil {
+		config.Width = settings.ScreenWidth
+		config.Height = settings.ScreenHeight
+		config.Framerate = settings.ScreenFramerate
+	}
+	return config
+}
+
+// startScreenTrack creates the local screen share track for a new call, using the camera's codec.
+// Frames only flow while sharing. Must be called after startVideoTrack.
+func startScreenTrack() {
+	config := loadScreenShareConfig()
+
+	videoLock.Lock()
+	defer videoLock.Unlock()
+
+	config.Codec = videoConfig.Codec
+	screenConfig = config
+	localScreenTrack = nil
+
+	track, err := webrtc.NewTrackLocalStaticSample(
+		webrtc.RTPCodecCapability{MimeType: videoMimeType(config.Codec), ClockRate: videoClockRate},
+		screenTrackID, "gossip-"+gossip_common.GetClientID())
+	if err != nil {
+		gossip_common.Err("Failed to create screen share track: %v", err)
+		return
+	}
+	localScreenTrack = track
+}
+
+/**
+ * stopScreenTrack drops the local screen share track at the end of a call and stops sharing.
+ * @param a The application instance.
+ */
+func stopScreenTrack(a *App) {
+	videoLock.Lock()
+	wasSharing := screenSharing
+	screenSharing = false
+	localScreenTrack = nil
+	videoLock.Unlock()
+
+	if wasSharing {
+		runtime.EventsEmit(a.ctx, "screen-share-stopped")
+	}
+}
+
+/**
+ * addScreenTrack attaches our screen share track to a peer connection.
+ * @param a The application instance.
+ * @param pc The peer connection.
+ * @return error Error if the track could not be added.
+ */
+func addScreenTrack(a *App, pc *webrtc.PeerConnection) error {
+	videoLock.Lock()
+	track := localScreenTrack
+	videoLock.Unlock()
+
+	return addLocalVideoTrack(a, pc, track, "screen-keyframe-request")
+}
+
+/**
+ * StartScreenShare starts sharing the screen. The frontend receives "screen-share-started"
+ * with the ScreenShareConfig, lets the user pick what to share and sends the encoded frames
+ * back with SendScreenFrame. Participants whose connection has no screen share track yet get
+ * it through a renegotiation
+ * @param surface "screen" to offer whole displays or "window" to offer single windows, where the platform's picker supports it
+ * @return error Error if not in a call or the surface is unknown
+ */
+func (a *App) StartScreenShare(surface string) error {
+	if surface != screenSurfaceMonitor && surface != screenSurfaceWindow {
+		return errors.New("surface must be \"screen\" or \"window\"")
+	}
+
+	videoLock.Lock()
+	if localScreenTrack == nil {
+		videoLock.Unlock()
+		return errors.New("not in a call")
+	}
+	screenSharing = true
+	screenConfig.Surface = surface
+	lastScreenFrame = time.Time{}
+	config := screenConfig
+	track := localScreenTrack
+	videoLock.Unlock()
+
+	attachVideoTrack(a, track, "screen-keyframe-request")
+
+	runtime.EventsEmit(a.ctx, "screen-share-started", config)
+	sendCallState(a)
+	return nil
+}
+
+/**
+ * StopScreenShare stops sharing the screen
+ */
+func (a *App) StopScreenShare() {
+	videoLock.Lock()
+	wasSharing := screenSharing
+	screenSharing = false
+	videoLock.Unlock()
+
+	if wasSharing {
+		runtime.EventsEmit(a.ctx, "screen-share-stopped")
+		sendCallState(a)
+	}
+}
+
+/**
+ * SetScreenShareLimits chooses the largest resolution and framerate a screen share is sent at,
+ * saves them and applies them to the running share
+ * @param width The largest frame width in pixels
+ * @param height The largest frame height in pixels
+ * @param framerate The most frames per second
+ * @return error Error if the values are out of range or could not be saved
+ */
+func (a *App) SetScreenShareLimits(width, height, framerate int) error {
+	if err := validVideoSize(width, height, framerate); err != nil {
+		return err
+	}
+
+	settings, err := LoadSettings()
+	if err != nil {
+		return err
+	}
+	settings.ScreenWidth = width
+	settings.ScreenHeight = height
+	settings.ScreenFramerate = framerate
+	if err := SaveSettings(settings); err != nil {
+		return err
+	}
+
+	videoLock.Lock()
+	screenConfig.Width = width
+	screenConfig.Height = height
+	screenConfig.Framerate = framerate
+	config := screenConfig
+	sharing := screenSharing
+	videoLock.Unlock()
+
+	if sharing {
+		runtime.EventsEmit(a.ctx, "screen-share-started", config)
+	}
+	return nil
+}
+
+/**
+ * GetScreenShareConfig returns the screen share limits of the current call, or the saved ones outside a call
+ * @return ScreenShareConfig The surface, resolution and framerate limits and codec
+ */
+func (a *App) GetScreenShareConfig() ScreenShareConfig {
+	videoLock.Lock()
+	defer videoLock.Unlock()
+
+	if localScreenTrack == nil {
+		return loadScreenShareConfig()
+	}
+	return screenConfig
+}
+
+/**
+ * SendScreenFrame sends one encoded screen frame to every participant. Screen content changes
+ * irregularly, so each frame lasts until the next one instead of a fixed frame interval
+ * @param frame The VP8 frame or H.264 access unit in Annex B format, base64 encoded
+ * @return error Error if not sharing or the frame could not be sent
+ */
+func (a *App) SendScreenFrame(frame string) error {
+	videoLock.Lock()
+	track := localScreenTrack
+	config := screenConfig
+	sharing := screenSharing
+
+	now := time.Now()
+	duration := time.Second / time.Duration(config.Framerate)
+	if !lastScreenFrame.IsZero() {
+		duration = now.Sub(lastScreenFrame)
+	}
+	lastScreenFrame = now
+	videoLock.Unlock()
+
+	if track == nil || !sharing {
+		return errors.New("not sharing the screen")
+	}
+
+	return writeVideoFrame(track, config.Codec, frame, duration)
+}
@@ -0,0 +1,567 @@
+package main
+
+import (
+	"crypto/ecdh"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	"gossip_common"
+
+	"github.com/wailsapp/wails/v2/pkg/runtime"
+)
+
+const (
+	maxPendingChats      = 64               // Channel messages held per sender while waiting for their sender key
+	maxOutboundMessages  = 64               // Pairwise messages held per peer while the session handshake runs
+	handshakeTimeout     = 10 * time.Second // How long a handshake waits for its reply before it is sent again
+	handshakeAttempts    = 3                // Handshakes sent before the messages waiting for the session are dropped
+	pendingChatTimeout   = time.Minute      // How long a channel message waits for its sender key before it is dropped
+	pendingSweepInterval = 5 * time.Second  // How often pending handshakes and channel messages are checked
+)
+
+/**
+ * secureEnvelope is the plaintext carried inside a pairwise ratchet message.
+ * @param Type "hello", "skd" (sender key distribution) or "dm" (direct message).
+ * @param Body The JSON body for the type.
+ */
+type secureEnvelope struct {
+	Type string `json:"t"`
+	Body []byte `json:"b"`
+}
+
+/**
+ * ratchetHandshake is the signed, PGP-encrypted payload of "dri" and "drr" packets.
+ * @param Key The sender's ephemeral X25519 public key.
+ * @param Message The responder's first ratchet message, which gives the initiator a sending chain.
+ */
+type ratchetHandshake struct {
+	Key     []byte                        `json:"eph"`
+	Message *gossip_common.RatchetMessage `json:"msg,omitempty"`
+}
+
+// pendingHandshake is a handshake we started and are waiting on a "drr" for.
+type pendingHandshake struct {
+	key      *ecdh.PrivateKey
+	sent     time.Time
+	attempts int
+}
+
+// pendingChat is a channel message held until its sender key arrives.
+type pendingChat struct {
+	packet   gossip_common.GMDataPacket
+	received time.Time
+}
+
+/**
+ * chatBody is the plaintext of a channel or direct message.
+ * @param UID The sender's username.
+ * @param Message The message text.
+ */
+type chatBody struct {
+	UID     string `json:"uid"`
+	Message string `json:"msg"`
+}
+
+var (
+	sessionsLock        sync.Mutex
+	ratchetSessions     = make(map[string]*gossip_common.RatchetSession)               // Pairwise sessions by peer
+	pendingHandshakes   = make(map[string]*pendingHandshake)                           // Handshakes we started by peer
+	outboundEnvelopes   = make(map[string][]secureEnvelope)                            // Envelopes waiting for a session by peer
+	ownSenderKeys       = make(map[string]*gossip_common.SenderKey)                    // Our sending chains by channel
+	sharedSenderKeys    = make(map[string]map[string]uint32)                           // Generation each peer holds, by channel
+	peerSenderKeys      = make(map[string]map[string]*gossip_common.SenderKeyReceiver) // Receiving chains by peer and channel
+	pendingChats        = make(map[string][]pendingChat)                               // Channel messages waiting for a sender key
+	senderKeyGeneration uint32
+)
+
+/**
+ * encryptChannelMessage encrypts a channel message with our sender key for the channel,
+ * first distributing the key to every peer that does not hold the current generation.
+ * @param channel The channel the message is sent to.
+ * @param plaintext The message to encrypt.
+ * @return The encrypted message.
+ */
+func encryptChannelMessage(channel string, plaintext []byte) ([]byte, error) {
+	sessionsLock.Lock()
+	defer sessionsLock.Unlock()
+
+	self := gossip_common.GetClientID()
+	senderKey, exists := ownSenderKeys[channel]
+	if !exists {
+		senderKeyGeneration++
+		var err error
+		senderKey, err = gossip_common.NewSenderKey(senderKeyGeneration)
+		if err != nil {
+			return nil, err
+		}
+		ownSenderKeys[channel] = senderKey
+		sharedSenderKeys[channel] = make(map[string]uint32)
+
+		// Keep a receiving chain for ourselves so the server's echo of our message can be read
+		if err := storeSenderKey(self, senderKey.Distribution(channel)); err != nil {
+			return nil, err
+		}
+	}
+
+	distribution, err := json.Marshal(senderKey.Distribution(channel))
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal sender key: %w", err)
+	}
+	for id := range publicKeys {
+		if id == self || sharedSenderKeys[channel][id] == senderKey.Generation() {
+			continue
+		}
+		if err := sendSecureEnvelope(id, secureEnvelope{Type: "skd", Body: distribution}); err != nil {
+			gossip_common.Err("Failed to send sender key to %s: %v", id, err)
+			continue
+		}
+		sharedSenderKeys[channel][id] = senderKey.Generation()
+	}
+
+	return senderKey.Encrypt(plaintext, channelAD(channel, self))
+}
+
+/**
+ * decryptChannelMessage decrypts a channel message with the sender's key for the channel.
+ * Messages that arrive before the sender's key are held and replayed once it does.
+ * @param packet The "cht" data packet.
+ * @return The decrypted message, or nil if the message was held.
+ */
+func decryptChannelMessage(packet gossip_common.GMDataPacket) ([]byte, error) {
+	sessionsLock.Lock()
+	defer sessionsLock.Unlock()
+
+	generation, _, err := gossip_common.ParseSenderKeyHeader(packet.Payload)
+	if err != nil {
+		return nil, err
+	}
+
+	receiver, exists := peerSenderKeys[packet.Sender][packet.Destination]
+	if !exists || receiver.Generation() < generation {
+		if len(pendingChats[packet.Sender]) < maxPendingChats {
+			pendingChats[packet.Sender] = append(pendingChats[packet.Sender], pendingChat{packet: packet, received: time.Now()})
+		}
+		return nil, nil
+	}
+
+	return receiver.Decrypt(packet.Payload, channelAD(packet.Destination, packet.Sender))
+}
+
+// storeSenderKey records a peer's sender key. The caller must hold sessionsLock.
+func storeSenderKey(peer string, distribution gossip_common.SenderKeyDistribution) error {
+	receiver, err := gossip_common.NewSenderKeyReceiver(distribution)
+	if err != nil {
+		return err
+	}
+	if peerSenderKeys[peer] == nil {
+		peerSenderKeys[peer] = make(map[string]*gossip_common.SenderKeyReceiver)
+	}
+	peerSenderKeys[peer][distribution.Channel] = receiver
+	return nil
+}
+
+/**
+ * sendDirectMessage encrypts a message over the pairwise ratchet session with a peer.
+ * @param peer The recipient's client ID.
+ * @param plaintext The message to send.
+ * @return error An error if the message could not be sent or queued.
+ */
+func sendDirectMessage(peer string, plaintext []byte) error {
+	sessionsLock.Lock()
+	defer sessionsLock.Unlock()
+
+	return sendSecureEnvelope(peer, secureEnvelope{Type: "dm", Body: plaintext})
+}
+
+// sendSecureEnvelope sends an envelope over the pairwise session with a peer, starting the
+// handshake and queueing the envelope if the session is not ready. The caller must hold sessionsLock.
+func sendSecureEnvelope(peer string, envelope secureEnvelope) error {
+	session, exists := ratchetSessions[peer]
+	if exists && session.CanSend() {
+		return sendRatchetMessage(peer, session, envelope)
+	}
+
+	if len(outboundEnvelopes[peer]) >= maxOutboundMessages {
+		return fmt.Errorf("too many messages waiting for a session with %s", peer)
+	}
+	outboundEnvelopes[peer] = append(outboundEnvelopes[peer], envelope)
+
+	if _, started := pendingHandshakes[peer]; !exists && !started {
+		return startHandshake(peer)
+	}
+	return nil
+}
+
+// sendRatchetMessage encrypts an envelope and sends it as a "drm" packet. The caller must hold sessionsLock.
+func sendRatchetMessage(peer string, session *gossip_common.RatchetSession, envelope secureEnvelope) error {
+	plaintext, err := json.Marshal(envelope)
+	if err != nil {
+		return fmt.Errorf("failed to marshal envelope: %w", err)
+	}
+	msg, err := session.Encrypt(plaintext, pairAD(gossip_common.GetClientID(), peer))
+	if err != nil {
+		return err
+	}
+	payload, err := json.Marshal(msg)
+	if err != nil {
+		return fmt.Errorf("failed to marshal ratchet message: %w", err)
+	}
+	return sendPairwisePacket("drm", peer, payload)
+}
+
+// startHandshake sends a "dri" packet with a fresh ephemeral key, counting it as another attempt
+// when a handshake with the peer is already pending. The caller must hold sessionsLock.
+func startHandshake(peer string) error {
+	ephemeral, err := gossip_common.GenerateRatchetKey()
+	if err != nil {
+		return err
+	}
+
+	payload, err := sealHandshake(peer, ratchetHandshake{Key: ephemeral.PublicKey().Bytes()})
+	if err != nil {
+		return err
+	}
+	attempts := 1
+	if pending, exists := pendingHandshakes[peer]; exists {
+		attempts = pending.attempts + 1
+	}
+	pendingHandshakes[peer] = &pendingHandshake{key: ephemeral, sent: time.Now(), attempts: attempts}
+
+	if debugLogging {
+		gossip_common.Dbg("Starting ratchet session with %s", peer)
+	}
+	return sendPairwisePacket("dri", peer, payload)
+}
+
+/**
+ * handleHandshakeInit answers a peer's "dri" packet, creating a new pairwise session.
+ * When both sides start a handshake at once, the one with the lower client ID wins.
+ * @param packet The "dri" data packet.
+ * @return error An error if the handshake could not be completed.
+ */
+func handleHandshakeInit(packet gossip_common.GMDataPacket) error {
+	sessionsLock.Lock()
+	defer sessionsLock.Unlock()
+
+	peer := packet.Sender
+	init, err := openHandshake(peer, packet.Payload)
+	if err != nil {
+		return err
+	}
+
+	if _, started := pendingHandshakes[peer]; started && gossip_common.GetClientID() < peer {
+		// Our own handshake takes precedence; the peer will answer it
+		return nil
+	}
+	delete(pendingHandshakes, peer)
+
+	ephemeral, err := gossip_common.GenerateRatchetKey()
+	if err != nil {
+		return err
+	}
+	sk, err := gossip_common.RatchetSharedSecret(ephemeral, init.Key)
+	if err != nil {
+		return err
+	}
+	session, err := gossip_common.NewRatchetSender(sk, init.Key)
+	if err != nil {
+		return err
+	}
+
+	hello, err := json.Marshal(secureEnvelope{Type: "hello"})
+	if err != nil {
+		return fmt.Errorf("failed to marshal envelope: %w", err)
+	}
+	msg, err := session.Encrypt(hello, pairAD(gossip_common.GetClientID(), peer))
+	if err != nil {
+		return err
+	}
+
+	payload, err := sealHandshake(peer, ratchetHandshake{Key: ephemeral.PublicKey().Bytes(), Message: msg})
+	if err != nil {
+		return err
+	}
+	if err := sendPairwisePacket("drr", peer, payload); err != nil {
+		return err
+	}
+
+	// A new handshake means the peer lost its old session, and with it our sender keys
+	ratchetSessions[peer] = session
+	for channel := range sharedSenderKeys {
+		delete(sharedSenderKeys[channel], peer)
+	}
+	flushOutbound(peer, session)
+
+	if debugLogging {
+		gossip_common.Dbg("Accepted ratchet session from %s", peer)
+	}
+	return nil
+}
+
+/**
+ * handleHandshakeReply completes a handshake we started once the peer's "drr" arrives.
+ * @param packet The "drr" data packet.
+ * @return error An error if the reply does not match a pending handshake.
+ */
+func handleHandshakeReply(packet gossip_common.GMDataPacket) error {
+	sessionsLock.Lock()
+	defer sessionsLock.Unlock()
+
+	peer := packet.Sender
+	pending, started := pendingHandshakes[peer]
+	if !started {
+		return fmt.Errorf("unexpected handshake reply from %s", peer)
+	}
+	ephemeral := pending.key
+
+	reply, err := openHandshake(peer, packet.Payload)
+	if err != nil {
+		return err
+	}
+	if reply.Message == nil {
+		return fmt.Errorf("handshake reply from %s has no message", peer)
+	}
+
+	sk, err := gossip_common.RatchetSharedSecret(ephemeral, reply.Key)
+	if err != nil {
+		return err
+	}
+	session := gossip_common.NewRatchetReceiver(sk, ephemeral)
+	if _, err := session.Decrypt(reply.Message, pairAD(peer, gossip_common.GetClientID())); err != nil {
+		return err
+	}
+
+	delete(pendingHandshakes, peer)
+	ratchetSessions[peer] = session
+	flushOutbound(peer, session)
+
+	if debugLogging {
+		gossip_common.Dbg("Ratchet session with %s established", peer)
+	}
+	return nil
+}
+
+/**
+ * handleRatchetMessage decrypts a "drm" packet and dispatches the envelope inside it.
+ * @param packet The "drm" data packet.
+ * @param a The application instance.
+ * @return error An error if the message could not be decrypted.
+ */
+func handleRatchetMessage(packet gossip_common.GMDataPacket, a *App) error {
+	sessionsLock.Lock()
+
+	peer := packet.Sender
+	session, exists := ratchetSessions[peer]
+	if !exists {
+		sessionsLock.Unlock()
+		return fmt.Errorf("no ratchet session with %s", peer)
+	}
+
+	var msg gossip_common.RatchetMessage
+	if err := json.Unmarshal(packet.Payload, &msg); err != nil {
+		sessionsLock.Unlock()
+		return fmt.Errorf("failed to unmarshal ratchet message: %w", err)
+	}
+	plaintext, err := session.Decrypt(&msg, pairAD(peer, gossip_common.GetClientID()))
+	if err != nil {
+		sessionsLock.Unlock()
+		return err
+	}
+
+	var envelope secureEnvelope
+	if err := json.Unmarshal(plaintext, &envelope); err != nil {
+		sessionsLock.Unlock()
+		return fmt.Errorf("failed to unmarshal envelope: %w", err)
+	}
+
+	switch envelope.Type {
+	case "skd":
+		var distribution gossip_common.SenderKeyDistribution
+		if err := json.Unmarshal(envelope.Body, &distribution); err != nil {
+			sessionsLock.Unlock()
+			return fmt.Errorf("failed to unmarshal sender key: %w", err)
+		}
+		if err := storeSenderKey(peer, distribution); err != nil {
+			sessionsLock.Unlock()
+			return err
+		}
+
+		// Replay channel messages that arrived before the key
+		held := pendingChats[peer]
+		delete(pendingChats, peer)
+		sessionsLock.Unlock()
+
+		for _, chat := range held {
+			handleDataPacket(chat.packet, a)
+		}
+		return nil
+
+	case "dm":
+		sessionsLock.Unlock()
+
+		var body chatBody
+		if err := json.Unmarshal(envelope.Body, &body); err != nil {
+			return fmt.Errorf("failed to unmarshal direct message: %w", err)
+		}
+		runtime.EventsEmit(a.ctx, "direct-message-received", peer, body.UID, body.Message, packet.Expiration, packet.Timestamp)
+		return nil
+	}
+
+	sessionsLock.Unlock()
+	return nil
+}
+
+/**
+ * forgetPeer drops every session and key shared with a peer that left the server, and
+ * replaces our own sender keys so the peer cannot read channel messages sent afterwards.
+ * @param peer The client ID that left.
+ */
+func forgetPeer(peer string) {
+	sessionsLock.Lock()
+	defer sessionsLock.Unlock()
+
+	delete(ratchetSessions, peer)
+	delete(pendingHandshakes, peer)
+	delete(outboundEnvelopes, peer)
+	delete(peerSenderKeys, peer)
+	delete(pendingChats, peer)
+
+	ownSenderKeys = make(map[string]*gossip_common.SenderKey)
+	sharedSenderKeys = make(map[string]map[string]uint32)
+}
+
+/**
+ * watchPendingSessions resends handshakes that got no reply and drops what waited too long for a
+ * session or a sender key, until done is closed. Peers whose handshake failed are reported with
+ * "secure-session-failed" and the number of messages dropped, and senders whose key never came
+ * with "channel-messages-dropped".
+ * @param a The application instance.
+ * @param done Closed when the connection to the server ends.
+ */
+func watchPendingSessions(a *App, done <-chan struct{}) {
+	ticker := time.NewTicker(pendingSweepInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			sweepPendingSessions(a)
+		}
+	}
+}
+
+// sweepPendingSessions retries or gives up on stale handshakes and drops expired channel messages.
+func sweepPendingSessions(a *App) {
+	sessionsLock.Lock()
+
+	failed := make(map[string]int)
+	for peer, pending := range pendingHandshakes {
+		if time.Since(pending.sent) < handshakeTimeout {
+			continue
+		}
+		if pending.attempts < handshakeAttempts {
+			err := startHandshake(peer)
+			if err == nil {
+				continue
+			}
+			gossip_common.Err("Failed to resend handshake to %s: %v", peer, err)
+		}
+
+		// Queued sender keys were never delivered, so the next channel message sends them again
+		failed[peer] = len(outboundEnvelopes[peer])
+		delete(pendingHandshakes, peer)
+		delete(outboundEnvelopes, peer)
+		for channel := range sharedSenderKeys {
+			delete(sharedSenderKeys[channel], peer)
+		}
+	}
+
+	dropped := make(map[string]int)
+	for sender, chats := range pendingChats {
+		kept := []pendingChat{}
+		for _, chat := range chats {
+			if time.Since(chat.received) < pendingChatTimeout {
+				kept = append(kept, chat)
+			}
+		}
+		if len(kept) < len(chats) {
+			dropped[sender] = len(chats) - len(kept)
+		}
+		if len(kept) == 0 {
+			delete(pendingChats, sender)
+		} else {
+			pendingChats[sender] = kept
+		}
+	}
+
+	sessionsLock.Unlock()
+
+	for peer, count := range failed {
+		gossip_common.Err("No ratchet session with %s after %d attempts, dropped %d messages", peer, handshakeAttempts, count)
+		runtime.EventsEmit(a.ctx, "secure-session-failed", peer, count)
+	}
+	for sender, count := range dropped {
+		gossip_common.Err("Dropped %d channel messages from %s that never got a sender key", count, sender)
+		runtime.EventsEmit(a.ctx, "channel-messages-dropped", sender, count)
+	}
+}
+
+// flushOutbound sends the envelopes queued while the session was being set up. The caller must hold sessionsLock.
+func flushOutbound(peer string, session *gossip_common.RatchetSession) {
+	for _, envelope := range outboundEnvelopes[peer] {
+		if err := sendRatchetMessage(peer, session, envelope); err != nil {
+			gossip_common.Err("Failed to send queued message to %s: %v", peer, err)
+		}
+	}
+	delete(outboundEnvelopes, peer)
+}
+
+// sealHandshake signs and encrypts a handshake payload to a peer's PGP key.
+func sealHandshake(peer string, handshake ratchetHandshake) ([]byte, error) {
+	publicKey, exists := publicKeys[peer]
+	if !exists || publicKey == nil {
+		return nil, fmt.Errorf("no public key for %s", peer)
+	}
+	plaintext, err := json.Marshal(handshake)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal handshake: %w", err)
+	}
+	return gossip_common.GWEncryptSigned(plaintext, publicKey)
+}
+
+// openHandshake decrypts a handshake payload and checks it was signed by the peer.
+func openHandshake(peer string, payload []byte) (*ratchetHandshake, error) {
+	publicKey, exists := publicKeys[peer]
+	if !exists || publicKey == nil {
+		return nil, fmt.Errorf("no public key for %s", peer)
+	}
+	plaintext, err := gossip_common.GWDecryptVerified(payload, publicKey)
+	if err != nil {
+		return nil, err
+	}
+	var handshake ratchetHandshake
+	if err := json.Unmarshal(plaintext, &handshake); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal handshake: %w", err)
+	}
+	return &handshake, nil
+}
+
+// sendPairwisePacket sends a data packet addressed to a single client.
+func sendPairwisePacket(opCmd string, peer string, payload []byte) error {
+	packet := gossip_common.NewDataPacketFromData(opCmd, nil, time.Now().Unix(), 0, 1, 1, gossip_common.GetClientID(), peer, payload)
+	return sendData(packet, serverPublicKey)
+}
+
+// pairAD binds a pairwise message to its sender and recipient.
+func pairAD(from string, to string) []byte {
+	return []byte("dr:" + from + ":" + to)
+}
+
+// channelAD binds a channel message to its channel and sender.
+func channelAD(channel string, sender string) []byte {
+	return []byte("sk:" + channel + ":" + sender)
+}
@@ -2,9 +2,36 @@
 
 package main
 
+import "gossip_common"
+
 type Settings struct {
-	SelectedTheme   string `json:"selectedTheme"`
-	DefaultUsername string `json:"defaultUsername"`
-	DefaultHost     string `json:"defaultHost"`
-	DefaultPort     string `json:"defaultPort"`
+	SelectedTheme      string                    `json:"selectedTheme"`
+	DefaultUsername    string                    `json:"defaultUsername"`
+	DefaultHost        string                    `json:"defaultHost"`
+	DefaultPort        string                    `json:"defaultPort"`
+	OpusBitrate        int                       `json:"opusBitrate"`        // Opus bitrate in bits per second
+	OpusFrameSize      int                       `json:"opusFrameSize"`      // Audio frame length in milliseconds: 10, 20, 40 or 60
+	OpusFEC            bool                      `json:"opusFec"`            // Send Opus forward error correction data
+	EncryptMediaFrames bool                      `json:"encryptMediaFrames"` // Seal media track frames with the call key on top of DTLS-SRTP
+	InputMode          string                    `json:"inputMode"`          // "voice" to send only while speaking, "open" to always send, "ptt" to send while a key is held
+	VADSensitivity     int                       `json:"vadSensitivity"`     // Voice detection sensitivity from 1 to 100
+	PushToTalkKey      string                    `json:"pushToTalkKey"`      // Push-to-talk key such as "F8" or "Ctrl+Shift+T"
+	PushToTalkRelease  int                       `json:"pushToTalkRelease"`  // Milliseconds to keep sending after the push-to-talk key is released
+	HighPassFilter     bool                      `json:"highPassFilter"`     // Cut rumble below 100 Hz from the microphone
+	NoiseSuppression   bool                      `json:"noiseSuppression"`   // Remove steady background noise from the microphone
+	EchoCancellation   bool                      `json:"echoCancellation"`   // Remove the call audio the microphone picks up from the speakers
+	CaptureDevice      string                    `json:"captureDevice"`      // Microphone ID, empty for the system default
+	PlaybackDevice     string                    `json:"playbackDevice"`     // Speaker ID, empty for the system default
+	VideoCodec         string                    `json:"videoCodec"`         // Camera codec, "vp8" or "h264"
+	VideoWidth         int                       `json:"videoWidth"`         // Camera frame width in pixels
+	VideoHeight        int                       `json:"videoHeight"`        // Camera frame height in pixels
+	VideoFramerate     int                       `json:"videoFramerate"`     // Camera frames per second
+	ScreenWidth        int                       `json:"screenWidth"`        // Largest screen share frame width in pixels
+	ScreenHeight       int                       `json:"screenHeight"`       // Largest screen share frame height in pixels
+	ScreenFramerate    int                       `json:"screenFramerate"`    // Most screen share frames per second
+	ICEServers         []gossip_common.ICEServer `json:"iceServers"`         // STUN and TURN servers for calls, used before any the server pushes
+	RelayOnly          bool                      `json:"relayOnly"`          // Only connect calls through TURN relays, hiding our address from participants
+	UsePublicSTUN      bool                      `json:"usePublicStun"`      // Fall back to a public STUN server when no other ICE server is known
+	CallMode           string                    `json:"callMode"`           // "mesh" to send audio to each participant, "sfu" to send it once through the server, "auto" to switch at five participants
+	PeerGracePeriod    int                       `json:"peerGracePeriod"`    // Seconds to keep reconnecting a participant whose connection dropped before leaving them out of the call
 }
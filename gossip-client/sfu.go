@@ -0,0 +1,273 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	"gossip_common"
+
+	"github.com/wailsapp/wails/v2/pkg/runtime"
+)
+
+const (
+	callModeMesh = "mesh" // Send audio to every participant directly
+	callModeSFU  = "sfu"  // Send audio once to the server, which forwards it to the participants
+	callModeAuto = "auto" // Use the server once the call is large enough
+
+	sfuAutoParticipants = 5  // Participants, including us, from which auto mode switches to the server
+	sfuQueueLength      = 50 // Frames waiting to be sent to the server before new ones are dropped
+)
+
+// sfuFrame is one sealed audio frame and the participants it goes to.
+type sfuFrame struct {
+	payload    []byte
+	recipients []string
+}
+
+var (
+	sfuMode      = callModeMesh
+	sfuQueue     chan sfuFrame             // nil when no call is relaying audio through the server
+	relayedPeers = make(map[string]bool)   // Participants whose peer connection failed, reached through the server instead
+	relayedSent  = make(map[string]uint64) // Audio bytes sent to each participant through the server
+	relayedRecv  = make(map[string]uint64) // Audio bytes received from each participant through the server
+	sfuLock      sync.Mutex
+)
+
+/**
+ * startSFU reads the call mode from the settings and starts sending queued frames to the server.
+ */
+func startSFU() {
+	mode := callModeMesh
+	settings, err := LoadSettings()
+	if err != nil {
+		gossip_common.Err("Failed to load call mode, using mesh: %v", err)
+	}
+	switch settings.CallMode {
+	case callModeSFU, callModeAuto:
+		mode = settings.CallMode
+	}
+
+	sfuLock.Lock()
+	defer sfuLock.Unlock()
+
+	if sfuQueue != nil {
+		close(sfuQueue)
+	}
+	sfuMode = mode
+	sfuQueue = make(chan sfuFrame, sfuQueueLength)
+	go sendSFUFrames(sfuQueue)
+}
+
+// stopSFU stops sending frames to the server.
+func stopSFU() {
+	sfuLock.Lock()
+	defer sfuLock.Unlock()
+
+	if sfuQueue != nil {
+		close(sfuQueue)
+		sfuQueue = nil
+	}
+	relayedPeers = make(map[string]bool)
+	relayedSent = make(map[string]uint64)
+	relayedRecv = make(map[string]uint64)
+}
+
+/**
+ * usesSFU reports whether our audio goes through the server for a call of this size.
+ * @param peers The number of participants we are sending to.
+ * @return bool True to send audio through the server.
+ */
+func usesSFU(peers int) bool {
+	sfuLock.Lock()
+	defer sfuLock.Unlock()
+
+	if sfuQueue == nil {
+		return false
+	}
+	switch sfuMode {
+	case callModeSFU:
+		return true
+	case callModeAuto:
+		return peers+1 >= sfuAutoParticipants
+	}
+	return false
+}
+
+/**
+ * queueSFUFrame queues a sealed audio frame for the server, dropping it if the queue is full
+ * so a slow connection delays audio by at most sfuQueueLength frames.
+ * @param payload The frame sealed with our call key.
+ * @param recipients The participants the server forwards it to.
+ */
+func queueSFUFrame(payload []byte, recipients []string) {
+	sfuLock.Lock()
+	defer sfuLock.Unlock()
+
+	if sfuQueue == nil {
+		return
+	}
+	select {
+	case sfuQueue <- sfuFrame{payload: payload, recipients: recipients}:
+		for _, id := range recipients {
+			relayedSent[id] += uint64(len(payload))
+		}
+	default:
+		if debugLogging {
+			gossip_common.Dbg("Dropped audio frame, the server queue is full")
+		}
+	}
+}
+
+/**
+ * serverRecipients groups the participants whose audio goes through the server by the codec they receive.
+ * @param peers The participants.
+ * @return map[byte][]string The participants for each codec.
+ */
+func serverRecipients(peers []string) map[byte][]string {
+	recipients := make(map[byte][]string)
+	for _, id := range peers {
+		codec := sendCodec(id)
+		recipients[codec] = append(recipients[codec], id)
+	}
+	return recipients
+}
+
+/**
+ * queueServerFrames seals an encoded frame with our call key once per codec and queues it
+ * for the server to forward to the participants receiving that codec.
+ * @param frame The frame encoded with each codec.
+ * @param recipients The participants for each codec.
+ * @return error Error if a frame could not be sealed.
+ */
+func queueServerFrames(frame map[byte][]byte, recipients map[byte][]string) error {
+	for codec, ids := range recipients {
+		encoded, ok := frame[codec]
+		if !ok {
+			continue
+		}
+		encryptedSample, err := callKeys.seal(encoded)
+		if err != nil {
+			return err
+		}
+		queueSFUFrame(encryptedSample, ids)
+	}
+	return nil
+}
+
+/**
+ * relayPeer falls back to exchanging audio with a participant as stream packets through the
+ * server. Their call key already travels through the server, so only the path changes.
+ * @param a The application instance.
+ * @param id The participant we could not connect to.
+ */
+func relayPeer(a *App, id string) {
+	if !inCall {
+		return
+	}
+
+	sfuLock.Lock()
+	if sfuQueue == nil || relayedPeers[id] {
+		sfuLock.Unlock()
+		return
+	}
+	relayedPeers[id] = true
+	sfuLock.Unlock()
+
+	gossip_common.Log("Could not connect to %s directly, relaying audio through the server", id)
+	if err := SendCallKey(id); err != nil {
+		gossip_common.Err("Failed to send call key to %s: %v", id, err)
+	}
+
+	runtime.EventsEmit(a.ctx, "caller_relayed", id)
+	rosterUpdate(a, id, func(entry *RosterEntry) {
+		entry.Connected = true
+		entry.Relayed = true
+	})
+}
+
+// stopRelayingPeer stops relaying a participant's audio, reporting whether it was relayed.
+func stopRelayingPeer(id string) bool {
+	sfuLock.Lock()
+	defer sfuLock.Unlock()
+
+	relayed := relayedPeers[id]
+	delete(relayedPeers, id)
+	return relayed
+}
+
+// isRelayedPeer reports whether a participant's audio goes through the server because their connection failed.
+func isRelayedPeer(id string) bool {
+	sfuLock.Lock()
+	defer sfuLock.Unlock()
+
+	return relayedPeers[id]
+}
+
+// relayedBytes returns the audio bytes exchanged with a participant through the server.
+func relayedBytes(id string) (sent uint64, received uint64) {
+	sfuLock.Lock()
+	defer sfuLock.Unlock()
+
+	return relayedSent[id], relayedRecv[id]
+}
+
+/**
+ * relayedPeerIDs returns the participants reached through the server that we have a public key for.
+ * @param exclude Participants to leave out, such as those already reached directly.
+ * @return []string The participants.
+ */
+func relayedPeerIDs(exclude []string) []string {
+	sfuLock.Lock()
+	defer sfuLock.Unlock()
+
+	skip := make(map[string]bool)
+	for _, id := range exclude {
+		skip[id] = true
+	}
+	peers := []string{}
+	for id := range relayedPeers {
+		if publicKey, exists := publicKeys[id]; skip[id] || !exists || publicKey == nil {
+			continue
+		}
+		peers = append(peers, id)
+	}
+	return peers
+}
+
+/**
+ * sendSFUFrames sends queued frames to the server as stream packets until the queue is closed.
+ * The server only sees the call and the recipients; the frames stay sealed with our call key.
+ * @param queue The frames to send.
+ */
+func sendSFUFrames(queue chan sfuFrame) {
+	for frame := range queue {
+		if streamCipher == nil {
+			gossip_common.Err("Dropped audio frame, no session key was agreed with the server")
+			continue
+		}
+		packet := gossip_common.NewStreamPacketFromData("audio", nil, time.Now().Unix(), 0, 1, 1, gossip_common.GetClientID(), callID, frame.payload, frame.recipients)
+
+		if err := sendStream(packet, streamCipher); err != nil {
+			gossip_common.Err("Failed to send audio to the server: %v", err)
+		}
+	}
+}
+
+/**
+ * handleStreamPacket plays a frame the server forwarded from another participant.
+ * @param packet The stream packet.
+ * @param a The application instance.
+ */
+func handleStreamPacket(packet gossip_common.GMStreamPacket, a *App) {
+	if !inCall || packet.Destination != callID {
+		return
+	}
+
+	switch packet.OpCmd {
+	case "audio":
+		sfuLock.Lock()
+		relayedRecv[packet.Sender] += uint64(len(packet.Payload))
+		sfuLock.Unlock()
+		playParticipantAudio(a, packet.Sender, packet.Payload)
+	}
+}
@@ -0,0 +1,387 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"gossip_common"
+
+	"github.com/pion/interceptor"
+	"github.com/pion/interceptor/pkg/stats"
+	"github.com/pion/webrtc/v4"
+	"github.com/wailsapp/wails/v2/pkg/runtime"
+)
+
+const callStatsInterval = 2 * time.Second // How often call-stats is emitted during a call
+
+// CallStats describes the connection to one participant.
+type CallStats struct {
+	ID             string  `json:"id"`
+	RoundTripTime  float64 `json:"roundTripTime"`  // Milliseconds over the direct connection, 0 until measured
+	PacketLoss     float64 `json:"packetLoss"`     // Percentage of their audio packets lost since the last report
+	Jitter         float64 `json:"jitter"`         // Interarrival jitter of their audio in milliseconds
+	SendBitrate    float64 `json:"sendBitrate"`    // Bits per second of audio sent to them since the last report
+	ReceiveBitrate float64 `json:"receiveBitrate"` // Bits per second of audio received from them since the last report
+	BufferDepth    float64 `json:"bufferDepth"`    // Milliseconds of their audio waiting in the jitter buffer
+	CandidateType  string  `json:"candidateType"`  // Our side of the candidate pair in use: host, srflx, prflx or relay, or "server" while relayed
+	Codec          string  `json:"codec"`          // Audio codec we send them
+}
+
+// linkStats is what pion reports about the audio sent over a peer connection.
+type linkStats struct {
+	candidateType string
+	roundTrip     float64 // Milliseconds measured by ICE on the nominated candidate pair, 0 until measured
+	sent          uint64  // Audio bytes sent over the data channel and the Opus track
+	received      uint64  // Audio bytes received over the data channel and the Opus track
+	packets       uint64  // Opus track packets expected from them
+	lost          uint64  // Opus track packets lost
+}
+
+// statsSample holds the counters of the previous report, to turn totals into rates.
+type statsSample struct {
+	at         time.Time
+	sent       uint64
+	received   uint64
+	packets    uint64
+	packetLost uint64
+	frames     uint64
+	lost       uint64
+}
+
+var (
+	roundTrips   = make(map[string]float64)      // Latest ping round trip time to each participant in milliseconds
+	rtpStats     = make(map[string]stats.Getter) // RTP stream statistics of each participant's peer connection
+	statsSamples = make(map[string]statsSample)
+	statsStop    chan struct{}
+	statsLock    sync.Mutex
+)
+
+/**
+ * newPeerConnection creates a participant's peer connection with pion's default codecs and
+ * interceptors plus the stats interceptor, which counts the packets and bytes of each RTP
+ * stream that GetStats does not report.
+ * @param id The participant.
+ * @param config The peer connection configuration.
+ * @return *webrtc.PeerConnection The peer connection.
+ * @return error Error if it could not be created.
+ */
+func newPeerConnection(id string, config webrtc.Configuration) (*webrtc.PeerConnection, error) {
+	mediaEngine := &webrtc.MediaEngine{}
+	if err := mediaEngine.RegisterDefaultCodecs(); err != nil {
+		return nil, err
+	}
+	registry := &interceptor.Registry{}
+	if err := webrtc.RegisterDefaultInterceptors(mediaEngine, registry); err != nil {
+		return nil, err
+	}
+	statsInterceptor, err := stats.NewInterceptor()
+	if err != nil {
+		return nil, err
+	}
+	// The callback runs while the peer connection is built, so the getter is set once NewPeerConnection returns
+	var getter stats.Getter
+	statsInterceptor.OnNewPeerConnection(func(_ string, g stats.Getter) { getter = g })
+	registry.Add(statsInterceptor)
+
+	api := webrtc.NewAPI(webrtc.WithMediaEngine(mediaEngine), webrtc.WithInterceptorRegistry(registry))
+	pc, err := api.NewPeerConnection(config)
+	if err != nil {
+		return nil, err
+	}
+
+	statsLock.Lock()
+	if getter != nil {
+		rtpStats[id] = getter
+	} else {
+		delete(rtpStats, id)
+	}
+	statsLock.Unlock()
+	return pc, nil
+}
+
+// forgetCallStats drops the statistics of a participant whose peer connection is closed.
+func forgetCallStats(id string) {
+	statsLock.Lock()
+	defer statsLock.Unlock()
+
+	delete(roundTrips, id)
+	delete(rtpStats, id)
+	delete(statsSamples, id)
+}
+
+/**
+ * sendPing sends a participant the current time as a text message over their data channel;
+ * they echo it back so we can measure the round trip. Audio frames are always binary.
+ * @param dc The participant's data channel.
+ */
+func sendPing(dc *webrtc.DataChannel) {
+	if dc.ReadyState() != webrtc.DataChannelStateOpen {
+		return
+	}
+	if err := dc.SendText("ping " + strconv.FormatInt(time.Now().UnixNano(), 10)); err != nil && debugLogging {
+		gossip_common.Dbg("Failed to send ping: %v", err)
+	}
+}
+
+/**
+ * handleLinkMessage answers a participant's ping, or records the round trip time from their
+ * answer to ours.
+ * @param id The participant.
+ * @param dc Their data channel.
+ * @param message The text message.
+ */
+func handleLinkMessage(id string, dc *webrtc.DataChannel, message string) {
+	kind, sent, found := strings.Cut(message, " ")
+	if !found {
+		return
+	}
+
+	switch kind {
+	case "ping":
+		if err := dc.SendText("pong " + sent); err != nil && debugLogging {
+			gossip_common.Dbg("Failed to answer ping from %s: %v", id, err)
+		}
+	case "pong":
+		nanos, err := strconv.ParseInt(sent, 10, 64)
+		if err != nil {
+			return
+		}
+		statsLock.Lock()
+		roundTrips[id] = float64(time.Now().UnixNano()-nanos) / float64(time.Millisecond)
+		statsLock.Unlock()
+	}
+}
+
+// peerRoundTrip returns the latest ping round trip time to a participant in milliseconds, 0 until measured.
+func peerRoundTrip(id string) float64 {
+	statsLock.Lock()
+	defer statsLock.Unlock()
+
+	return roundTrips[id]
+}
+
+/**
+ * linkRoundTrip returns the round trip time to a participant in milliseconds, as measured by
+ * ICE on the nominated candidate pair, or by our pings while ICE has not measured it.
+ * @param id The participant.
+ * @param pc Their peer connection.
+ * @return float64 The round trip time, 0 until measured.
+ */
+func linkRoundTrip(id string, pc *webrtc.PeerConnection) float64 {
+	if roundTrip := peerConnectionStats(id, pc).roundTrip; roundTrip > 0 {
+		return roundTrip
+	}
+	return peerRoundTrip(id)
+}
+
+/**
+ * peerConnectionStats reads the nominated candidate pair and the audio sent and received over
+ * a peer connection: the data channel from pion's statistics and the Opus track from the stats
+ * interceptor. Video and ICE traffic are left out.
+ * @param id The participant.
+ * @param pc Their peer connection.
+ * @return linkStats The statistics, zero where not yet known.
+ */
+func peerConnectionStats(id string, pc *webrtc.PeerConnection) linkStats {
+	var link linkStats
+	report := pc.GetStats()
+
+	localCandidate := ""
+	for _, stat := range report {
+		switch s := stat.(type) {
+		case webrtc.ICECandidatePairStats:
+			if s.Nominated && s.State == webrtc.StatsICECandidatePairStateSucceeded {
+				localCandidate = s.LocalCandidateID
+				link.roundTrip = s.CurrentRoundTripTime * 1000
+			}
+		case webrtc.DataChannelStats:
+			link.sent += s.BytesSent
+			link.received += s.BytesReceived
+		}
+	}
+
+	if candidate, ok := report[localCandidate].(webrtc.ICECandidateStats); ok {
+		link.candidateType = candidate.CandidateType.String()
+	}
+
+	statsLock.Lock()
+	getter := rtpStats[id]
+	statsLock.Unlock()
+	if getter == nil {
+		return link
+	}
+
+	for _, transceiver := range pc.GetTransceivers() {
+		if transceiver.Kind() != webrtc.RTPCodecTypeAudio {
+			continue
+		}
+		if sender := transceiver.Sender(); sender != nil && sender.Track() != nil {
+			for _, encoding := range sender.GetParameters().Encodings {
+				if s := getter.Get(uint32(encoding.SSRC)); s != nil {
+					link.sent += s.OutboundRTPStreamStats.BytesSent
+				}
+			}
+		}
+		if receiver := transceiver.Receiver(); receiver != nil {
+			for _, track := range receiver.Tracks() {
+				if s := getter.Get(uint32(track.SSRC())); s != nil {
+					inbound := s.InboundRTPStreamStats
+					lost := uint64(0)
+					if inbound.PacketsLost > 0 {
+						lost = uint64(inbound.PacketsLost)
+					}
+					link.received += inbound.BytesReceived
+					link.packets += inbound.PacketsReceived + lost
+					link.lost += lost
+				}
+			}
+		}
+	}
+	return link
+}
+
+// counterDelta returns how much a counter grew, treating a reset counter as having started over.
+func counterDelta(current, previous uint64) uint64 {
+	if current < previous {
+		return current
+	}
+	return current - previous
+}
+
+/**
+ * collectCallStats gathers the statistics of every participant we are connected to, directly
+ * or through the server. Rates cover the time since the previous collection.
+ * @return []CallStats One entry per participant.
+ */
+func collectCallStats() []CallStats {
+	recoveryLock.Lock()
+	peers := make(map[string]*webrtc.PeerConnection, len(watchedPeers))
+	for id, pc := range watchedPeers {
+		peers[id] = pc
+	}
+	recoveryLock.Unlock()
+	for _, id := range relayedPeerIDs(nil) {
+		if _, exists := peers[id]; !exists {
+			peers[id] = nil
+		}
+	}
+
+	playback := make(map[string]PlaybackStats)
+	if mixer := currentMixer(); mixer != nil {
+		for _, entry := range mixer.Stats() {
+			playback[entry.ID] = entry
+		}
+	}
+
+	now := time.Now()
+	stats := []CallStats{}
+	samples := make(map[string]statsSample, len(peers))
+	for id, pc := range peers {
+		entry := CallStats{ID: id, Codec: codecName(sendCodec(id))}
+		sample := statsSample{at: now}
+
+		if pc != nil {
+			link := peerConnectionStats(id, pc)
+			entry.RoundTripTime = link.roundTrip
+			if entry.RoundTripTime == 0 {
+				entry.RoundTripTime = peerRoundTrip(id)
+			}
+			entry.CandidateType = link.candidateType
+			sample.sent, sample.received = link.sent, link.received
+			sample.packets, sample.packetLost = link.packets, link.lost
+		}
+		relayedSent, relayedReceived := relayedBytes(id)
+		sample.sent += relayedSent
+		sample.received += relayedReceived
+		if isRelayedPeer(id) {
+			entry.CandidateType = "server"
+		}
+
+		if buffer, ok := playback[id]; ok {
+			entry.Jitter = buffer.Jitter
+			entry.BufferDepth = buffer.Depth
+			sample.frames = buffer.Received + buffer.Lost + buffer.Late
+			sample.lost = buffer.Lost + buffer.Late
+		}
+
+		statsLock.Lock()
+		previous, ok := statsSamples[id]
+		statsLock.Unlock()
+		if elapsed := now.Sub(previous.at).Seconds(); ok && elapsed > 0 {
+			entry.SendBitrate = float64(counterDelta(sample.sent, previous.sent)) * 8 / elapsed
+			entry.ReceiveBitrate = float64(counterDelta(sample.received, previous.received)) * 8 / elapsed
+			// Audio on the Opus track has RTP loss counts; data channel and relayed audio only have the jitter buffer's
+			if packets := counterDelta(sample.packets, previous.packets); packets > 0 {
+				entry.PacketLoss = float64(counterDelta(sample.packetLost, previous.packetLost)) * 100 / float64(packets)
+			} else if frames := counterDelta(sample.frames, previous.frames); frames > 0 {
+				entry.PacketLoss = float64(counterDelta(sample.lost, previous.lost)) * 100 / float64(frames)
+			}
+		}
+
+		samples[id] = sample
+		stats = append(stats, entry)
+	}
+
+	statsLock.Lock()
+	statsSamples = samples
+	statsLock.Unlock()
+	return stats
+}
+
+/**
+ * startCallStats pings every participant and emits call-stats with the statistics of
+ * every participant every callStatsInterval until the call ends.
+ * @param a The application instance.
+ */
+func startCallStats(a *App) {
+	statsLock.Lock()
+	defer statsLock.Unlock()
+
+	if statsStop != nil {
+		close(statsStop)
+	}
+	stop := make(chan struct{})
+	statsStop = stop
+	statsSamples = make(map[string]statsSample)
+	roundTrips = make(map[string]float64)
+
+	go func() {
+		ticker := time.NewTicker(callStatsInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+				for _, dc := range dataChannels() {
+					sendPing(dc)
+				}
+				if stats := collectCallStats(); len(stats) > 0 {
+					runtime.EventsEmit(a.ctx, "call-stats", stats)
+				}
+			}
+		}
+	}()
+}
+
+// stopCallStats stops emitting call statistics.
+func stopCallStats() {
+	statsLock.Lock()
+	defer statsLock.Unlock()
+
+	if statsStop != nil {
+		close(statsStop)
+		statsStop = nil
+	}
+}
+
+/**
+ * GetCallStats returns round trip time, packet loss, jitter, bitrates, buffer depth, candidate type and codec for every participant
+ * @return []CallStats One entry per participant
+ */
+func (a *App) GetCallStats() []CallStats {
+	return collectCallStats()
+}
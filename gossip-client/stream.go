@@ -1,9 +1,10 @@
 package main
 
 import (
-	"bufio"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"sync"
 
 	"gossip_common"
 
@@ -13,6 +14,12 @@ import (
 
 var participentPeerConnections = make(map[string]*webrtc.PeerConnection)
 var participentDataChannels = make(map[string]*webrtc.DataChannel)
+var participentLock sync.RWMutex // Guards both maps, shared by signaling, audio, recovery and statistics goroutines
+
+var (
+	dataChannelOrdered     = false
+	dataChannelRetransmits = uint16(0)
+)
 
 func GetParticipentsFromServer(callID string, a *App) { // only called by the joiner
 	runtime.EventsEmit(a.ctx, "call_starting")
@@ -21,7 +28,7 @@ func GetParticipentsFromServer(callID string, a *App) { // only called by the jo
 	getParticipentsPacket := gossip_common.NewSignalPacketFromData("gmp", "", gossip_common.GetClientID(), []byte(callID))
 
 	// Send the start call packet
-	err := gossip_common.SendSignalPacket(writer, getParticipentsPacket)
+	err := sendSignal(getParticipentsPacket)
 	if err != nil {
 		gossip_common.Err("Failed to send start call packet: %v", err)
 		return
@@ -36,98 +43,114 @@ func GetParticipentsFromServer(callID string, a *App) { // only called by the jo
  * SendOfferToClient initializes a WebRTC offer and sends it to the signaling server.
  * @return error Potential error during the offer creation or sending process.
  */
-func SendOfferToClient(destination string, a *App, bufferWriter *bufio.Writer) error {
+func SendOfferToClient(destination string, a *App) error {
 	// Create a new PeerConnection
-	var err error
-	participentPeerConnections[destination], err = webrtc.NewPeerConnection(webrtc.Configuration{
-		ICEServers: []webrtc.ICEServer{
-			{
-				URLs: []string{"stun:stun.l.google.com:19302"},
-			},
-		},
-	})
+	config, err := peerConnectionConfig()
+	if err != nil {
+		return fmt.Errorf("failed to configure peer connection: %w", err)
+	}
+	pc, err := newPeerConnection(destination, config)
 	if err != nil {
 		return fmt.Errorf("failed to create peer connection: %w", err)
 	}
+	setPeerConnection(destination, pc)
 
-	// Create a data channel
-	participentDataChannels[destination], err = participentPeerConnections[destination].CreateDataChannel("data", nil)
+	// Offer an audio section for our Opus track, attached once the answer shows they receive Opus, and offer our camera and screen share tracks
+	if err := offerAudioTrack(pc); err != nil {
+		return err
+	}
+	if err := addVideoTrack(a, pc); err != nil {
+		return err
+	}
+	if err := addScreenTrack(a, pc); err != nil {
+		return err
+	}
+	pc.OnTrack(func(track *webrtc.TrackRemote, receiver *webrtc.RTPReceiver) {
+		handleRemoteTrack(a, destination, track, pc)
+	})
+	watchPeerConnection(a, destination, pc)
+
+	// Create an unordered, unreliable data channel so a lost PCM frame never stalls the ones after it
+	dc, err := pc.CreateDataChannel("data", &webrtc.DataChannelInit{
+		Ordered:        &dataChannelOrdered,
+		MaxRetransmits: &dataChannelRetransmits,
+	})
 	if err != nil {
 		return fmt.Errorf("failed to create data channel: %w", err)
 	}
+	setDataChannel(destination, dc)
 
-	participentDataChannels[destination].OnOpen(func() {
+	dc.OnOpen(func() {
 		if debugLogging {
 			gossip_common.Dbg("Data channel opened")
 		}
 		gossip_common.Log("You are successfully connected to %s!", destination)
 
+		if err := SendCallKey(destination); err != nil {
+			gossip_common.Err("Failed to send call key to %s: %v", destination, err)
+		}
+
 		runtime.EventsEmit(a.ctx, "call_started")
 		runtime.EventsEmit(a.ctx, "caller_self_active")
 		runtime.EventsEmit(a.ctx, "caller_active", destination)
+		rosterUpdate(a, destination, func(entry *RosterEntry) { entry.Connected = true })
 
 	})
 
-	participentDataChannels[destination].OnClose(func() {
+	dc.OnClose(func() {
 		if debugLogging {
 			gossip_common.Dbg("Data channel closed")
 		}
+		if isRelayedPeer(destination) {
+			// The connection failed but the participant is still in the call, reached through the server
+			return
+		}
+		participantLeft(destination)
+		rosterUpdate(a, destination, func(entry *RosterEntry) { entry.Connected = false })
 		runtime.EventsEmit(a.ctx, "caller_hung_up", destination)
 	})
 
-	participentDataChannels[destination].OnMessage(func(msg webrtc.DataChannelMessage) {
-
-		if player, exists := playbackDevices[destination]; exists {
-			player.AddToBuffer(msg.Data)
-		} else {
-			// Create a new player for the destination if it does not exist
-			newPlayer := NewPlayer()
-			if err := newPlayer.initDevice(make([][]byte, 0)); err != nil {
-				return
-			}
-			if err := newPlayer.Start(); err != nil {
-				gossip_common.Err("Failed to start new player for %s: %v", destination, err)
-			} else {
-				playbackDevices[destination] = newPlayer
-				playbackDevices[destination].AddToBuffer(msg.Data)
-			}
+	dc.OnMessage(func(msg webrtc.DataChannelMessage) {
+		if msg.IsString {
+			handleLinkMessage(destination, dc, string(msg.Data))
+			return
 		}
-
+		playParticipantAudio(a, destination, msg.Data)
 	})
 
-	participentPeerConnections[destination].OnICECandidate(func(c *webrtc.ICECandidate) {
+	pc.OnICECandidate(func(c *webrtc.ICECandidate) {
 		if c == nil {
 			// ICE gathering is finished
 			return
 		}
 
 		candidate := c.ToJSON()
-		err := SendICECandidate(destination, candidate, bufferWriter)
+		err := SendICECandidate(destination, candidate)
 		if err != nil {
 			fmt.Printf("Failed to send ICE candidate: %v\n", err)
 		}
 	})
 
 	// Create an offer
-	offer, err := participentPeerConnections[destination].CreateOffer(nil)
+	offer, err := pc.CreateOffer(nil)
 	if err != nil {
 		return fmt.Errorf("failed to create offer: %w", err)
 	}
 
 	// Set the local description
-	err = participentPeerConnections[destination].SetLocalDescription(offer)
+	err = pc.SetLocalDescription(offer)
 	if err != nil {
 		return fmt.Errorf("failed to set local description: %w", err)
 	}
 
-	// Send the offer to the signaling server
-	offerPayload, err := json.Marshal(offer)
+	// Send the offer to the signaling server along with the codecs we support
+	offerPayload, err := json.Marshal(newCallDescription(offer))
 	if err != nil {
 		return fmt.Errorf("failed to marshal offer: %w", err)
 	}
 
 	offerPacket := gossip_common.NewSignalPacketFromData("offer", destination, gossip_common.GetClientID(), offerPayload)
-	err = gossip_common.SendSignalPacket(bufferWriter, offerPacket)
+	err = sendSignal(offerPacket)
 	if err != nil {
 		gossip_common.Err("Failed to send offer packet: %v", err)
 		return fmt.Errorf("failed to send offer packet: %w", err)
@@ -146,108 +169,135 @@ func SendOfferToClient(destination string, a *App, bufferWriter *bufio.Writer) e
  * @param offer The received offer to handle.
  * @return error Potential error during the answer creation or sending process.
  */
-func HandleOffer(sender string, offerBlob []byte, bufferWriter *bufio.Writer, a *App) error {
+func HandleOffer(sender string, offerBlob []byte, a *App) error {
 
-	var offer webrtc.SessionDescription
+	var offer callDescription
 	err := json.Unmarshal(offerBlob, &offer)
 	if err != nil {
 		return fmt.Errorf("failed to unmarshal offer: %v", err)
 	}
+	negotiateMedia(sender, offer)
 
-	if participentPeerConnections[sender] == nil {
-		var err error
-		participentPeerConnections[sender], err = webrtc.NewPeerConnection(webrtc.Configuration{
-			ICEServers: []webrtc.ICEServer{
-				{
-					URLs: []string{"stun:stun.l.google.com:19302"},
-				},
-			},
-		})
+	pc := peerConnection(sender)
+	newConnection := pc == nil
+	if newConnection {
+		config, err := peerConnectionConfig()
+		if err != nil {
+			return fmt.Errorf("failed to configure peer connection: %w", err)
+		}
+		pc, err = newPeerConnection(sender, config)
 		if err != nil {
 			return fmt.Errorf("failed to create peer connection: %w", err)
 		}
+		setPeerConnection(sender, pc)
+		watchPeerConnection(a, sender, pc)
 
-		participentPeerConnections[sender].OnDataChannel(func(d *webrtc.DataChannel) {
-			participentDataChannels[sender] = d
+		pc.OnDataChannel(func(d *webrtc.DataChannel) {
+			setDataChannel(sender, d)
 			d.OnOpen(func() {
 				if debugLogging {
 					gossip_common.Dbg("Data channel opened")
 				}
 				gossip_common.Log("You are successfully connected to %s!", sender)
 
+				if err := SendCallKey(sender); err != nil {
+					gossip_common.Err("Failed to send call key to %s: %v", sender, err)
+				}
+
 				runtime.EventsEmit(a.ctx, "call_started")
 				runtime.EventsEmit(a.ctx, "caller_self_active")
 				runtime.EventsEmit(a.ctx, "caller_active", sender)
+				rosterUpdate(a, sender, func(entry *RosterEntry) { entry.Connected = true })
 			})
 
 			d.OnClose(func() {
 				if debugLogging {
 					gossip_common.Dbg("Data channel closed")
 				}
+				if isRelayedPeer(sender) {
+					// The connection failed but the participant is still in the call, reached through the server
+					return
+				}
+				participantLeft(sender)
+				rosterUpdate(a, sender, func(entry *RosterEntry) { entry.Connected = false })
 				runtime.EventsEmit(a.ctx, "caller_hung_up", sender)
 			})
 
 			d.OnMessage(func(msg webrtc.DataChannelMessage) {
-				// Process the received message
-				// Process the received message
-				if player, exists := playbackDevices[sender]; exists {
-					player.AddToBuffer(msg.Data)
-				} else {
-					// Create a new player for the destination if it does not exist
-					newPlayer := NewPlayer()
-					if err := newPlayer.initDevice(make([][]byte, 0)); err != nil {
-						return
-					}
-					if err := newPlayer.Start(); err != nil {
-						gossip_common.Err("Failed to start new player for %s: %v", sender, err)
-					} else {
-						playbackDevices[sender] = newPlayer
-						playbackDevices[sender].AddToBuffer(msg.Data)
-					}
+				if msg.IsString {
+					handleLinkMessage(sender, d, string(msg.Data))
+					return
 				}
+				playParticipantAudio(a, sender, msg.Data)
 			})
 		})
+
+		pc.OnTrack(func(track *webrtc.TrackRemote, receiver *webrtc.RTPReceiver) {
+			handleRemoteTrack(a, sender, track, pc)
+		})
 	}
 
 	// Set the remote description
-	err = participentPeerConnections[sender].SetRemoteDescription(offer)
+	err = pc.SetRemoteDescription(offer.SessionDescription)
 	if err != nil {
 		return fmt.Errorf("failed to set remote description: %w", err)
 	}
 
-	participentPeerConnections[sender].OnICECandidate(func(c *webrtc.ICECandidate) {
+	// Answer the offered audio track with ours when both sides speak Opus
+	if newConnection && usesAudioTrack(sender) {
+		if err := addAudioTrack(pc); err != nil {
+			return err
+		}
+	}
+
+	// Answer the offered video sections with our camera and screen share tracks
+	if newConnection {
+		videoTracks := offeredVideoTracks(pc)
+		if videoTracks > 0 {
+			if err := addVideoTrack(a, pc); err != nil {
+				return err
+			}
+		}
+		if videoTracks > 1 {
+			if err := addScreenTrack(a, pc); err != nil {
+				return err
+			}
+		}
+	}
+
+	pc.OnICECandidate(func(c *webrtc.ICECandidate) {
 		if c == nil {
 			// ICE gathering is finished
 			return
 		}
 
 		candidate := c.ToJSON()
-		err := SendICECandidate(sender, candidate, bufferWriter)
+		err := SendICECandidate(sender, candidate)
 		if err != nil {
 			fmt.Printf("Failed to send ICE candidate: %v\n", err)
 		}
 	})
 
 	// Create an answer
-	answer, err := participentPeerConnections[sender].CreateAnswer(nil)
+	answer, err := pc.CreateAnswer(nil)
 	if err != nil {
 		return fmt.Errorf("failed to create answer: %w", err)
 	}
 
 	// Set the local description
-	err = participentPeerConnections[sender].SetLocalDescription(answer)
+	err = pc.SetLocalDescription(answer)
 	if err != nil {
 		return fmt.Errorf("failed to set local description: %w", err)
 	}
 
 	// Send the answer to the signaling server
-	answerPayload, err := json.Marshal(answer)
+	answerPayload, err := json.Marshal(newCallDescription(answer))
 	if err != nil {
 		return fmt.Errorf("failed to marshal answer: %w", err)
 	}
 
 	answerPacket := gossip_common.NewSignalPacketFromData("answer", sender, gossip_common.GetClientID(), answerPayload)
-	err = gossip_common.SendSignalPacket(bufferWriter, answerPacket)
+	err = sendSignal(answerPacket)
 	if err != nil {
 		gossip_common.Err("Failed to send answer packet: %v", err)
 		return fmt.Errorf("failed to send answer packet: %w", err)
@@ -266,14 +316,14 @@ func HandleOffer(sender string, offerBlob []byte, bufferWriter *bufio.Writer, a
  * @param candidate The ICE candidate to send.
  * @return error Potential error during the ICE candidate sending process.
  */
-func SendICECandidate(destination string, candidate webrtc.ICECandidateInit, bufferWriter *bufio.Writer) error {
+func SendICECandidate(destination string, candidate webrtc.ICECandidateInit) error {
 	candidatePayload, err := json.Marshal(candidate)
 	if err != nil {
 		return fmt.Errorf("failed to marshal ICE candidate: %w", err)
 	}
 
 	icePacket := gossip_common.NewSignalPacketFromData("ice", destination, gossip_common.GetClientID(), candidatePayload)
-	err = gossip_common.SendSignalPacket(bufferWriter, icePacket)
+	err = sendSignal(icePacket)
 	if err != nil {
 		gossip_common.Err("Failed to send ice packet: %v", err)
 		return fmt.Errorf("failed to send ice packet: %w", err)
@@ -300,8 +350,8 @@ func HandleICECandidate(destination string, candidateBlob []byte) error {
 	}
 
 	// Check if the PeerConnection for the destination exists and is not nil
-	pc, exists := participentPeerConnections[destination]
-	if !exists || pc == nil {
+	pc := peerConnection(destination)
+	if pc == nil {
 		gossip_common.Err("peer connection does not exist or is nil for destination: %s", destination)
 		return fmt.Errorf("peer connection does not exist or is nil for destination: %s", destination)
 	}
@@ -325,17 +375,57 @@ func HandleICECandidate(destination string, candidateBlob []byte) error {
  * @return error Potential error during the remote description setting process.
  */
 func HandleAnswer(sender string, answerBlob []byte) error {
-	var answer webrtc.SessionDescription
+	var answer callDescription
 	err := json.Unmarshal(answerBlob, &answer)
 	if err != nil {
 		return fmt.Errorf("failed to unmarshal answer: %v", err)
 	}
+	negotiateMedia(sender, answer)
+
+	pc := peerConnection(sender)
+	if pc == nil {
+		return fmt.Errorf("no peer connection for %s", sender)
+	}
 
 	// Set the remote description with the received answer
-	err = participentPeerConnections[sender].SetRemoteDescription(answer)
+	err = pc.SetRemoteDescription(answer.SessionDescription)
 	if err != nil {
 		return fmt.Errorf("failed to set remote description: %v", err)
 	}
+
+	// Send our audio on the media track only if they answered with Opus
+	return bindAudioTrack(sender, pc)
+}
+
+/**
+ * sendOffer sends a participant a new offer on an established peer connection, used to restart
+ * ICE or to negotiate tracks added mid-call. They answer through HandleOffer.
+ * @param id The participant.
+ * @param pc Their peer connection.
+ * @param options The offer options, nil for a plain renegotiation.
+ * @return error Error if an earlier offer is still unanswered or the offer could not be sent.
+ */
+func sendOffer(id string, pc *webrtc.PeerConnection, options *webrtc.OfferOptions) error {
+	if pc.SignalingState() != webrtc.SignalingStateStable {
+		return errors.New("an earlier offer is still waiting for its answer")
+	}
+
+	offer, err := pc.CreateOffer(options)
+	if err != nil {
+		return fmt.Errorf("failed to create offer: %w", err)
+	}
+	if err := pc.SetLocalDescription(offer); err != nil {
+		return fmt.Errorf("failed to set local description: %w", err)
+	}
+
+	offerPayload, err := json.Marshal(newCallDescription(offer))
+	if err != nil {
+		return fmt.Errorf("failed to marshal offer: %w", err)
+	}
+	offerPacket := gossip_common.NewSignalPacketFromData("offer", id, gossip_common.GetClientID(), offerPayload)
+	if err := sendSignal(offerPacket); err != nil {
+		return fmt.Errorf("failed to send offer packet: %w", err)
+	}
 	return nil
 }
 
@@ -347,7 +437,7 @@ func HangUp(a *App) {
 	hangupPacket := gossip_common.NewSignalPacketFromData("hang-up", "", gossip_common.GetClientID(), []byte(callID))
 
 	// Send the start call packet
-	err := gossip_common.SendSignalPacket(writer, hangupPacket)
+	err := sendSignal(hangupPacket)
 	if err != nil {
 		gossip_common.Err("Failed to send hangup packet: %v", err)
 		return
@@ -358,59 +448,277 @@ func HangUp(a *App) {
 	}
 
 	// Stop all active peer connections, dispose of them, and close associated data channels
-	for sender, pc := range participentPeerConnections {
-		// Close and remove associated data channels
-		if dc, exists := participentDataChannels[sender]; exists && dc != nil {
-			dc.Close()
-			delete(participentDataChannels, sender)
+	closeAllPeers()
+}
+
+/**
+ * SendAudioToChannels encodes captured audio into frames and sends them to every participant.
+ * Opus frames go out once on the shared media track; participants without the track get frames
+ * in their negotiated codec sealed with our call key over their data channel.
+ * @param pSample The raw audio sample to send.
+ */
+func SendAudioToChannels(pSample []byte) {
+	if callKeys.needsRekey() {
+		go rekeyCall()
+	}
+
+	// Check if the public key exists for every participant we are about to send to
+	peers := []string{}
+	channels := dataChannels()
+	for id, dc := range channels {
+		if dc.ReadyState() != webrtc.DataChannelStateOpen || isRelayedPeer(id) {
+			continue
+		}
+		if publicKey, exists := publicKeys[id]; !exists || publicKey == nil {
+			// Close the data channel if no public key is found
+			if removeDataChannel(id, dc) {
+				dc.Close()
+			}
 			if debugLogging {
-				gossip_common.Dbg("Closed data channel for %s", sender)
+				gossip_common.Dbg("Closed data channel for %s due to missing public key", id)
 			}
+			continue
 		}
-		if pc != nil {
-			// Close the peer connection
-			err := pc.Close()
-			if err != nil {
-				gossip_common.Err("Failed to close peer connection for %s: %v", sender, err)
-			} else {
-				if debugLogging {
-					gossip_common.Dbg("Closed peer connection for %s", sender)
-				}
-			}
+		peers = append(peers, id)
+	}
+
+	// Participants we cannot reach directly get our audio through the server, as does everyone in SFU mode
+	serverPeers := relayedPeerIDs(peers)
+	if usesSFU(len(peers) + len(serverPeers)) {
+		serverPeers = append(serverPeers, peers...)
+		peers = nil
+	}
+	recipients := serverRecipients(serverPeers)
+
+	// Participants without the media track get frames in their negotiated codec over their data channel
+	trackPeers, channelPeers := 0, make(map[byte][]string)
+	for _, id := range peers {
+		if usesAudioTrack(id) {
+			trackPeers++
+		} else {
+			codec := sendCodec(id)
+			channelPeers[codec] = append(channelPeers[codec], id)
 		}
-		// Remove the peer connection from the map
-		delete(participentPeerConnections, sender)
 	}
-}
 
-func SendAudioToChannels(pSample []byte) {
-	// Iterate over all participant data channels
-	for id, dc := range participentDataChannels {
-		if dc.ReadyState() == webrtc.DataChannelStateOpen {
+	for _, frame := range encodeCapturedAudio(pSample, append(serverPeers, peers...)) {
+		if encoded, ok := frame[codecOpus]; ok && trackPeers > 0 {
+			if err := writeAudioTrack(encoded[audioFrameHeader:]); err != nil {
+				gossip_common.Err("Failed to write audio track: %v", err)
+			}
+		}
 
-			// Check if the public key exists for the participant
-			if publicKey, exists := publicKeys[id]; !exists || publicKey == nil {
-				// Close the data channel if no public key is found
-				dc.Close()
-				delete(participentDataChannels, id)
-				if debugLogging {
-					gossip_common.Dbg("Closed data channel for %s due to missing public key", id)
-				}
+		if err := queueServerFrames(frame, recipients); err != nil {
+			gossip_common.Err("Failed to encrypt audio: %v", err)
+			return
+		}
+
+		for codec, ids := range channelPeers {
+			encoded, ok := frame[codec]
+			if !ok {
+				// The codec produced nothing for this frame, so there is nothing to send
 				continue
 			}
 
-			// Encrypt the audio sample with the recipient's PGP key
-			encryptedSample, err := gossip_common.GWEncrypt(pSample, publicKeys[id])
+			// Encrypt each encoded frame with our symmetric call key
+			encryptedSample, err := callKeys.seal(encoded)
 			if err != nil {
-				gossip_common.Err("Failed to encrypt audio for %s: %v", id, err)
-				continue
+				gossip_common.Err("Failed to encrypt audio: %v", err)
+				return
+			}
+			for _, id := range ids {
+				if err := channels[id].Send(encryptedSample); err != nil {
+					gossip_common.Err("Failed to send audio to %s: %v", id, err)
+				}
 			}
+		}
+	}
+}
 
-			// Send the audio sample if the data channel is open
-			err = dc.Send(encryptedSample)
-			if err != nil {
-				gossip_common.Err("Failed to send audio to %s: %v", id, err)
+/**
+ * playParticipantAudio decrypts a frame received over a participant's data channel and plays it.
+ * @param a The application instance.
+ * @param id The participant the frame came from.
+ * @param frame The sealed audio frame.
+ */
+func playParticipantAudio(a *App, id string, frame []byte) {
+	plaintext, err := callKeys.open(id, frame)
+	if err != nil {
+		if debugLogging {
+			gossip_common.Dbg("Dropped audio frame from %s: %v", id, err)
+		}
+		return
+	}
+	playAudioFrame(a, id, plaintext)
+}
+
+/**
+ * playAudioFrame decodes a participant's audio frame and queues it in the playback mixer,
+ * opening the playback device on the first frame.
+ * @param a The application instance.
+ * @param id The participant the frame came from.
+ * @param plaintext The decrypted audio frame, starting with the audio frame header.
+ */
+func playAudioFrame(a *App, id string, plaintext []byte) {
+	decoded, err := decodeAudioFrame(id, plaintext)
+	if err != nil && debugLogging {
+		gossip_common.Dbg("Failed to decode audio from %s: %v", id, err)
+	}
+	if len(decoded) == 0 {
+		return
+	}
+
+	for _, frame := range decoded {
+		if detectRemoteSpeech(id, frame.pcm) {
+			markTalking(a, id)
+			break
+		}
+	}
+
+	mixer, err := startMixer()
+	if err != nil {
+		gossip_common.Err("Failed to start playback: %v", err)
+		return
+	}
+	for _, frame := range decoded {
+		mixer.AddFrame(id, frame.seq, frame.pcm)
+	}
+}
+
+/**
+ * participantLeft forgets a departed participant's call key and rotates ours
+ * so they cannot read anything sent after they left.
+ * @param id The participant that left.
+ */
+func participantLeft(id string) {
+	callKeys.removePeer(id)
+	if inCall && callKeys.requestRekey() {
+		go rekeyCall()
+	}
+}
+
+/**
+ * closeParticipant tears down the connection and mixer source of a participant that left the call.
+ * @param id The participant that left.
+ */
+func closeParticipant(id string) {
+	if stopRelayingPeer(id) {
+		participantLeft(id)
+	}
+	closePeerConnection(id)
+	forgetMedia(id)
+
+	if mixer := currentMixer(); mixer != nil {
+		mixer.RemoveSource(id)
+	}
+}
+
+// closePeerConnection closes a participant's peer connection and data channel.
+func closePeerConnection(id string) {
+	forgetPeerConnection(id)
+
+	participentLock.Lock()
+	dc := participentDataChannels[id]
+	pc := participentPeerConnections[id]
+	delete(participentDataChannels, id)
+	delete(participentPeerConnections, id)
+	participentLock.Unlock()
+
+	if dc != nil {
+		dc.Close()
+	}
+	if pc != nil {
+		if err := pc.Close(); err != nil {
+			gossip_common.Err("Failed to close peer connection for %s: %v", id, err)
+		}
+	}
+}
+
+// closeAllPeers closes and forgets every peer connection and data channel.
+func closeAllPeers() {
+	participentLock.Lock()
+	peerConnections, channels := participentPeerConnections, participentDataChannels
+	participentPeerConnections = make(map[string]*webrtc.PeerConnection)
+	participentDataChannels = make(map[string]*webrtc.DataChannel)
+	participentLock.Unlock()
+
+	for id, dc := range channels {
+		if dc != nil {
+			dc.Close()
+			if debugLogging {
+				gossip_common.Dbg("Closed data channel for %s", id)
 			}
 		}
 	}
+	for id, pc := range peerConnections {
+		forgetCallStats(id)
+		if pc == nil {
+			continue
+		}
+		if err := pc.Close(); err != nil {
+			gossip_common.Err("Failed to close peer connection for %s: %v", id, err)
+		} else if debugLogging {
+			gossip_common.Dbg("Closed peer connection for %s", id)
+		}
+	}
+}
+
+// peerConnection returns a participant's peer connection, nil if there is none.
+func peerConnection(id string) *webrtc.PeerConnection {
+	participentLock.RLock()
+	defer participentLock.RUnlock()
+
+	return participentPeerConnections[id]
+}
+
+// setPeerConnection stores a participant's peer connection.
+func setPeerConnection(id string, pc *webrtc.PeerConnection) {
+	participentLock.Lock()
+	defer participentLock.Unlock()
+
+	participentPeerConnections[id] = pc
+}
+
+// setDataChannel stores a participant's data channel.
+func setDataChannel(id string, dc *webrtc.DataChannel) {
+	participentLock.Lock()
+	defer participentLock.Unlock()
+
+	participentDataChannels[id] = dc
+}
+
+// removeDataChannel forgets a participant's data channel if it is still the given one, reporting whether it was.
+func removeDataChannel(id string, dc *webrtc.DataChannel) bool {
+	participentLock.Lock()
+	defer participentLock.Unlock()
+
+	if participentDataChannels[id] != dc {
+		return false
+	}
+	delete(participentDataChannels, id)
+	return true
+}
+
+// peerConnections returns a copy of every participant's peer connection, safe to range over.
+func peerConnections() map[string]*webrtc.PeerConnection {
+	participentLock.RLock()
+	defer participentLock.RUnlock()
+
+	connections := make(map[string]*webrtc.PeerConnection, len(participentPeerConnections))
+	for id, pc := range participentPeerConnections {
+		connections[id] = pc
+	}
+	return connections
+}
+
+// dataChannels returns a copy of every participant's data channel, safe to range over.
+func dataChannels() map[string]*webrtc.DataChannel {
+	participentLock.RLock()
+	defer participentLock.RUnlock()
+
+	channels := make(map[string]*webrtc.DataChannel, len(participentDataChannels))
+	for id, dc := range participentDataChannels {
+		channels[id] = dc
+	}
+	return channels
 }
@@ -0,0 +1,280 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"gossip_common"
+
+	"github.com/pion/webrtc/v4"
+	"github.com/pion/webrtc/v4/pkg/media"
+)
+
+var (
+	localAudioTrack     *webrtc.TrackLocalStaticSample // Shared by every peer connection that negotiated Opus
+	peerFrameEncryption = make(map[string]bool)        // Whether a participant seals its media frames with its call key
+	trackLock           sync.Mutex
+)
+
+/**
+ * newCallDescription wraps a local session description with our codecs, PCM format and frame encryption setting.
+ * @param sd The local offer or answer.
+ * @return The description to send.
+ */
+func newCallDescription(sd webrtc.SessionDescription) callDescription {
+	codecLock.Lock()
+	encryptFrames := captureConfig.encryptFrames
+	codecLock.Unlock()
+
+	format := callFormat
+	return callDescription{SessionDescription: sd, Codecs: supportedCodecs(), FrameEncryption: encryptFrames, Format: &format}
+}
+
+/**
+ * negotiateMedia records the codec, PCM format and frame encryption a participant advertised.
+ * @param id The participant.
+ * @param desc Their offer or answer.
+ */
+func negotiateMedia(id string, desc callDescription) {
+	negotiateCodec(id, desc.Codecs)
+	negotiateFormat(id, desc.Format)
+
+	trackLock.Lock()
+	peerFrameEncryption[id] = desc.FrameEncryption
+	trackLock.Unlock()
+}
+
+/**
+ * startAudioTrack creates the local Opus track for a new call. Builds without Opus
+ * have no track and send everything over data channels.
+ */
+func startAudioTrack() {
+	trackLock.Lock()
+	defer trackLock.Unlock()
+
+	localAudioTrack = nil
+	if !opusAvailable {
+		return
+	}
+
+	track, err := webrtc.NewTrackLocalStaticSample(
+		webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeOpus, ClockRate: audioSampleRate, Channels: 2},
+		"audio", "gossip-"+gossip_common.GetClientID())
+	if err != nil {
+		gossip_common.Err("Failed to create audio track: %v", err)
+		return
+	}
+	localAudioTrack = track
+}
+
+// stopAudioTrack drops the local track and per-participant media state at the end of a call.
+func stopAudioTrack() {
+	trackLock.Lock()
+	defer trackLock.Unlock()
+
+	localAudioTrack = nil
+	peerFrameEncryption = make(map[string]bool)
+}
+
+/**
+ * addAudioTrack attaches our audio track to a peer connection and drains its RTCP
+ * so receiver reports and NACKs are processed.
+ * @param pc The peer connection.
+ * @return error Error if the track could not be added.
+ */
+func addAudioTrack(pc *webrtc.PeerConnection) error {
+	trackLock.Lock()
+	track := localAudioTrack
+	trackLock.Unlock()
+
+	if track == nil {
+		return nil
+	}
+
+	sender, err := pc.AddTrack(track)
+	if err != nil {
+		return fmt.Errorf("failed to add audio track: %w", err)
+	}
+	go drainRTCP(sender)
+	return nil
+}
+
+/**
+ * offerAudioTrack offers an audio section before we know which codecs the participant speaks.
+ * It stays silent until bindAudioTrack attaches our Opus track, so a participant that answers
+ * with PCM only never receives Opus frames.
+ * @param pc The peer connection.
+ * @return error Error if the section could not be added.
+ */
+func offerAudioTrack(pc *webrtc.PeerConnection) error {
+	trackLock.Lock()
+	hasTrack := localAudioTrack != nil
+	trackLock.Unlock()
+
+	if !hasTrack {
+		return nil
+	}
+
+	transceiver, err := pc.AddTransceiverFromKind(webrtc.RTPCodecTypeAudio)
+	if err != nil {
+		return fmt.Errorf("failed to offer audio track: %w", err)
+	}
+	go drainRTCP(transceiver.Sender())
+	return nil
+}
+
+/**
+ * bindAudioTrack attaches our Opus track to the audio section we offered once the participant's
+ * answer shows they receive Opus.
+ * @param id The participant.
+ * @param pc Their peer connection.
+ * @return error Error if the track could not be attached.
+ */
+func bindAudioTrack(id string, pc *webrtc.PeerConnection) error {
+	if !usesAudioTrack(id) {
+		return nil
+	}
+
+	trackLock.Lock()
+	track := localAudioTrack
+	trackLock.Unlock()
+
+	for _, transceiver := range pc.GetTransceivers() {
+		sender := transceiver.Sender()
+		if transceiver.Kind() != webrtc.RTPCodecTypeAudio || sender == nil {
+			continue
+		}
+		if sender.Track() == track {
+			return nil
+		}
+		if err := sender.ReplaceTrack(track); err != nil {
+			return fmt.Errorf("failed to attach audio track: %w", err)
+		}
+		return nil
+	}
+	return nil
+}
+
+// drainRTCP reads a sender's RTCP until it closes so the interceptors can process it.
+func drainRTCP(sender *webrtc.RTPSender) {
+	buffer := make([]byte, 1500)
+	for {
+		if _, _, err := sender.Read(buffer); err != nil {
+			return
+		}
+	}
+}
+
+/**
+ * usesAudioTrack reports whether a participant receives our audio over the media track.
+ * @param id The participant.
+ */
+func usesAudioTrack(id string) bool {
+	trackLock.Lock()
+	hasTrack := localAudioTrack != nil
+	trackLock.Unlock()
+
+	return hasTrack && sendCodec(id) == codecOpus
+}
+
+/**
+ * writeAudioTrack sends one encoded Opus frame on our track, sealing it with the call key
+ * first when frame encryption is on.
+ * @param packet The Opus packet without the audio frame header.
+ * @return error Error if the frame could not be sealed or written.
+ */
+func writeAudioTrack(packet []byte) error {
+	trackLock.Lock()
+	track := localAudioTrack
+	trackLock.Unlock()
+
+	if track == nil {
+		return errors.New("no audio track")
+	}
+
+	codecLock.Lock()
+	config := captureConfig
+	codecLock.Unlock()
+
+	if config.encryptFrames {
+		sealed, err := callKeys.seal(packet)
+		if err != nil {
+			return err
+		}
+		packet = sealed
+	}
+
+	return track.WriteSample(media.Sample{Data: packet, Duration: time.Duration(config.frameSize) * time.Millisecond})
+}
+
+/**
+ * handleRemoteTrack reads a participant's audio track until it ends and plays every frame.
+ * The RTP sequence number becomes the frame sequence, so the decoder can recover lost packets.
+ * Camera and screen share tracks are handed to handleRemoteVideo.
+ * @param a The application instance.
+ * @param id The participant the track belongs to.
+ * @param track The remote track.
+ * @param pc The participant's peer connection.
+ */
+func handleRemoteTrack(a *App, id string, track *webrtc.TrackRemote, pc *webrtc.PeerConnection) {
+	if track.Kind() == webrtc.RTPCodecTypeVideo {
+		source := "video"
+		if track.ID() == screenTrackID {
+			source = "screen"
+		}
+		handleRemoteVideo(a, id, track, pc, source)
+		return
+	}
+	if debugLogging {
+		gossip_common.Dbg("Receiving %s audio track from %s", track.Codec().MimeType, id)
+	}
+
+	for {
+		packet, _, err := track.ReadRTP()
+		if err != nil {
+			if err != io.EOF && debugLogging {
+				gossip_common.Dbg("Audio track from %s ended: %v", id, err)
+			}
+			return
+		}
+		if len(packet.Payload) == 0 {
+			continue
+		}
+
+		trackLock.Lock()
+		encrypted := peerFrameEncryption[id]
+		trackLock.Unlock()
+
+		payload := packet.Payload
+		if encrypted {
+			if payload, err = callKeys.open(id, payload); err != nil {
+				if debugLogging {
+					gossip_common.Dbg("Dropped audio frame from %s: %v", id, err)
+				}
+				continue
+			}
+		}
+
+		frame := make([]byte, audioFrameHeader, audioFrameHeader+len(payload))
+		frame[0] = codecOpus
+		binary.BigEndian.PutUint16(frame[1:3], packet.SequenceNumber)
+		playAudioFrame(a, id, append(frame, payload...))
+	}
+}
+
+/**
+ * forgetMedia drops the codec, decoder and frame encryption state of a participant that left.
+ * @param id The participant.
+ */
+func forgetMedia(id string) {
+	forgetCodec(id)
+	forgetRemoteSpeech(id)
+
+	trackLock.Lock()
+	delete(peerFrameEncryption, id)
+	trackLock.Unlock()
+}
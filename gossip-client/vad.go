@@ -0,0 +1,196 @@
+package main
+
+import (
+	"math"
+	"sync"
+
+	"gossip_common"
+
+	"github.com/wailsapp/wails/v2/pkg/runtime"
+)
+
+const (
+	vadDefaultSensitivity = 50
+	vadAbsoluteFloor      = -60.0 // dBFS below which nothing counts as speech
+	vadHangover           = 0.3   // Seconds a detector keeps reporting speech after the level drops
+	vadInitialNoiseFloor  = -60.0 // dBFS
+	vadNoiseRise          = 0.005 // How fast the noise floor creeps up under a constant signal
+)
+
+// Input modes stored in Settings.
+const (
+	inputModeVoice = "voice" // Transmit only while the VAD hears speech
+	inputModeOpen  = "open"  // Transmit everything
+	inputModePTT   = "ptt"   // Transmit only while the push-to-talk key is held
+)
+
+// voiceDetector is an energy based voice activity detector that tracks the background
+// noise level and reports speech when a frame rises far enough above it.
+type voiceDetector struct {
+	noiseFloor float64 // dBFS
+	threshold  float64 // dB above the noise floor that counts as speech
+	hangover   int     // Samples left before speech is reported as over
+	speaking   bool
+}
+
+var (
+	vadApp         *App // Receives the local speaking events
+	localVAD       *voiceDetector
+	remoteVADs     = make(map[string]*voiceDetector)
+	vadLock        sync.Mutex
+	vadSensitivity = vadDefaultSensitivity
+	localSpeaking  bool // Whether the UI was last told the local user is speaking
+)
+
+/**
+ * newVoiceDetector creates a detector.
+ * @param sensitivity 1 (only loud speech) to 100 (anything above the noise).
+ * @return The detector.
+ */
+func newVoiceDetector(sensitivity int) *voiceDetector {
+	if sensitivity < 1 || sensitivity > 100 {
+		sensitivity = vadDefaultSensitivity
+	}
+	return &voiceDetector{
+		noiseFloor: vadInitialNoiseFloor,
+		threshold:  30 - 0.25*float64(sensitivity),
+	}
+}
+
+// detect reports whether a frame carries speech.
+func (v *voiceDetector) detect(pcm []int16) bool {
+	if len(pcm) == 0 {
+		return v.speaking
+	}
+
+	var sum float64
+	for _, sample := range pcm {
+		x := float64(sample) / 32768
+		sum += x * x
+	}
+	level := 10 * math.Log10(sum/float64(len(pcm))+1e-12)
+
+	// Follow the noise floor down immediately and up slowly, so speech does not become the floor
+	if level < v.noiseFloor {
+		v.noiseFloor = level
+	} else {
+		v.noiseFloor += (level - v.noiseFloor) * vadNoiseRise
+	}
+	if v.noiseFloor < -90 {
+		v.noiseFloor = -90
+	}
+
+	if level > vadAbsoluteFloor && level > v.noiseFloor+v.threshold {
+		v.hangover = int(vadHangover * audioSampleRate)
+		v.speaking = true
+	} else if v.hangover > 0 {
+		v.hangover -= len(pcm)
+	} else {
+		v.speaking = false
+	}
+	return v.speaking
+}
+
+/**
+ * startVAD resets voice detection for a new call.
+ * @param a The application instance that receives speaking events.
+ * @param config The audio configuration.
+ */
+func startVAD(a *App, config audioConfig) {
+	vadLock.Lock()
+	defer vadLock.Unlock()
+
+	vadApp = a
+	vadSensitivity = config.vadSensitivity
+	localVAD = newVoiceDetector(config.vadSensitivity)
+	localSpeaking = false
+	remoteVADs = make(map[string]*voiceDetector)
+}
+
+/**
+ * detectLocalSpeech runs the capture VAD on one frame and emits speaking-started and
+ * speaking-stopped when the local user starts or stops being heard.
+ * @param pcm The captured frame.
+ * @param mode The input mode.
+ * @return Whether the frame should be transmitted.
+ */
+func detectLocalSpeech(pcm []int16, mode string) bool {
+	vadLock.Lock()
+	if localVAD == nil {
+		vadLock.Unlock()
+		return true
+	}
+	heard := localVAD.detect(pcm)
+
+	transmit := true
+	switch mode {
+	case inputModeVoice:
+		transmit = heard
+	case inputModePTT:
+		transmit = pushToTalkActive()
+	}
+
+	speaking := heard && transmit
+	changed := speaking != localSpeaking
+	localSpeaking = speaking
+	a := vadApp
+	vadLock.Unlock()
+
+	if changed && a != nil {
+		go emitLocalSpeaking(a, speaking)
+	}
+	return transmit
+}
+
+// stopLocalSpeaking ends a local speaking indication, used when the microphone is muted.
+func stopLocalSpeaking() {
+	vadLock.Lock()
+	if localVAD == nil || !localSpeaking {
+		vadLock.Unlock()
+		return
+	}
+	localSpeaking = false
+	localVAD.speaking = false
+	localVAD.hangover = 0
+	a := vadApp
+	vadLock.Unlock()
+
+	if a != nil {
+		emitLocalSpeaking(a, false)
+	}
+}
+
+// emitLocalSpeaking reports a local speaking change to the UI and our roster entry.
+func emitLocalSpeaking(a *App, speaking bool) {
+	if speaking {
+		runtime.EventsEmit(a.ctx, "speaking-started")
+	} else {
+		runtime.EventsEmit(a.ctx, "speaking-stopped")
+	}
+	rosterUpdate(a, gossip_common.GetClientID(), func(entry *RosterEntry) { entry.Talking = speaking })
+}
+
+/**
+ * detectRemoteSpeech runs a participant's VAD on a received frame.
+ * @param id The participant.
+ * @param pcm The decoded frame.
+ * @return Whether the participant is speaking.
+ */
+func detectRemoteSpeech(id string, pcm []int16) bool {
+	vadLock.Lock()
+	defer vadLock.Unlock()
+
+	detector, exists := remoteVADs[id]
+	if !exists {
+		detector = newVoiceDetector(vadSensitivity)
+		remoteVADs[id] = detector
+	}
+	return detector.detect(pcm)
+}
+
+// forgetRemoteSpeech drops the detector of a participant that left.
+func forgetRemoteSpeech(id string) {
+	vadLock.Lock()
+	delete(remoteVADs, id)
+	vadLock.Unlock()
+}
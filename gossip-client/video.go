@@ -0,0 +1,514 @@
+package main
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"gossip_common"
+
+	"github.com/pion/rtcp"
+	"github.com/pion/rtp"
+	"github.com/pion/rtp/codecs"
+	"github.com/pion/webrtc/v4"
+	"github.com/pion/webrtc/v4/pkg/media"
+	"github.com/pion/webrtc/v4/pkg/media/samplebuilder"
+	"github.com/wailsapp/wails/v2/pkg/runtime"
+)
+
+// Video codecs stored in Settings.
+const (
+	videoCodecVP8  = "vp8"
+	videoCodecH264 = "h264"
+)
+
+const (
+	defaultVideoWidth     = 640
+	defaultVideoHeight    = 480
+	defaultVideoFramerate = 30
+	videoClockRate        = 90000
+	videoMaxLate          = 256                    // RTP packets the sample builder waits for a missing one
+	videoKeyframeRetry    = 1 * time.Second        // How often we ask for a keyframe until one arrives
+	videoMaxFrame         = 4 * 1024 * 1024        // Largest encoded frame accepted from the frontend
+	videoMaxDelay         = 100 * time.Millisecond // How long a frame waits for its missing packets before it is skipped
+	videoOpenTimeout      = 10 * time.Second       // How long a participant's frames may fail to decrypt before we give up on the track
+)
+
+/**
+ * VideoConfig describes the camera stream the frontend captures and encodes.
+ * @param Width The frame width in pixels.
+ * @param Height The frame height in pixels.
+ * @param Framerate Frames per second.
+ * @param Codec "vp8" or "h264".
+ */
+type VideoConfig struct {
+	Width     int    `json:"width"`
+	Height    int    `json:"height"`
+	Framerate int    `json:"framerate"`
+	Codec     string `json:"codec"`
+}
+
+var (
+	localVideoTrack *webrtc.TrackLocalStaticSample // Shared by every peer connection
+	videoConfig     VideoConfig                    // Settings of the current call's video track
+	cameraOn        bool
+	videoLock       sync.Mutex
+)
+
+/**
+ * loadVideoConfig reads the camera settings, falling back to defaults for missing or invalid values.
+ * @return The video configuration.
+ */
+func loadVideoConfig() VideoConfig {
+	config := VideoConfig{
+		Width:     defaultVideoWidth,
+		Height:    defaultVideoHeight,
+		Framerate: defaultVideoFramerate,
+		Codec:     videoCodecVP8,
+	}
+
+	settings, err := LoadSettings()
+	if err != nil {
+		gossip_common.Err("Failed to load video settings, using defaults: %v", err)
+		return config
+	}
+
+	if validVideoSize(settings.VideoWidth, settings.VideoHeight, settings.VideoFramerate) == nil {
+		config.Width = settings.VideoWidth
+		config.Height = settings.VideoHeight
+		config.Framerate = settings.VideoFramerate
+	}
+	if settings.VideoCodec == videoCodecH264 {
+		if settings.EncryptMediaFrames {
+			// H.264 is packetized by NAL unit and cannot be sealed, so we never send it in the clear
+			gossip_common.Log("H.264 cannot be used with media frame encryption, using VP8")
+		} else {
+			config.Codec = videoCodecH264
+		}
+	}
+	return config
+}
+
+// validVideoSize checks a resolution and framerate.
+func validVideoSize(width, height, framerate int) error {
+	if width < 160 || width > 1920 || height < 120 || height > 1080 {
+		return errors.New("resolution must be between 160x120 and 1920x1080")
+	}
+	if framerate < 1 || framerate > 60 {
+		return errors.New("framerate must be between 1 and 60")
+	}
+	return nil
+}
+
+// videoMimeType returns the WebRTC MIME type of a video codec.
+func videoMimeType(codec string) string {
+	if codec == videoCodecH264 {
+		return webrtc.MimeTypeH264
+	}
+	return webrtc.MimeTypeVP8
+}
+
+// startVideoTrack creates the local video track for a new call. Frames only flow while the camera is on.
+func startVideoTrack() {
+	config := loadVideoConfig()
+
+	videoLock.Lock()
+	defer videoLock.Unlock()
+
+	videoConfig = config
+	localVideoTrack = nil
+
+	track, err := webrtc.NewTrackLocalStaticSample(
+		webrtc.RTPCodecCapability{MimeType: videoMimeType(config.Codec), ClockRate: videoClockRate},
+		"video", "gossip-"+gossip_common.GetClientID())
+	if err != nil {
+		gossip_common.Err("Failed to create video track: %v", err)
+		return
+	}
+	localVideoTrack = track
+}
+
+/**
+ * stopVideoTrack drops the local video track at the end of a call and turns the camera off.
+ * @param a The application instance.
+ */
+func stopVideoTrack(a *App) {
+	videoLock.Lock()
+	wasOn := cameraOn
+	cameraOn = false
+	localVideoTrack = nil
+	videoLock.Unlock()
+
+	if wasOn {
+		runtime.EventsEmit(a.ctx, "camera-stopped")
+	}
+}
+
+/**
+ * addVideoTrack attaches our camera track to a peer connection.
+ * @param a The application instance.
+ * @param pc The peer connection.
+ * @return error Error if the track could not be added.
+ */
+func addVideoTrack(a *App, pc *webrtc.PeerConnection) error {
+	videoLock.Lock()
+	track := localVideoTrack
+	videoLock.Unlock()
+
+	return addLocalVideoTrack(a, pc, track, "video-keyframe-request")
+}
+
+/**
+ * addLocalVideoTrack attaches a local video track to a peer connection and emits keyframeEvent
+ * whenever the participant reports picture loss, so the frontend encodes a keyframe.
+ * @param a The application instance.
+ * @param pc The peer connection.
+ * @param track The track, nothing is added when nil.
+ * @param keyframeEvent The event emitted on a PLI or FIR.
+ * @return error Error if the track could not be added.
+ */
+func addLocalVideoTrack(a *App, pc *webrtc.PeerConnection, track *webrtc.TrackLocalStaticSample, keyframeEvent string) error {
+	if track == nil {
+		return nil
+	}
+
+	sender, err := pc.AddTrack(track)
+	if err != nil {
+		return fmt.Errorf("failed to add %s track: %w", track.ID(), err)
+	}
+
+	go func() {
+		for {
+			packets, _, err := sender.ReadRTCP()
+			if err != nil {
+				return
+			}
+			for _, packet := range packets {
+				switch packet.(type) {
+				case *rtcp.PictureLossIndication, *rtcp.FullIntraRequest:
+					runtime.EventsEmit(a.ctx, keyframeEvent)
+				}
+			}
+		}
+	}()
+	return nil
+}
+
+/**
+ * attachVideoTrack adds a local video track to every participant's peer connection that does not
+ * send it yet, such as one whose offer had no section for it, and renegotiates so they receive it.
+ * @param a The application instance.
+ * @param track The track.
+ * @param keyframeEvent The event emitted on a PLI or FIR.
+ */
+func attachVideoTrack(a *App, track *webrtc.TrackLocalStaticSample, keyframeEvent string) {
+	for id, pc := range peerConnections() {
+		if sendsTrack(pc, track) {
+			continue
+		}
+		if err := addLocalVideoTrack(a, pc, track, keyframeEvent); err != nil {
+			gossip_common.Err("Failed to add %s track for %s: %v", track.ID(), id, err)
+			continue
+		}
+		if err := sendOffer(id, pc, nil); err != nil {
+			gossip_common.Err("Failed to renegotiate %s track with %s: %v", track.ID(), id, err)
+			continue
+		}
+		if debugLogging {
+			gossip_common.Dbg("Renegotiated %s track with %s", track.ID(), id)
+		}
+	}
+}
+
+// sendsTrack reports whether a peer connection already has a sender for a local track.
+func sendsTrack(pc *webrtc.PeerConnection, track webrtc.TrackLocal) bool {
+	for _, sender := range pc.GetSenders() {
+		if sender.Track() == track {
+			return true
+		}
+	}
+	return false
+}
+
+/**
+ * offeredVideoTracks counts the video sections of a remote offer. The first is answered with
+ * our camera track and the second with our screen share track.
+ * @param pc The peer connection after the offer was applied.
+ */
+func offeredVideoTracks(pc *webrtc.PeerConnection) int {
+	count := 0
+	for _, transceiver := range pc.GetTransceivers() {
+		if transceiver.Kind() == webrtc.RTPCodecTypeVideo {
+			count++
+		}
+	}
+	return count
+}
+
+/**
+ * StartCamera turns the camera on. The frontend receives "camera-started" with the VideoConfig
+ * to capture and encode, and sends the encoded frames back with SendVideoFrame. Participants
+ * whose connection has no camera track yet get it through a renegotiation
+ * @return error Error if not in a call
+ */
+func (a *App) StartCamera() error {
+	videoLock.Lock()
+	if localVideoTrack == nil {
+		videoLock.Unlock()
+		return errors.New("not in a call")
+	}
+	cameraOn = true
+	config := videoConfig
+	track := localVideoTrack
+	videoLock.Unlock()
+
+	attachVideoTrack(a, track, "video-keyframe-request")
+
+	runtime.EventsEmit(a.ctx, "camera-started", config)
+	sendCallState(a)
+	return nil
+}
+
+/**
+ * StopCamera turns the camera off
+ */
+func (a *App) StopCamera() {
+	videoLock.Lock()
+	wasOn := cameraOn
+	cameraOn = false
+	videoLock.Unlock()
+
+	if wasOn {
+		runtime.EventsEmit(a.ctx, "camera-stopped")
+		sendCallState(a)
+	}
+}
+
+/**
+ * SetVideoQuality chooses the camera resolution and framerate, saves them and applies them
+ * to the running camera
+ * @param width The frame width in pixels
+ * @param height The frame height in pixels
+ * @param framerate Frames per second
+ * @return error Error if the values are out of range or could not be saved
+ */
+func (a *App) SetVideoQuality(width, height, framerate int) error {
+	if err := validVideoSize(width, height, framerate); err != nil {
+		return err
+	}
+
+	settings, err := LoadSettings()
+	if err != nil {
+		return err
+	}
+	settings.VideoWidth = width
+	settings.VideoHeight = height
+	settings.VideoFramerate = framerate
+	if err := SaveSettings(settings); err != nil {
+		return err
+	}
+
+	videoLock.Lock()
+	videoConfig.Width = width
+	videoConfig.Height = height
+	videoConfig.Framerate = framerate
+	config := videoConfig
+	on := cameraOn
+	videoLock.Unlock()
+
+	if on {
+		runtime.EventsEmit(a.ctx, "camera-started", config)
+	}
+	return nil
+}
+
+/**
+ * GetVideoConfig returns the camera settings of the current call, or the saved ones outside a call
+ * @return VideoConfig The resolution, framerate and codec
+ */
+func (a *App) GetVideoConfig() VideoConfig {
+	videoLock.Lock()
+	defer videoLock.Unlock()
+
+	if localVideoTrack == nil {
+		return loadVideoConfig()
+	}
+	return videoConfig
+}
+
+/**
+ * SendVideoFrame sends one encoded camera frame to every participant
+ * @param frame The VP8 frame or H.264 access unit in Annex B format, base64 encoded
+ * @return error Error if the camera is off or the frame could not be sent
+ */
+func (a *App) SendVideoFrame(frame string) error {
+	videoLock.Lock()
+	track := localVideoTrack
+	config := videoConfig
+	on := cameraOn
+	videoLock.Unlock()
+
+	if track == nil || !on {
+		return errors.New("camera is off")
+	}
+
+	return writeVideoFrame(track, config.Codec, frame, time.Second/time.Duration(config.Framerate))
+}
+
+/**
+ * writeVideoFrame decodes a frame from the frontend, seals it when frame encryption is on and
+ * writes it to a local video track.
+ * @param track The local track.
+ * @param codec The track's codec.
+ * @param frame The encoded frame, base64 encoded.
+ * @param duration How long the frame is shown, which advances the RTP timestamp.
+ * @return error Error if the frame is invalid or could not be written.
+ */
+func writeVideoFrame(track *webrtc.TrackLocalStaticSample, codec string, frame string, duration time.Duration) error {
+	data, err := base64.StdEncoding.DecodeString(frame)
+	if err != nil {
+		return fmt.Errorf("invalid video frame: %w", err)
+	}
+	if len(data) == 0 || len(data) > videoMaxFrame {
+		return errors.New("invalid video frame size")
+	}
+
+	// H.264 is packetized by NAL unit, so only VP8 frames can be sealed without breaking it
+	if frameEncryptionEnabled() {
+		if codec != videoCodecVP8 {
+			return errors.New("H.264 frames cannot be encrypted")
+		}
+		if data, err = callKeys.seal(data); err != nil {
+			return err
+		}
+	}
+
+	return track.WriteSample(media.Sample{Data: data, Duration: duration})
+}
+
+// frameEncryptionEnabled reports whether we seal media frames with our call key.
+func frameEncryptionEnabled() bool {
+	codecLock.Lock()
+	defer codecLock.Unlock()
+
+	return captureConfig.encryptFrames
+}
+
+/**
+ * handleRemoteVideo reassembles a participant's video frames and hands them to the frontend
+ * as "<source>-frame" events with the participant ID, the base64 frame, whether it is a
+ * keyframe and the codec. Until the first keyframe arrives we keep asking for one. If no frame
+ * decrypts for videoOpenTimeout, "<source>-error" is emitted with the participant ID and the
+ * reason, and the track is given up on.
+ * @param a The application instance.
+ * @param id The participant the track belongs to.
+ * @param track The remote video track.
+ * @param pc The participant's peer connection, used to request keyframes.
+ * @param source "video" for the camera or "screen" for a screen share, used as the event prefix.
+ */
+func handleRemoteVideo(a *App, id string, track *webrtc.TrackRemote, pc *webrtc.PeerConnection, source string) {
+	codec := videoCodecVP8
+	var depacketizer rtp.Depacketizer = &codecs.VP8Packet{}
+	if track.Codec().MimeType == webrtc.MimeTypeH264 {
+		codec = videoCodecH264
+		depacketizer = &codecs.H264Packet{}
+	}
+	if debugLogging {
+		gossip_common.Dbg("Receiving %s %s track from %s", track.Codec().MimeType, source, id)
+	}
+
+	builder := samplebuilder.New(videoMaxLate, depacketizer, track.Codec().ClockRate, samplebuilder.WithMaxTimeDelay(videoMaxDelay))
+	requestKeyframe := func() {
+		if pc == nil {
+			return
+		}
+		pli := []rtcp.Packet{&rtcp.PictureLossIndication{MediaSSRC: uint32(track.SSRC())}}
+		if err := pc.WriteRTCP(pli); err != nil && debugLogging {
+			gossip_common.Dbg("Failed to request a keyframe from %s: %v", id, err)
+		}
+	}
+
+	defer runtime.EventsEmit(a.ctx, source+"-stopped", id)
+
+	haveKeyframe := false
+	lastRequest := time.Now()
+	var failingSince time.Time // When frames started failing to decrypt, zero while they open
+	requestKeyframe()
+	for {
+		packet, _, err := track.ReadRTP()
+		if err != nil {
+			if err != io.EOF && debugLogging {
+				gossip_common.Dbg("%s track from %s ended: %v", source, id, err)
+			}
+			return
+		}
+		builder.Push(packet)
+
+		for sample := builder.Pop(); sample != nil; sample = builder.Pop() {
+			frame := sample.Data
+
+			trackLock.Lock()
+			encrypted := peerFrameEncryption[id]
+			trackLock.Unlock()
+
+			if encrypted && codec == videoCodecVP8 {
+				if frame, err = callKeys.open(id, frame); err != nil {
+					if debugLogging {
+						gossip_common.Dbg("Dropped video frame from %s: %v", id, err)
+					}
+					if failingSince.IsZero() {
+						failingSince = time.Now()
+					} else if time.Since(failingSince) > videoOpenTimeout {
+						gossip_common.Err("Giving up on %s track from %s: %v", source, id, err)
+						runtime.EventsEmit(a.ctx, source+"-error", id, err.Error())
+						return
+					}
+					continue
+				}
+				failingSince = time.Time{}
+			}
+
+			keyframe := isKeyframe(codec, frame)
+			if !haveKeyframe && !keyframe {
+				// The decoder cannot start from a delta frame
+				if time.Since(lastRequest) > videoKeyframeRetry {
+					requestKeyframe()
+					lastRequest = time.Now()
+				}
+				continue
+			}
+			haveKeyframe = true
+
+			runtime.EventsEmit(a.ctx, source+"-frame", id, base64.StdEncoding.EncodeToString(frame), keyframe, codec)
+		}
+	}
+}
+
+/**
+ * isKeyframe reports whether an encoded frame can be decoded on its own.
+ * @param codec "vp8" or "h264".
+ * @param frame The encoded frame.
+ */
+func isKeyframe(codec string, frame []byte) bool {
+	if len(frame) == 0 {
+		return false
+	}
+	if codec == videoCodecVP8 {
+		// The lowest bit of the VP8 frame tag is 0 for keyframes
+		return frame[0]&0x01 == 0
+	}
+
+	// Look for an IDR slice or a sequence parameter set between Annex B start codes
+	for i := 0; i+3 < len(frame); i++ {
+		if frame[i] == 0 && frame[i+1] == 0 && frame[i+2] == 1 {
+			switch frame[i+3] & 0x1F {
+			case 5, 7:
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,62 @@
+package gossip_common
+
+/**
+ * CallInvite is the payload of an "invite" packet.
+ * @param CallID The call the invitees are asked to join.
+ * @param Invitees The client IDs to ring.
+ */
+type CallInvite struct {
+	CallID   string   `json:"call"`
+	Invitees []string `json:"invitees"`
+}
+
+/**
+ * CallParticipantState is the payload of a "call_state" packet.
+ * @param Muted Whether the participant's microphone is muted.
+ * @param Deafened Whether the participant has deafened themselves.
+ * @param Camera Whether the participant is sending camera video.
+ * @param Screen Whether the participant is sharing their screen.
+ */
+type CallParticipantState struct {
+	Muted    bool `json:"muted"`
+	Deafened bool `json:"deafened"`
+	Camera   bool `json:"camera,omitempty"`
+	Screen   bool `json:"screen,omitempty"`
+}
+
+/**
+ * CallSummary describes an active call in a "calls" packet.
+ * @param CallID The call ID, left empty unless the requester is in or invited to the call.
+ * @param Participants The participants and when they joined.
+ * @param Started When the call started, in Unix seconds.
+ * @param Duration How long the call has been running, in seconds.
+ */
+type CallSummary struct {
+	CallID       string                   `json:"call,omitempty"`
+	Participants []CallParticipantSummary `json:"participants"`
+	Started      int64                    `json:"started"`
+	Duration     int64                    `json:"duration"`
+}
+
+/**
+ * CallParticipantSummary is one participant of a CallSummary.
+ * @param ID The participant's client ID.
+ * @param Joined When the participant joined, in Unix seconds.
+ */
+type CallParticipantSummary struct {
+	ID     string `json:"id"`
+	Joined int64  `json:"joined"`
+}
+
+/**
+ * ICEServer is a STUN or TURN server clients use to connect their calls, as sent in an
+ * "ice_servers" packet and stored in the client settings.
+ * @param URLs The server URLs, such as "stun:stun.example.org:3478" or "turn:turn.example.org:3478?transport=udp".
+ * @param Username The TURN username, empty for STUN.
+ * @param Credential The TURN password, empty for STUN.
+ */
+type ICEServer struct {
+	URLs       []string `json:"urls"`
+	Username   string   `json:"username,omitempty"`
+	Credential string   `json:"credential,omitempty"`
+}
@@ -2,6 +2,7 @@ package gossip_common
 
 import (
 	"bytes"
+	"encoding/hex"
 	"fmt"
 	"io/ioutil"
 
@@ -59,6 +60,32 @@ func RetrievePrivateKey() []byte {
 	return buf.Bytes()
 }
 
+/**
+ * ClientIDFromPublicKey derives the client ID bound to an armored public key.
+ * The ID is the hex fingerprint of the primary key, so a client cannot claim an ID
+ * without holding the matching key.
+ * @param publicKey The armored public key.
+ * @return The client ID.
+ */
+func ClientIDFromPublicKey(publicKey []byte) (string, error) {
+	entityList, err := openpgp.ReadArmoredKeyRing(bytes.NewReader(publicKey))
+	if err != nil {
+		return "", fmt.Errorf("failed to read public key: %w", err)
+	}
+	if len(entityList) != 1 {
+		return "", fmt.Errorf("expected a single public key, got %d", len(entityList))
+	}
+	return hex.EncodeToString(entityList[0].PrimaryKey.Fingerprint), nil
+}
+
+/**
+ * DeriveClientID sets the client ID to the fingerprint of the generated key.
+ * Must be called after GenerateKeys.
+ */
+func DeriveClientID() {
+	cID = hex.EncodeToString(entity.PrimaryKey.Fingerprint)
+}
+
 /**
  * GWEncrypt encrypts a message for a recipient using their public key.
  * @param plaintext The plaintext message to encrypt.
@@ -141,6 +168,71 @@ func GWDecrypt(ciphertext []byte) ([]byte, error) {
 	return plaintext, nil
 }
 
+/**
+ * GWEncryptSigned encrypts a message for a recipient and signs it with our private key,
+ * so the recipient can tell it was not forged by the server or another client.
+ * @param plaintext The plaintext message to encrypt.
+ * @param recipientPublicKey The recipient's public key.
+ * @return The signed and encrypted message.
+ */
+func GWEncryptSigned(plaintext []byte, recipientPublicKey []byte) ([]byte, error) {
+	recipientEntityList, err := openpgp.ReadArmoredKeyRing(bytes.NewReader(recipientPublicKey))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read recipient public key: %w", err)
+	}
+
+	buf := new(bytes.Buffer)
+	w, err := openpgp.Encrypt(buf, recipientEntityList, entity, nil, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encrypt message: %w", err)
+	}
+	_, err = w.Write(plaintext)
+	if err != nil {
+		return nil, fmt.Errorf("failed to write plaintext to encrypted message: %w", err)
+	}
+	err = w.Close()
+	if err != nil {
+		return nil, fmt.Errorf("failed to close WriteCloser: %w", err)
+	}
+	return ioutil.ReadAll(buf)
+}
+
+/**
+ * GWDecryptVerified decrypts a message produced by GWEncryptSigned and checks that it was
+ * signed by the expected sender.
+ * @param ciphertext The encrypted message to decrypt.
+ * @param senderPublicKey The public key the signature must match.
+ * @return The decrypted message.
+ */
+func GWDecryptVerified(ciphertext []byte, senderPublicKey []byte) ([]byte, error) {
+	senderEntityList, err := openpgp.ReadArmoredKeyRing(bytes.NewReader(senderPublicKey))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read sender public key: %w", err)
+	}
+
+	keyring := append(openpgp.EntityList{entity}, senderEntityList...)
+	md, err := openpgp.ReadMessage(bytes.NewBuffer(ciphertext), keyring, nil, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read encrypted message: %w", err)
+	}
+	plaintext, err := ioutil.ReadAll(md.UnverifiedBody)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read plaintext from encrypted message: %w", err)
+	}
+
+	// The signature is only checked once the body has been read to the end
+	if !md.IsSigned || md.SignedBy == nil {
+		return nil, fmt.Errorf("message is not signed by a known key")
+	}
+	if md.SignatureError != nil {
+		return nil, fmt.Errorf("invalid message signature: %w", md.SignatureError)
+	}
+	if md.SignedBy.Entity.PrimaryKey.KeyId != senderEntityList[0].PrimaryKey.KeyId {
+		return nil, fmt.Errorf("message is signed by an unexpected key")
+	}
+	return plaintext, nil
+}
+
 /**
  * HashPassword hashes a password using Argon2.
  * @param password The password to hash.
@@ -57,6 +57,16 @@ type GMStreamPacket struct {
 	Recipients   []string `json:"r"` // List of recipient client IDs
 }
 
+/**
+ * LoginProof is the payload of an "ighru" packet, signed with the client's key and encrypted to the server.
+ * @param Password The server password.
+ * @param Challenge The challenge the server sent this connection, so the proof cannot be replayed.
+ */
+type LoginProof struct {
+	Password  string `json:"password"`
+	Challenge string `json:"challenge"`
+}
+
 /**
  * NewMessagePacket creates a new instance of a GMSigPacket with string data.
  * @param OpCmd The operation command.
@@ -295,30 +305,30 @@ func SendDataPacket(writer *bufio.Writer, packet GMDataPacket, publicKey []byte)
 }
 
 /**
- * Sends a GMStreamPacket over the given connection, encrypting for each recipient.
+ * Sends a GMStreamPacket over the given connection, sealed with the connection's session key.
  * @param writer The connection to send the packet over.
  * @param packet The GMStreamPacket to be sent.
- * @param serverPublicKey The public key of the server used to encrypt the packet.
+ * @param cipher The stream cipher of the connection.
  * @return error An error if sending fails, nil otherwise.
  */
-func SendStreamPacket(writer *bufio.Writer, packet GMStreamPacket, serverPublicKey []byte) error {
+func SendStreamPacket(writer *bufio.Writer, packet GMStreamPacket, cipher *StreamCipher) error {
 	packetStr, err := SerializeGMStreamPacket(&packet)
 	if err != nil {
 		Err("Failed to serialize GMStreamPacket: %v", err)
 		return err
 	}
 
-	// Encrypt the serialized packet with the server's public key
-	encryptedPacket, err := GWEncrypt([]byte(packetStr), serverPublicKey)
+	// Seal the serialized packet with the session key
+	sealedPacket, err := cipher.Seal([]byte(packetStr))
 	if err != nil {
-		Err("Failed to encrypt GMStreamPacket: %v", err)
+		Err("Failed to seal GMStreamPacket: %v", err)
 		return err
 	}
 
-	// Convert the encrypted packet to a base64 string for transmission
-	base64EncryptedPacket := base64.StdEncoding.EncodeToString(encryptedPacket)
+	// Convert the sealed packet to a base64 string for transmission
+	base64SealedPacket := base64.StdEncoding.EncodeToString(sealedPacket)
 
-	_, err = fmt.Fprintf(writer, "2%s\n", base64EncryptedPacket)
+	_, err = fmt.Fprintf(writer, "2%s\n", base64SealedPacket)
 	if err != nil {
 		Err("Failed to send GMStreamPacket over connection: %v", err)
 		return err
@@ -326,3 +336,23 @@ func SendStreamPacket(writer *bufio.Writer, packet GMStreamPacket, serverPublicK
 
 	return writer.Flush()
 }
+
+/**
+ * ReadStreamPacket decodes, opens and deserializes a stream packet received on a connection.
+ * @param message The message without its packet type prefix.
+ * @param cipher The stream cipher of the connection.
+ * @return The GMStreamPacket and an error if it could not be read.
+ */
+func ReadStreamPacket(message string, cipher *StreamCipher) (*GMStreamPacket, error) {
+	decodedPacket, err := base64.StdEncoding.DecodeString(message)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode base64 GMStreamPacket: %w", err)
+	}
+
+	openedPacket, err := cipher.Open(decodedPacket)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open GMStreamPacket: %w", err)
+	}
+
+	return DeserializeGMStreamPacket(string(openedPacket))
+}
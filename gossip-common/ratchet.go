@@ -0,0 +1,330 @@
+package gossip_common
+
+import (
+	"bytes"
+	"crypto/ecdh"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/hkdf"
+)
+
+const (
+	RatchetMaxSkip = 1000 // Maximum number of message keys kept for out-of-order messages
+)
+
+var (
+	ratchetRootInfo    = []byte("gossip-ratchet-root")
+	ratchetSessionInfo = []byte("gossip-ratchet-session")
+	ratchetZeroNonce   = make([]byte, chacha20poly1305.NonceSize)
+)
+
+/**
+ * RatchetHeader is sent in clear with every double ratchet message.
+ * @param DH The sender's current ratchet public key.
+ * @param PN The number of messages in the sender's previous sending chain.
+ * @param N The message number in the current sending chain.
+ */
+type RatchetHeader struct {
+	DH []byte `json:"dh"`
+	PN uint32 `json:"pn"`
+	N  uint32 `json:"n"`
+}
+
+/**
+ * RatchetMessage is a single double ratchet message.
+ * @param Header The ratchet header, authenticated as associated data.
+ * @param Ciphertext The encrypted message.
+ */
+type RatchetMessage struct {
+	Header     RatchetHeader `json:"h"`
+	Ciphertext []byte        `json:"c"`
+}
+
+type skippedKey struct {
+	dh string
+	n  uint32
+}
+
+/**
+ * RatchetSession holds the state of one side of a Signal-style double ratchet between two clients.
+ * Every message uses a fresh key that is deleted after use, and a new Diffie-Hellman exchange
+ * happens each time the conversation changes direction, which gives forward secrecy and
+ * recovery from a compromised session state.
+ */
+type RatchetSession struct {
+	dhs     *ecdh.PrivateKey
+	dhr     *ecdh.PublicKey
+	rk      []byte
+	cks     []byte
+	ckr     []byte
+	ns      uint32
+	nr      uint32
+	pn      uint32
+	skipped map[skippedKey][]byte
+}
+
+/**
+ * GenerateRatchetKey generates an X25519 key pair for a ratchet handshake.
+ * @return The new private key.
+ */
+func GenerateRatchetKey() (*ecdh.PrivateKey, error) {
+	key, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate ratchet key: %w", err)
+	}
+	return key, nil
+}
+
+/**
+ * RatchetSharedSecret derives the initial session secret from two ephemeral handshake keys.
+ * @param own Our ephemeral private key.
+ * @param remote The peer's ephemeral public key.
+ * @return The shared secret used to initialize the session.
+ */
+func RatchetSharedSecret(own *ecdh.PrivateKey, remote []byte) ([]byte, error) {
+	remoteKey, err := ecdh.X25519().NewPublicKey(remote)
+	if err != nil {
+		return nil, fmt.Errorf("invalid ratchet public key: %w", err)
+	}
+	dh, err := own.ECDH(remoteKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to compute shared secret: %w", err)
+	}
+
+	sk := make([]byte, 32)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, dh, nil, ratchetSessionInfo), sk); err != nil {
+		return nil, fmt.Errorf("failed to derive shared secret: %w", err)
+	}
+	return sk, nil
+}
+
+/**
+ * NewRatchetSender starts a session on the side that can send first.
+ * @param sk The shared secret from RatchetSharedSecret.
+ * @param remote The peer's ratchet public key.
+ * @return The new session.
+ */
+func NewRatchetSender(sk []byte, remote []byte) (*RatchetSession, error) {
+	remoteKey, err := ecdh.X25519().NewPublicKey(remote)
+	if err != nil {
+		return nil, fmt.Errorf("invalid ratchet public key: %w", err)
+	}
+	dhs, err := GenerateRatchetKey()
+	if err != nil {
+		return nil, err
+	}
+
+	s := &RatchetSession{dhs: dhs, dhr: remoteKey, skipped: make(map[skippedKey][]byte)}
+	dh, err := s.dhs.ECDH(s.dhr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to compute ratchet step: %w", err)
+	}
+	s.rk, s.cks, err = kdfRoot(sk, dh)
+	if err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+/**
+ * NewRatchetReceiver starts a session on the side that waits for the first message.
+ * @param sk The shared secret from RatchetSharedSecret.
+ * @param own Our ratchet key pair, whose public half the peer used to start the session.
+ * @return The new session.
+ */
+func NewRatchetReceiver(sk []byte, own *ecdh.PrivateKey) *RatchetSession {
+	return &RatchetSession{dhs: own, rk: sk, skipped: make(map[skippedKey][]byte)}
+}
+
+/**
+ * CanSend reports whether the session has a sending chain yet.
+ * The receiving side gets one once the first message from its peer arrives.
+ */
+func (s *RatchetSession) CanSend() bool {
+	return s.cks != nil
+}
+
+/**
+ * Encrypt encrypts a message and advances the sending chain.
+ * @param plaintext The message to encrypt.
+ * @param ad Associated data bound to the message, such as both client IDs.
+ * @return The ratchet message.
+ */
+func (s *RatchetSession) Encrypt(plaintext []byte, ad []byte) (*RatchetMessage, error) {
+	if s.cks == nil {
+		return nil, errors.New("ratchet session has no sending chain yet")
+	}
+
+	var mk []byte
+	s.cks, mk = kdfChain(s.cks)
+	header := RatchetHeader{DH: s.dhs.PublicKey().Bytes(), PN: s.pn, N: s.ns}
+	s.ns++
+
+	ciphertext, err := ratchetSeal(mk, plaintext, ratchetAD(ad, header))
+	if err != nil {
+		return nil, err
+	}
+	return &RatchetMessage{Header: header, Ciphertext: ciphertext}, nil
+}
+
+/**
+ * Decrypt decrypts a message, performing a Diffie-Hellman ratchet step when the peer's key changed.
+ * The session is left untouched if the message fails to authenticate.
+ * @param msg The ratchet message.
+ * @param ad The associated data used by the sender.
+ * @return The decrypted message.
+ */
+func (s *RatchetSession) Decrypt(msg *RatchetMessage, ad []byte) ([]byte, error) {
+	key := skippedKey{dh: string(msg.Header.DH), n: msg.Header.N}
+	if mk, ok := s.skipped[key]; ok {
+		plaintext, err := ratchetOpen(mk, msg.Ciphertext, ratchetAD(ad, msg.Header))
+		if err != nil {
+			return nil, err
+		}
+		delete(s.skipped, key)
+		return plaintext, nil
+	}
+
+	next := s.clone()
+	if next.dhr == nil || !bytes.Equal(msg.Header.DH, next.dhr.Bytes()) {
+		if err := next.skip(msg.Header.PN); err != nil {
+			return nil, err
+		}
+		if err := next.dhRatchet(msg.Header.DH); err != nil {
+			return nil, err
+		}
+	}
+	if err := next.skip(msg.Header.N); err != nil {
+		return nil, err
+	}
+
+	var mk []byte
+	next.ckr, mk = kdfChain(next.ckr)
+	next.nr++
+
+	plaintext, err := ratchetOpen(mk, msg.Ciphertext, ratchetAD(ad, msg.Header))
+	if err != nil {
+		return nil, err
+	}
+	*s = *next
+	return plaintext, nil
+}
+
+// skip stores the message keys of the receiving chain up to message number until.
+func (s *RatchetSession) skip(until uint32) error {
+	if s.ckr == nil {
+		return nil
+	}
+	if until > s.nr+RatchetMaxSkip {
+		return errors.New("too many skipped ratchet messages")
+	}
+	for s.nr < until {
+		var mk []byte
+		s.ckr, mk = kdfChain(s.ckr)
+		s.skipped[skippedKey{dh: string(s.dhr.Bytes()), n: s.nr}] = mk
+		s.nr++
+	}
+	for len(s.skipped) > RatchetMaxSkip {
+		for k := range s.skipped {
+			delete(s.skipped, k)
+			break
+		}
+	}
+	return nil
+}
+
+// dhRatchet moves to the peer's new ratchet key and starts new receiving and sending chains.
+func (s *RatchetSession) dhRatchet(remote []byte) error {
+	remoteKey, err := ecdh.X25519().NewPublicKey(remote)
+	if err != nil {
+		return fmt.Errorf("invalid ratchet public key: %w", err)
+	}
+
+	s.pn = s.ns
+	s.ns = 0
+	s.nr = 0
+	s.dhr = remoteKey
+
+	dh, err := s.dhs.ECDH(s.dhr)
+	if err != nil {
+		return fmt.Errorf("failed to compute ratchet step: %w", err)
+	}
+	if s.rk, s.ckr, err = kdfRoot(s.rk, dh); err != nil {
+		return err
+	}
+
+	if s.dhs, err = GenerateRatchetKey(); err != nil {
+		return err
+	}
+	dh, err = s.dhs.ECDH(s.dhr)
+	if err != nil {
+		return fmt.Errorf("failed to compute ratchet step: %w", err)
+	}
+	s.rk, s.cks, err = kdfRoot(s.rk, dh)
+	return err
+}
+
+func (s *RatchetSession) clone() *RatchetSession {
+	c := *s
+	c.skipped = make(map[skippedKey][]byte, len(s.skipped))
+	for k, v := range s.skipped {
+		c.skipped[k] = v
+	}
+	return &c
+}
+
+// kdfRoot derives a new root key and chain key from the current root key and a DH output.
+func kdfRoot(rk []byte, dh []byte) ([]byte, []byte, error) {
+	out := make([]byte, 64)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, dh, rk, ratchetRootInfo), out); err != nil {
+		return nil, nil, fmt.Errorf("failed to derive root key: %w", err)
+	}
+	return out[:32], out[32:], nil
+}
+
+// kdfChain advances a chain key and returns the next chain key and the message key.
+func kdfChain(ck []byte) ([]byte, []byte) {
+	mac := hmac.New(sha256.New, ck)
+	mac.Write([]byte{0x01})
+	mk := mac.Sum(nil)
+
+	mac = hmac.New(sha256.New, ck)
+	mac.Write([]byte{0x02})
+	return mac.Sum(nil), mk
+}
+
+func ratchetAD(ad []byte, header RatchetHeader) []byte {
+	out := make([]byte, 0, len(ad)+len(header.DH)+8)
+	out = append(out, ad...)
+	out = append(out, header.DH...)
+	out = binary.BigEndian.AppendUint32(out, header.PN)
+	return binary.BigEndian.AppendUint32(out, header.N)
+}
+
+// ratchetSeal encrypts with a single-use message key, so a zero nonce is safe.
+func ratchetSeal(mk []byte, plaintext []byte, ad []byte) ([]byte, error) {
+	aead, err := chacha20poly1305.New(mk)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create message cipher: %w", err)
+	}
+	return aead.Seal(nil, ratchetZeroNonce, plaintext, ad), nil
+}
+
+func ratchetOpen(mk []byte, ciphertext []byte, ad []byte) ([]byte, error) {
+	aead, err := chacha20poly1305.New(mk)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create message cipher: %w", err)
+	}
+	plaintext, err := aead.Open(nil, ratchetZeroNonce, ciphertext, ad)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt message: %w", err)
+	}
+	return plaintext, nil
+}
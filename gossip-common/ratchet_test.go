@@ -0,0 +1,199 @@
+package gossip_common
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+)
+
+// newRatchetPair sets up a session between a sender and a receiver the way two clients do after a handshake.
+func newRatchetPair(t *testing.T) (*RatchetSession, *RatchetSession) {
+	t.Helper()
+
+	alice, err := GenerateRatchetKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	bob, err := GenerateRatchetKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	aliceSecret, err := RatchetSharedSecret(alice, bob.PublicKey().Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	bobSecret, err := RatchetSharedSecret(bob, alice.PublicKey().Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(aliceSecret, bobSecret) {
+		t.Fatal("both sides must derive the same shared secret")
+	}
+
+	sender, err := NewRatchetSender(aliceSecret, bob.PublicKey().Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return sender, NewRatchetReceiver(bobSecret, bob)
+}
+
+// encryptAll encrypts numbered messages on a session.
+func encryptAll(t *testing.T, s *RatchetSession, count int, ad []byte) []*RatchetMessage {
+	t.Helper()
+
+	messages := make([]*RatchetMessage, count)
+	for i := range messages {
+		msg, err := s.Encrypt([]byte(fmt.Sprintf("message %d", i)), ad)
+		if err != nil {
+			t.Fatal(err)
+		}
+		messages[i] = msg
+	}
+	return messages
+}
+
+// expectDecrypt decrypts a message and checks it is the numbered one.
+func expectDecrypt(t *testing.T, s *RatchetSession, msg *RatchetMessage, ad []byte, n int) {
+	t.Helper()
+
+	plaintext, err := s.Decrypt(msg, ad)
+	if err != nil {
+		t.Fatalf("message %d: %v", n, err)
+	}
+	if want := fmt.Sprintf("message %d", n); string(plaintext) != want {
+		t.Fatalf("got %q, want %q", plaintext, want)
+	}
+}
+
+func TestRatchetRoundTrip(t *testing.T) {
+	alice, bob := newRatchetPair(t)
+	ad := []byte("alice:bob")
+
+	if bob.CanSend() {
+		t.Fatal("the receiver must not send before the first message arrives")
+	}
+	if _, err := bob.Encrypt([]byte("too early"), ad); err == nil {
+		t.Fatal("encrypting without a sending chain must fail")
+	}
+
+	// Change direction a few times so both sides perform Diffie-Hellman ratchet steps
+	for round := 0; round < 3; round++ {
+		for i, msg := range encryptAll(t, alice, 3, ad) {
+			expectDecrypt(t, bob, msg, ad, i)
+		}
+		if !bob.CanSend() {
+			t.Fatal("the receiver must be able to answer after the first message")
+		}
+		for i, msg := range encryptAll(t, bob, 2, ad) {
+			expectDecrypt(t, alice, msg, ad, i)
+		}
+	}
+}
+
+func TestRatchetKeysChangeEveryMessage(t *testing.T) {
+	alice, _ := newRatchetPair(t)
+
+	first, err := alice.Encrypt([]byte("same"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := alice.Encrypt([]byte("same"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Equal(first.Ciphertext, second.Ciphertext) {
+		t.Fatal("the same plaintext must encrypt differently under consecutive message keys")
+	}
+	if first.Header.N != 0 || second.Header.N != 1 {
+		t.Fatalf("message numbers %d and %d, want 0 and 1", first.Header.N, second.Header.N)
+	}
+}
+
+func TestRatchetOutOfOrder(t *testing.T) {
+	alice, bob := newRatchetPair(t)
+	ad := []byte("alice:bob")
+	messages := encryptAll(t, alice, 5, ad)
+
+	for _, n := range []int{3, 0, 4, 2, 1} {
+		expectDecrypt(t, bob, messages[n], ad, n)
+	}
+	if len(bob.skipped) != 0 {
+		t.Fatalf("%d skipped message keys left after every message arrived", len(bob.skipped))
+	}
+}
+
+func TestRatchetSkippedKeysAcrossRatchetSteps(t *testing.T) {
+	alice, bob := newRatchetPair(t)
+	ad := []byte("alice:bob")
+
+	// Bob misses the end of Alice's first chain, answers, and Alice starts a new chain
+	first := encryptAll(t, alice, 4, ad)
+	expectDecrypt(t, bob, first[0], ad, 0)
+	for i, msg := range encryptAll(t, bob, 1, ad) {
+		expectDecrypt(t, alice, msg, ad, i)
+	}
+	second := encryptAll(t, alice, 2, ad)
+
+	// The new chain's header carries the old chain's length, so its missing keys are kept
+	expectDecrypt(t, bob, second[1], ad, 1)
+	if len(bob.skipped) != 4 {
+		t.Fatalf("%d skipped message keys, want 3 from the old chain and 1 from the new one", len(bob.skipped))
+	}
+	expectDecrypt(t, bob, first[2], ad, 2)
+	expectDecrypt(t, bob, second[0], ad, 0)
+	expectDecrypt(t, bob, first[3], ad, 3)
+	expectDecrypt(t, bob, first[1], ad, 1)
+	if len(bob.skipped) != 0 {
+		t.Fatalf("%d skipped message keys left after every message arrived", len(bob.skipped))
+	}
+}
+
+func TestRatchetRejectsReplay(t *testing.T) {
+	alice, bob := newRatchetPair(t)
+	ad := []byte("alice:bob")
+	messages := encryptAll(t, alice, 2, ad)
+
+	expectDecrypt(t, bob, messages[0], ad, 0)
+	expectDecrypt(t, bob, messages[1], ad, 1)
+	if _, err := bob.Decrypt(messages[0], ad); err == nil {
+		t.Fatal("a message key must only be usable once")
+	}
+}
+
+func TestRatchetFailedDecryptLeavesSessionIntact(t *testing.T) {
+	alice, bob := newRatchetPair(t)
+	ad := []byte("alice:bob")
+	messages := encryptAll(t, alice, 3, ad)
+
+	if _, err := bob.Decrypt(messages[2], []byte("mallory:bob")); err == nil {
+		t.Fatal("decrypting with the wrong associated data must fail")
+	}
+	tampered := *messages[1]
+	tampered.Ciphertext = append([]byte(nil), messages[1].Ciphertext...)
+	tampered.Ciphertext[0] ^= 1
+	if _, err := bob.Decrypt(&tampered, ad); err == nil {
+		t.Fatal("decrypting a tampered message must fail")
+	}
+
+	// Neither failure may have consumed a key or skipped ahead
+	for i, msg := range messages {
+		expectDecrypt(t, bob, msg, ad, i)
+	}
+}
+
+func TestRatchetTooManySkipped(t *testing.T) {
+	alice, bob := newRatchetPair(t)
+	ad := []byte("alice:bob")
+
+	expectDecrypt(t, bob, encryptAll(t, alice, 1, ad)[0], ad, 0)
+
+	msg, err := alice.Encrypt([]byte("far ahead"), ad)
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg.Header.N = RatchetMaxSkip + 2
+	if _, err := bob.Decrypt(msg, ad); err == nil {
+		t.Fatal("a message too far ahead of the chain must be rejected")
+	}
+}
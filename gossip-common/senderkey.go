@@ -0,0 +1,223 @@
+package gossip_common
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+const (
+	senderKeyHeader  = 8 // Generation (4 bytes) followed by the iteration (4 bytes)
+	senderKeyMaxSkip = 2000
+)
+
+/**
+ * SenderKeyDistribution is sent to every channel member over their pairwise ratchet session
+ * so they can decrypt our channel messages from the given iteration onwards.
+ * @param Channel The channel the key is used in.
+ * @param Generation The key generation, bumped whenever the key is replaced.
+ * @param Iteration The chain position the chain key belongs to.
+ * @param ChainKey The chain key at that iteration.
+ * @param SigningKey The public key our channel messages are signed with.
+ */
+type SenderKeyDistribution struct {
+	Channel    string `json:"ch"`
+	Generation uint32 `json:"gen"`
+	Iteration  uint32 `json:"it"`
+	ChainKey   []byte `json:"ck"`
+	SigningKey []byte `json:"sk"`
+}
+
+/**
+ * SenderKey is our own sending chain for one channel. Each message advances the chain with
+ * a one-way function, so a key captured later cannot decrypt earlier messages.
+ */
+type SenderKey struct {
+	generation uint32
+	iteration  uint32
+	chainKey   []byte
+	signing    ed25519.PrivateKey
+}
+
+/**
+ * NewSenderKey creates a fresh sending chain.
+ * @param generation The generation number for the new key.
+ * @return The new sender key.
+ */
+func NewSenderKey(generation uint32) (*SenderKey, error) {
+	chainKey := make([]byte, 32)
+	if _, err := rand.Read(chainKey); err != nil {
+		return nil, fmt.Errorf("failed to generate sender key: %w", err)
+	}
+	_, signing, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate sender signing key: %w", err)
+	}
+	return &SenderKey{generation: generation, chainKey: chainKey, signing: signing}, nil
+}
+
+/**
+ * Generation returns the generation number of the key.
+ */
+func (k *SenderKey) Generation() uint32 {
+	return k.generation
+}
+
+/**
+ * Distribution returns the current chain state for sharing with a channel member.
+ * @param channel The channel the key is used in.
+ * @return The distribution message.
+ */
+func (k *SenderKey) Distribution(channel string) SenderKeyDistribution {
+	return SenderKeyDistribution{
+		Channel:    channel,
+		Generation: k.generation,
+		Iteration:  k.iteration,
+		ChainKey:   append([]byte(nil), k.chainKey...),
+		SigningKey: k.signing.Public().(ed25519.PublicKey),
+	}
+}
+
+/**
+ * Encrypt encrypts and signs a channel message, then advances the chain.
+ * @param plaintext The message to encrypt.
+ * @param ad Associated data bound to the message, such as the channel and sender.
+ * @return The header, ciphertext and signature.
+ */
+func (k *SenderKey) Encrypt(plaintext []byte, ad []byte) ([]byte, error) {
+	var mk []byte
+	iteration := k.iteration
+	k.chainKey, mk = kdfChain(k.chainKey)
+	k.iteration++
+
+	header := make([]byte, senderKeyHeader)
+	binary.BigEndian.PutUint32(header[0:4], k.generation)
+	binary.BigEndian.PutUint32(header[4:8], iteration)
+
+	ciphertext, err := ratchetSeal(mk, plaintext, append(append([]byte(nil), ad...), header...))
+	if err != nil {
+		return nil, err
+	}
+
+	msg := append(header, ciphertext...)
+	return append(msg, ed25519.Sign(k.signing, msg)...), nil
+}
+
+/**
+ * ParseSenderKeyHeader reads the generation and iteration of a channel message.
+ * @param msg The message produced by SenderKey.Encrypt.
+ * @return The generation and iteration.
+ */
+func ParseSenderKeyHeader(msg []byte) (uint32, uint32, error) {
+	if len(msg) < senderKeyHeader+ed25519.SignatureSize {
+		return 0, 0, errors.New("sender key message too short")
+	}
+	return binary.BigEndian.Uint32(msg[0:4]), binary.BigEndian.Uint32(msg[4:8]), nil
+}
+
+/**
+ * SenderKeyReceiver tracks a channel member's sending chain on our side.
+ */
+type SenderKeyReceiver struct {
+	generation uint32
+	iteration  uint32
+	chainKey   []byte
+	verify     ed25519.PublicKey
+	skipped    map[uint32][]byte
+}
+
+/**
+ * NewSenderKeyReceiver creates a receiving chain from a distribution message.
+ * @param d The distribution message from the channel member.
+ * @return The receiving chain.
+ */
+func NewSenderKeyReceiver(d SenderKeyDistribution) (*SenderKeyReceiver, error) {
+	if len(d.ChainKey) != 32 || len(d.SigningKey) != ed25519.PublicKeySize {
+		return nil, errors.New("invalid sender key distribution")
+	}
+	return &SenderKeyReceiver{
+		generation: d.Generation,
+		iteration:  d.Iteration,
+		chainKey:   d.ChainKey,
+		verify:     ed25519.PublicKey(d.SigningKey),
+		skipped:    make(map[uint32][]byte),
+	}, nil
+}
+
+/**
+ * Generation returns the generation number of the chain.
+ */
+func (r *SenderKeyReceiver) Generation() uint32 {
+	return r.generation
+}
+
+/**
+ * Decrypt verifies and decrypts a channel message, advancing the chain past it.
+ * The chain is left untouched if the message fails to authenticate.
+ * @param msg The message produced by SenderKey.Encrypt.
+ * @param ad The associated data used by the sender.
+ * @return The decrypted message.
+ */
+func (r *SenderKeyReceiver) Decrypt(msg []byte, ad []byte) ([]byte, error) {
+	generation, iteration, err := ParseSenderKeyHeader(msg)
+	if err != nil {
+		return nil, err
+	}
+	if generation != r.generation {
+		return nil, fmt.Errorf("sender key generation %d does not match %d", generation, r.generation)
+	}
+
+	body := msg[:len(msg)-ed25519.SignatureSize]
+	if !ed25519.Verify(r.verify, body, msg[len(body):]) {
+		return nil, errors.New("invalid sender key signature")
+	}
+
+	header := body[:senderKeyHeader]
+	ad = append(append([]byte(nil), ad...), header...)
+
+	if iteration < r.iteration {
+		mk, ok := r.skipped[iteration]
+		if !ok {
+			return nil, errors.New("sender key message is a replay or too old")
+		}
+		plaintext, err := ratchetOpen(mk, body[senderKeyHeader:], ad)
+		if err != nil {
+			return nil, err
+		}
+		delete(r.skipped, iteration)
+		return plaintext, nil
+	}
+
+	if iteration-r.iteration > senderKeyMaxSkip {
+		return nil, errors.New("too many skipped sender key messages")
+	}
+
+	// Advance a copy of the chain so a message that fails to open leaves ours untouched
+	chainKey := r.chainKey
+	skipped := make(map[uint32][]byte, iteration-r.iteration)
+	for i := r.iteration; i < iteration; i++ {
+		chainKey, skipped[i] = kdfChain(chainKey)
+	}
+	var mk []byte
+	chainKey, mk = kdfChain(chainKey)
+
+	plaintext, err := ratchetOpen(mk, body[senderKeyHeader:], ad)
+	if err != nil {
+		return nil, err
+	}
+
+	r.chainKey = chainKey
+	r.iteration = iteration + 1
+	for i, key := range skipped {
+		r.skipped[i] = key
+	}
+	for len(r.skipped) > senderKeyMaxSkip {
+		for k := range r.skipped {
+			delete(r.skipped, k)
+			break
+		}
+	}
+	return plaintext, nil
+}
@@ -0,0 +1,166 @@
+package gossip_common
+
+import (
+	"fmt"
+	"testing"
+)
+
+// newSenderKeyPair creates a sender key and a member's receiving chain from its distribution.
+func newSenderKeyPair(t *testing.T) (*SenderKey, *SenderKeyReceiver) {
+	t.Helper()
+
+	key, err := NewSenderKey(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	receiver, err := NewSenderKeyReceiver(key.Distribution("general"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key, receiver
+}
+
+// encryptChannel encrypts numbered channel messages.
+func encryptChannel(t *testing.T, key *SenderKey, count int, ad []byte) [][]byte {
+	t.Helper()
+
+	messages := make([][]byte, count)
+	for i := range messages {
+		msg, err := key.Encrypt([]byte(fmt.Sprintf("message %d", i)), ad)
+		if err != nil {
+			t.Fatal(err)
+		}
+		messages[i] = msg
+	}
+	return messages
+}
+
+// expectChannelDecrypt decrypts a channel message and checks it is the numbered one.
+func expectChannelDecrypt(t *testing.T, r *SenderKeyReceiver, msg []byte, ad []byte, n int) {
+	t.Helper()
+
+	plaintext, err := r.Decrypt(msg, ad)
+	if err != nil {
+		t.Fatalf("message %d: %v", n, err)
+	}
+	if want := fmt.Sprintf("message %d", n); string(plaintext) != want {
+		t.Fatalf("got %q, want %q", plaintext, want)
+	}
+}
+
+func TestSenderKeyRoundTrip(t *testing.T) {
+	key, receiver := newSenderKeyPair(t)
+	ad := []byte("general:alice")
+
+	for i, msg := range encryptChannel(t, key, 5, ad) {
+		generation, iteration, err := ParseSenderKeyHeader(msg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if generation != 1 || iteration != uint32(i) {
+			t.Fatalf("header generation %d iteration %d, want 1 and %d", generation, iteration, i)
+		}
+		expectChannelDecrypt(t, receiver, msg, ad, i)
+	}
+}
+
+func TestSenderKeyOutOfOrder(t *testing.T) {
+	key, receiver := newSenderKeyPair(t)
+	ad := []byte("general:alice")
+	messages := encryptChannel(t, key, 6, ad)
+
+	for _, n := range []int{4, 1, 0, 5, 3, 2} {
+		expectChannelDecrypt(t, receiver, messages[n], ad, n)
+	}
+	if len(receiver.skipped) != 0 {
+		t.Fatalf("%d skipped message keys left after every message arrived", len(receiver.skipped))
+	}
+	if _, err := receiver.Decrypt(messages[3], ad); err == nil {
+		t.Fatal("a replayed message must be rejected")
+	}
+}
+
+func TestSenderKeyLateJoiner(t *testing.T) {
+	key, err := NewSenderKey(3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ad := []byte("general:alice")
+	before := encryptChannel(t, key, 3, ad)
+
+	// A member who joins now gets the chain from the current iteration and cannot read earlier messages
+	receiver, err := NewSenderKeyReceiver(key.Distribution("general"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := receiver.Decrypt(before[2], ad); err == nil {
+		t.Fatal("a message from before the distribution must not decrypt")
+	}
+	msg, err := key.Encrypt([]byte("after"), ad)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if plaintext, err := receiver.Decrypt(msg, ad); err != nil || string(plaintext) != "after" {
+		t.Fatalf("got %q, %v", plaintext, err)
+	}
+}
+
+func TestSenderKeyRejectsForgery(t *testing.T) {
+	key, receiver := newSenderKeyPair(t)
+	ad := []byte("general:alice")
+	messages := encryptChannel(t, key, 2, ad)
+
+	tampered := append([]byte(nil), messages[0]...)
+	tampered[senderKeyHeader] ^= 1
+	if _, err := receiver.Decrypt(tampered, ad); err == nil {
+		t.Fatal("a tampered message must fail the signature check")
+	}
+	if _, err := receiver.Decrypt(messages[0], []byte("general:mallory")); err == nil {
+		t.Fatal("decrypting with the wrong associated data must fail")
+	}
+
+	// A different key of the same generation cannot sign for this sender
+	other, err := NewSenderKey(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	forged, err := other.Encrypt([]byte("forged"), ad)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := receiver.Decrypt(forged, ad); err == nil {
+		t.Fatal("a message signed by another key must be rejected")
+	}
+
+	// Message 0 was never consumed, so it still decrypts
+	expectChannelDecrypt(t, receiver, messages[0], ad, 0)
+	expectChannelDecrypt(t, receiver, messages[1], ad, 1)
+}
+
+func TestSenderKeyGeneration(t *testing.T) {
+	_, receiver := newSenderKeyPair(t)
+
+	next, err := NewSenderKey(2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg, err := next.Encrypt([]byte("rekeyed"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := receiver.Decrypt(msg, nil); err == nil {
+		t.Fatal("a message from another generation must be rejected")
+	}
+}
+
+func TestSenderKeyInvalidDistribution(t *testing.T) {
+	key, err := NewSenderKey(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := key.Distribution("general")
+	d.ChainKey = d.ChainKey[:16]
+	if _, err := NewSenderKeyReceiver(d); err == nil {
+		t.Fatal("a short chain key must be rejected")
+	}
+}
@@ -0,0 +1,139 @@
+package gossip_common
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sync/atomic"
+
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+const (
+	SessionKeySize     = chacha20poly1305.KeySize // Size of a symmetric session key in bytes
+	SessionFrameHeader = 12                       // Epoch (4 bytes) followed by the frame counter (8 bytes)
+)
+
+/**
+ * GenerateSessionKey generates a random symmetric key for sealing stream frames.
+ * @return The new key and an error if the system random source fails.
+ */
+func GenerateSessionKey() ([]byte, error) {
+	key := make([]byte, SessionKeySize)
+	if _, err := rand.Read(key); err != nil {
+		return nil, fmt.Errorf("failed to generate session key: %w", err)
+	}
+	return key, nil
+}
+
+/**
+ * SealFrame encrypts a single stream frame with ChaCha20-Poly1305.
+ * The epoch and counter form the nonce and are sent in clear as the frame header,
+ * so a key must never be used twice with the same counter.
+ * @param key The session key for the epoch.
+ * @param epoch The key epoch, incremented on every rekey.
+ * @param counter The per-frame counter within the epoch.
+ * @param plaintext The frame to encrypt.
+ * @return The header followed by the ciphertext.
+ */
+func SealFrame(key []byte, epoch uint32, counter uint64, plaintext []byte) ([]byte, error) {
+	aead, err := chacha20poly1305.New(key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create frame cipher: %w", err)
+	}
+
+	frame := make([]byte, SessionFrameHeader, SessionFrameHeader+len(plaintext)+aead.Overhead())
+	binary.BigEndian.PutUint32(frame[0:4], epoch)
+	binary.BigEndian.PutUint64(frame[4:12], counter)
+
+	return aead.Seal(frame, frame[:SessionFrameHeader], plaintext, frame[:SessionFrameHeader]), nil
+}
+
+/**
+ * ParseFrameHeader reads the epoch and counter of a sealed frame without decrypting it.
+ * @param frame The sealed frame.
+ * @return The epoch, the counter and an error if the frame is too short.
+ */
+func ParseFrameHeader(frame []byte) (uint32, uint64, error) {
+	if len(frame) < SessionFrameHeader {
+		return 0, 0, errors.New("frame too short")
+	}
+	return binary.BigEndian.Uint32(frame[0:4]), binary.BigEndian.Uint64(frame[4:12]), nil
+}
+
+/**
+ * OpenFrame authenticates and decrypts a frame produced by SealFrame.
+ * @param key The session key for the frame's epoch.
+ * @param frame The sealed frame.
+ * @return The decrypted frame.
+ */
+func OpenFrame(key []byte, frame []byte) ([]byte, error) {
+	if len(frame) < SessionFrameHeader {
+		return nil, errors.New("frame too short")
+	}
+
+	aead, err := chacha20poly1305.New(key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create frame cipher: %w", err)
+	}
+
+	header := frame[:SessionFrameHeader]
+	plaintext, err := aead.Open(nil, header, frame[SessionFrameHeader:], header)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open frame: %w", err)
+	}
+	return plaintext, nil
+}
+
+const (
+	streamEpochClient = 0 // Epoch of stream packets a client sends to the server
+	streamEpochServer = 1 // Epoch of stream packets the server sends to a client
+)
+
+/**
+ * StreamCipher seals the stream packets exchanged between a client and the server with the
+ * session key the client sent once after logging in, so frames need no public key operations.
+ * Each direction uses its own epoch, so the two sides never produce the same nonce.
+ */
+type StreamCipher struct {
+	key         []byte
+	sendEpoch   uint32
+	openEpoch   uint32
+	sendCounter atomic.Uint64
+}
+
+/**
+ * NewStreamCipher creates the cipher for one side of a connection.
+ * @param key The session key from GenerateSessionKey.
+ * @param client True on the client, false on the server.
+ * @return The cipher and an error if the key has the wrong size.
+ */
+func NewStreamCipher(key []byte, client bool) (*StreamCipher, error) {
+	if len(key) != SessionKeySize {
+		return nil, fmt.Errorf("session key must be %d bytes, got %d", SessionKeySize, len(key))
+	}
+
+	cipher := &StreamCipher{key: key, sendEpoch: streamEpochServer, openEpoch: streamEpochClient}
+	if client {
+		cipher.sendEpoch, cipher.openEpoch = streamEpochClient, streamEpochServer
+	}
+	return cipher, nil
+}
+
+// Seal encrypts a packet for the other side with the next counter.
+func (c *StreamCipher) Seal(plaintext []byte) ([]byte, error) {
+	return SealFrame(c.key, c.sendEpoch, c.sendCounter.Add(1), plaintext)
+}
+
+// Open decrypts a packet sealed by the other side.
+func (c *StreamCipher) Open(frame []byte) ([]byte, error) {
+	epoch, _, err := ParseFrameHeader(frame)
+	if err != nil {
+		return nil, err
+	}
+	if epoch != c.openEpoch {
+		return nil, errors.New("frame sealed for the wrong direction")
+	}
+	return OpenFrame(c.key, frame)
+}
@@ -1,8 +1,9 @@
 package gossip_common
 
 import (
+	"crypto/rand"
 	"log"
-	"math/rand"
+	"math/big"
 	"os"
 	"time"
 
@@ -94,31 +95,29 @@ func Dbg(format string, a ...interface{}) {
 }
 
 /**
- * GenerateID generates a random string of a specified length.
+ * GenerateID generates a random client ID of a specified length and stores it.
  * @param length The length of the string to generate.
- * @return A random string of the specified length.
  */
 func GenerateID(length int) {
-	const charset = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789"
-	var seededRand *rand.Rand = rand.New(rand.NewSource(time.Now().UnixNano()))
-	b := make([]byte, length)
-	for i := range b {
-		b[i] = charset[seededRand.Intn(len(charset))]
-	}
-	cID = string(b)
+	cID = ReturnRandomID(length)
 }
 
 /**
- * GenerateID generates a random string of a specified length.
+ * ReturnRandomID generates a random string of a specified length using the system's
+ * cryptographically secure random source, so IDs cannot be predicted or collide by timing.
  * @param length The length of the string to generate.
  * @return A random string of the specified length.
  */
 func ReturnRandomID(length int) string {
 	const charset = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789"
-	var seededRand *rand.Rand = rand.New(rand.NewSource(time.Now().UnixNano()))
+	max := big.NewInt(int64(len(charset)))
 	b := make([]byte, length)
 	for i := range b {
-		b[i] = charset[seededRand.Intn(len(charset))]
+		n, err := rand.Int(rand.Reader, max)
+		if err != nil {
+			panic("gossip: system random source failed: " + err.Error())
+		}
+		b[i] = charset[n.Int64()]
 	}
 	return string(b)
 }
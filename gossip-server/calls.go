@@ -0,0 +1,303 @@
+package main
+
+import (
+	"encoding/json"
+	"time"
+
+	"gossip_common"
+)
+
+const (
+	callParticipantTimeout = 90 * time.Second // Participants that stop sending call_ping are dropped after this long
+	callSweepInterval      = 30 * time.Second // How often stale participants are looked for
+)
+
+// activeCall tracks who is in a call and when they were last heard from.
+type activeCall struct {
+	participants []string
+	joined       map[string]time.Time
+	lastSeen     map[string]time.Time
+	started      time.Time
+}
+
+func newActiveCall() *activeCall {
+	return &activeCall{
+		joined:   make(map[string]time.Time),
+		lastSeen: make(map[string]time.Time),
+		started:  time.Now(),
+	}
+}
+
+// add puts a client in the call, or refreshes them if they are already in it.
+func (c *activeCall) add(clientID string) {
+	if _, exists := c.joined[clientID]; !exists {
+		c.participants = append(c.participants, clientID)
+		c.joined[clientID] = time.Now()
+	}
+	c.lastSeen[clientID] = time.Now()
+}
+
+// remove takes a client out of the call and reports whether they were in it.
+func (c *activeCall) remove(clientID string) bool {
+	if _, exists := c.joined[clientID]; !exists {
+		return false
+	}
+	remaining := []string{}
+	for _, participant := range c.participants {
+		if participant != clientID {
+			remaining = append(remaining, participant)
+		}
+	}
+	c.participants = remaining
+	delete(c.joined, clientID)
+	delete(c.lastSeen, clientID)
+	return true
+}
+
+/**
+ * startCall creates a call with its first participant, or joins it if it already exists.
+ * @param callID The call to start.
+ * @param clientID The client starting the call.
+ */
+func startCall(callID string, clientID string) {
+	activeCallsLock.Lock()
+	call, exists := activeCalls[callID]
+	if !exists {
+		call = newActiveCall()
+		activeCalls[callID] = call
+	}
+	call.add(clientID)
+	activeCallsLock.Unlock()
+
+	if exists {
+		broadcastToCall(callID, clientID, "call_join", clientID, []byte(callID))
+	}
+}
+
+/**
+ * joinCall adds a client to an existing call and tells the other participants.
+ * @param callID The call to join.
+ * @param clientID The joining client.
+ * @return The participants that were already in the call, and false if the call does not exist.
+ */
+func joinCall(callID string, clientID string) ([]string, bool) {
+	activeCallsLock.Lock()
+	call, ok := activeCalls[callID]
+	if !ok {
+		activeCallsLock.Unlock()
+		return nil, false
+	}
+	others := []string{}
+	for _, participant := range call.participants {
+		if participant != clientID {
+			others = append(others, participant)
+		}
+	}
+	call.add(clientID)
+	activeCallsLock.Unlock()
+
+	broadcastToCall(callID, clientID, "call_join", clientID, []byte(callID))
+	return others, true
+}
+
+/**
+ * touchCall records that a participant is still in a call.
+ * @param callID The call the heartbeat is for.
+ * @param clientID The participant sending it.
+ * @return false if the client is not in the call.
+ */
+func touchCall(callID string, clientID string) bool {
+	activeCallsLock.Lock()
+	defer activeCallsLock.Unlock()
+
+	call, ok := activeCalls[callID]
+	if !ok {
+		return false
+	}
+	if _, exists := call.joined[clientID]; !exists {
+		return false
+	}
+	call.lastSeen[clientID] = time.Now()
+	return true
+}
+
+/**
+ * leaveCall removes a client from a call, tells the remaining participants and ends the call
+ * for everyone once fewer than two are left in it.
+ * @param callID The call to leave.
+ * @param clientID The leaving client.
+ */
+func leaveCall(callID string, clientID string) {
+	activeCallsLock.Lock()
+	call, ok := activeCalls[callID]
+	if !ok || !call.remove(clientID) {
+		activeCallsLock.Unlock()
+		return
+	}
+
+	if len(call.participants) > 1 {
+		activeCallsLock.Unlock()
+
+		broadcastToCall(callID, "", "call_leave", clientID, []byte(callID))
+		return
+	}
+
+	// Nobody is left to talk to, so end the call for the leaver and whoever is still in it
+	remaining := append([]string{clientID}, call.participants...)
+	delete(activeCalls, callID)
+	activeCallsLock.Unlock()
+
+	for _, participant := range remaining {
+		endedPacket := gossip_common.NewSignalPacketFromData("call_ended", participant, "", []byte(callID))
+		if err := sendSignalToClient(participant, endedPacket); err != nil {
+			gossip_common.Err("Failed to send call_ended to %s: %v", participant, err)
+		}
+	}
+	cancelInvites(callID)
+
+	if debugLogging {
+		gossip_common.Dbg("Call %s ended", callID)
+	}
+}
+
+/**
+ * leaveAllCalls removes a client from every call it is in, used when its connection drops.
+ * @param clientID The client that went away.
+ */
+func leaveAllCalls(clientID string) {
+	activeCallsLock.RLock()
+	callIDs := []string{}
+	for callID, call := range activeCalls {
+		if _, exists := call.joined[clientID]; exists {
+			callIDs = append(callIDs, callID)
+		}
+	}
+	activeCallsLock.RUnlock()
+
+	for _, callID := range callIDs {
+		leaveCall(callID, clientID)
+		if debugLogging {
+			gossip_common.Dbg("Removed %s from call %s", clientID, callID)
+		}
+	}
+}
+
+/**
+ * expireStaleCalls periodically drops participants that stopped sending heartbeats,
+ * which ends calls left with nobody in them.
+ */
+func expireStaleCalls() {
+	ticker := time.NewTicker(callSweepInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		type staleParticipant struct{ callID, clientID string }
+		stale := []staleParticipant{}
+
+		activeCallsLock.Lock()
+		for callID, call := range activeCalls {
+			for clientID, lastSeen := range call.lastSeen {
+				if time.Since(lastSeen) > callParticipantTimeout {
+					stale = append(stale, staleParticipant{callID, clientID})
+				}
+			}
+			if len(call.participants) == 0 {
+				delete(activeCalls, callID)
+				go cancelInvites(callID)
+			}
+		}
+		activeCallsLock.Unlock()
+
+		for _, p := range stale {
+			if connectionLogging {
+				gossip_common.Conn("Client %s timed out of call %s", p.clientID, p.callID)
+			}
+			leaveCall(p.callID, p.clientID)
+		}
+	}
+}
+
+/**
+ * listActiveCalls describes every active call. Call IDs are secrets that let anyone join,
+ * so they are only filled in for calls the requesting client is in or has been invited to.
+ * @param clientID The client asking for the list.
+ * @return The summaries.
+ */
+func listActiveCalls(clientID string) []gossip_common.CallSummary {
+	activeCallsLock.RLock()
+	defer activeCallsLock.RUnlock()
+
+	summaries := []gossip_common.CallSummary{}
+	for callID, call := range activeCalls {
+		summary := gossip_common.CallSummary{
+			Started:  call.started.Unix(),
+			Duration: int64(time.Since(call.started).Seconds()),
+		}
+		for _, participant := range call.participants {
+			summary.Participants = append(summary.Participants, gossip_common.CallParticipantSummary{
+				ID:     participant,
+				Joined: call.joined[participant].Unix(),
+			})
+		}
+		if _, inCall := call.joined[clientID]; inCall || hasPendingInvite(callID, clientID) {
+			summary.CallID = callID
+		}
+		summaries = append(summaries, summary)
+	}
+	return summaries
+}
+
+/**
+ * sendActiveCalls answers an "lsc" request with a "calls" packet.
+ * @param clientID The client asking for the list.
+ */
+func sendActiveCalls(clientID string) {
+	payload, err := json.Marshal(listActiveCalls(clientID))
+	if err != nil {
+		gossip_common.Err("Failed to marshal active calls: %v", err)
+		return
+	}
+	callsPacket := gossip_common.NewSignalPacketFromData("calls", clientID, "", payload)
+	if err := sendSignalToClient(clientID, callsPacket); err != nil {
+		gossip_common.Err("Failed to send active calls to %s: %v", clientID, err)
+	}
+}
+
+// callParticipants returns the clients currently in a call.
+func callParticipants(callID string) []string {
+	activeCallsLock.RLock()
+	defer activeCallsLock.RUnlock()
+
+	call, ok := activeCalls[callID]
+	if !ok {
+		return nil
+	}
+	return append([]string{}, call.participants...)
+}
+
+/**
+ * broadcastToCall sends a signal packet to every participant of a call.
+ * @param callID The call whose participants receive the packet.
+ * @param except A participant to skip, or an empty string.
+ * @param opCmd The operation command.
+ * @param sender The client the packet is about.
+ * @param payload The packet payload.
+ */
+func broadcastToCall(callID string, except string, opCmd string, sender string, payload []byte) {
+	activeCallsLock.RLock()
+	participants := []string{}
+	if call, ok := activeCalls[callID]; ok {
+		participants = append(participants, call.participants...)
+	}
+	activeCallsLock.RUnlock()
+
+	for _, participant := range participants {
+		if participant == except {
+			continue
+		}
+		packet := gossip_common.NewSignalPacketFromData(opCmd, participant, sender, payload)
+		if err := sendSignalToClient(participant, packet); err != nil {
+			gossip_common.Err("Failed to send %s to %s: %v", opCmd, participant, err)
+		}
+	}
+}
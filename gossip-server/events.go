@@ -3,13 +3,15 @@ package main
 import (
 	"bufio"
 	"encoding/base64"
+	"encoding/json"
+	"fmt"
 	"net"
 	"sync"
 
 	"gossip_common"
 )
 
-var activeCalls = make(map[string][]string)
+var activeCalls = make(map[string]*activeCall)
 var activeCallsLock = sync.RWMutex{}
 
 // boot listens for incoming connections and processes them.
@@ -37,18 +39,17 @@ func handleConnection(conn net.Conn) {
 
 	scanner := bufio.NewScanner(conn)
 	clientID := ""
+	authenticated := false
+	challenge := ""
 	var clientPublicKey []byte
 
 	defer func() {
-		if clientID != "" {
-			connectionsLock.Lock()
-			delete(connections, clientID)
-			delete(publicKeys, clientID)
-			connectionsLock.Unlock()
+		// Only a connection that completed the login was registered under its client ID
+		if authenticated {
+			unregisterClient(clientID)
 			if connectionLogging {
 				gossip_common.Conn("Client %s unregistered due to connection termination", clientID)
 			}
-			sendRMKPackets(clientID)
 		}
 	}()
 
@@ -68,34 +69,74 @@ func handleConnection(conn net.Conn) {
 				continue
 			}
 		} else if message[0] == '1' {
-			go handleDataPacket([]byte(message[1:]))
+			if !authenticated {
+				gossip_common.Err("Ignoring GMDataPacket from unauthenticated connection %v", conn.RemoteAddr())
+				continue
+			}
+			// Handled in order, since ratchet messages from one sender must arrive in sequence
+			handleDataPacket(clientID, []byte(message[1:]))
 			continue
 		} else if message[0] == '2' {
-			go handleStreamPacket([]byte(message[1:]))
+			if !authenticated {
+				gossip_common.Err("Ignoring GMStreamPacket from unauthenticated connection %v", conn.RemoteAddr())
+				continue
+			}
+			go handleStreamPacket(clientID, []byte(message[1:]))
 			continue
 		} else {
 			gossip_common.Err("Unknown packet type prefix: %v", message[0])
 			continue
 		}
 
+		// Identity comes only from the greeting on this connection, never from later packets
+		if packet.OpCmd != "grtng" {
+			if clientID == "" || (packet.OpCmd != "ighru" && !authenticated) {
+				gossip_common.Err("Ignoring %s from unauthenticated connection %v", packet.OpCmd, conn.RemoteAddr())
+				continue
+			}
+			if packet.Sender != "" && packet.Sender != clientID {
+				gossip_common.Err("Rejected %s from %s claiming to be %s", packet.OpCmd, clientID, packet.Sender)
+				continue
+			}
+		}
+
 		switch packet.OpCmd {
 
 		case "grtng":
+			if clientID != "" {
+				gossip_common.Err("Ignoring repeated greeting from %s", clientID)
+				continue
+			}
+
+			// The client ID must be the fingerprint of the key it registers with
+			keyID, err := gossip_common.ClientIDFromPublicKey(packet.Payload)
+			if err != nil || keyID != packet.Sender {
+				gossip_common.Err("Rejected greeting from %v: client ID %s does not match its public key", conn.RemoteAddr(), packet.Sender)
+				sendForbidden(writer, packet.Sender)
+				return
+			}
 
-			// Register client connection
+			// Turn away a client ID that is already registered before doing any more work
+			connectionsLock.RLock()
+			_, taken := connections[packet.Sender]
+			connectionsLock.RUnlock()
+			if taken {
+				gossip_common.Err("Rejected greeting from %v: client ID %s is already registered", conn.RemoteAddr(), packet.Sender)
+				sendConflict(writer, packet.Sender)
+				return
+			}
+
+			// The client is only registered once it has signed this challenge and given the password
 			clientID = packet.Sender
 			clientPublicKey = packet.Payload
+			challenge = gossip_common.ReturnRandomID(32)
 
-			connectionsLock.Lock()
-			connections[clientID] = conn
-			publicKeys[clientID] = clientPublicKey
-			connectionsLock.Unlock()
-			if connectionLogging {
-				gossip_common.Conn("Client %s registered with public key", clientID)
+			challengePacket := gossip_common.NewSignalPacketFromData("chlg", clientID, serverName, []byte(challenge))
+			if err := gossip_common.SendSignalPacket(writer, challengePacket); err != nil {
+				gossip_common.Err("Failed to send challenge to %s: %v", clientID, err)
+				return
 			}
 
-			sendKeyToOtherClients(clientID, clientPublicKey)
-
 			// Send HRU
 			responsePacket := gossip_common.NewSignalPacketFromData("hru", clientID, serverName, gossip_common.RetrievePublicKey())
 			if err := gossip_common.SendSignalPacket(writer, responsePacket); err != nil {
@@ -104,20 +145,31 @@ func handleConnection(conn net.Conn) {
 			}
 
 			if debugLogging {
-				gossip_common.Dbg("Sent HRU response to %s", clientID)
+				gossip_common.Dbg("Sent challenge and HRU response to %s", clientID)
 			}
 
 		case "ighru":
-			// Decrypt the payload
-			decryptedMsg, err := gossip_common.GWDecrypt(packet.Payload)
-			if err != nil {
-				gossip_common.Err("Failed to decrypt IGHRU message from %s: %v", clientID, err)
+			if authenticated {
+				gossip_common.Err("Ignoring repeated IGHRU from %s", clientID)
 				continue
 			}
 
-			clientPassword := string(decryptedMsg)
+			// The proof must be signed by the key the client greeted with
+			decryptedMsg, err := gossip_common.GWDecryptVerified(packet.Payload, clientPublicKey)
+			if err != nil {
+				gossip_common.Err("Rejected IGHRU from %s: %v", clientID, err)
+				sendForbidden(writer, clientID)
+				return
+			}
+
+			var proof gossip_common.LoginProof
+			if err := json.Unmarshal(decryptedMsg, &proof); err != nil || proof.Challenge != challenge {
+				gossip_common.Err("Rejected IGHRU from %s: the challenge does not match", clientID)
+				sendForbidden(writer, clientID)
+				return
+			}
 
-			if clientPassword != password {
+			if proof.Password != password {
 				gossip_common.Err("Failed to authenticate client %s", clientID)
 
 				// Send 401
@@ -138,8 +190,25 @@ func handleConnection(conn net.Conn) {
 				gossip_common.Dbg("Correct IGHRU response received from %s", clientID)
 			}
 
+			// Register the client only now that it has proven its key and the server password
+			connectionsLock.Lock()
+			if _, taken := connections[clientID]; taken {
+				connectionsLock.Unlock()
+				gossip_common.Err("Rejected login from %v: client ID %s is already registered", conn.RemoteAddr(), clientID)
+				sendConflict(writer, clientID)
+				return
+			}
+			connections[clientID] = conn
+			publicKeys[clientID] = clientPublicKey
+			connectionsLock.Unlock()
+			authenticated = true
+			if connectionLogging {
+				gossip_common.Conn("Client %s registered with public key", clientID)
+			}
+			sendKeyToOtherClients(clientID, clientPublicKey)
+
 			// Encrypt the payload "I'm good!" with the client's public key
-			encryptedMsg, err := gossip_common.GWEncrypt([]byte("I'm good!"), publicKeys[clientID])
+			encryptedMsg, err := gossip_common.GWEncrypt([]byte("I'm good!"), clientPublicKey)
 			if err != nil {
 				gossip_common.Err("Failed to encrypt IG message for %s: %v", clientID, err)
 				continue
@@ -159,8 +228,6 @@ func handleConnection(conn net.Conn) {
 			}
 
 		case "gmk":
-			clientID = packet.Sender
-
 			// Then, send all other clients' public keys to the requesting client
 			for id, key := range publicKeys {
 				// Encrypt each public key with the requesting client's public key
@@ -207,6 +274,11 @@ func handleConnection(conn net.Conn) {
 				}
 			}
 
+			// Tell the client which STUN and TURN servers to use for calls
+			if err := sendICEServers(writer, clientID, publicKeys[clientID]); err != nil {
+				gossip_common.Err("Failed to send ICE servers to %s: %v", clientID, err)
+			}
+
 			// Once all keys have been sent, send an "eok" (end of keys) signal packet to the requesting client
 			eokPacket := gossip_common.NewSignalPacketFromData("eok", clientID, "", []byte(""))
 			if err := gossip_common.SendSignalPacket(writer, eokPacket); err != nil {
@@ -216,10 +288,32 @@ func handleConnection(conn net.Conn) {
 			if debugLogging {
 				gossip_common.Dbg("Sent EOK to %s", clientID)
 			}
+		case "skey": // session key for stream packets
+			sessionKey, err := gossip_common.GWDecrypt(packet.Payload)
+			if err != nil {
+				gossip_common.Err("Failed to decrypt session key from %s: %v", clientID, err)
+				continue
+			}
+			cipher, err := gossip_common.NewStreamCipher(sessionKey, false)
+			if err != nil {
+				gossip_common.Err("Rejected session key from %s: %v", clientID, err)
+				continue
+			}
+
+			connectionsLock.Lock()
+			streamCiphers[clientID] = cipher
+			connectionsLock.Unlock()
+			if debugLogging {
+				gossip_common.Dbg("Stored session key of %s", clientID)
+			}
+
+		case "ice_request": // fresh ICE servers and relay credentials before a call
+			if err := sendICEServers(writer, clientID, publicKeys[clientID]); err != nil {
+				gossip_common.Err("Failed to send ICE servers to %s: %v", clientID, err)
+			}
+
 		case "start_call":
-			activeCallsLock.Lock()
-			activeCalls[string(packet.Payload)] = append(activeCalls[string(packet.Payload)], packet.Sender)
-			activeCallsLock.Unlock()
+			startCall(string(packet.Payload), clientID)
 
 			csPacket := gossip_common.NewSignalPacketFromData("call_active", clientID, "", []byte(""))
 			if err := gossip_common.SendSignalPacket(writer, csPacket); err != nil {
@@ -231,8 +325,8 @@ func handleConnection(conn net.Conn) {
 			}
 
 		case "gmp": // give me participents
-			// Check if the call ID exists in activeCalls
-			if _, ok := activeCalls[string(packet.Payload)]; !ok {
+			others, ok := joinCall(string(packet.Payload), clientID)
+			if !ok {
 				// If the call ID doesn't exist, send a "c404" (call not found) signal packet to the requesting client
 				c404Packet := gossip_common.NewSignalPacketFromData("c404", clientID, "", []byte(""))
 				if err := gossip_common.SendSignalPacket(writer, c404Packet); err != nil {
@@ -243,110 +337,79 @@ func handleConnection(conn net.Conn) {
 					gossip_common.Dbg("Sent c404 to %s", clientID)
 				}
 			} else {
-				activeCalls[string(packet.Payload)] = append(activeCalls[string(packet.Payload)], packet.Sender)
 				// Send each participant in its own packet
-				for _, participant := range activeCalls[string(packet.Payload)] {
-					if participant != packet.Sender {
-						participantPacket := gossip_common.NewSignalPacketFromData("participent", participant, packet.Sender, []byte(participant))
-						if err := gossip_common.SendSignalPacket(writer, participantPacket); err != nil {
-							gossip_common.Err("Failed to send participant packet to %s: %v", clientID, err)
-							continue
-						}
-						if debugLogging {
-							gossip_common.Dbg("Sent participant %s to %s", participant, clientID)
-						}
+				for _, participant := range others {
+					participantPacket := gossip_common.NewSignalPacketFromData("participent", participant, clientID, []byte(participant))
+					if err := gossip_common.SendSignalPacket(writer, participantPacket); err != nil {
+						gossip_common.Err("Failed to send participant packet to %s: %v", clientID, err)
+						continue
+					}
+					if debugLogging {
+						gossip_common.Dbg("Sent participant %s to %s", participant, clientID)
 					}
 				}
 			}
 
-		case "offer":
+		case "call_ping": // call heartbeat
+			if !touchCall(packet.Destination, clientID) {
+				// Tell the client the call no longer has them in it
+				endedPacket := gossip_common.NewSignalPacketFromData("call_ended", clientID, "", []byte(packet.Destination))
+				if err := gossip_common.SendSignalPacket(writer, endedPacket); err != nil {
+					gossip_common.Err("Failed to send call_ended packet to %s: %v", clientID, err)
+				}
+			}
 
-			destination := packet.Destination
-			offerWriter := bufio.NewWriter(connections[destination])
-			offer := packet.Payload
+		case "lsc": // list active calls
+			sendActiveCalls(clientID)
 
-			offerPacket := gossip_common.NewSignalPacketFromData("offer", destination, packet.Sender, offer)
-			if err := gossip_common.SendSignalPacket(offerWriter, offerPacket); err != nil {
-				gossip_common.Err("Failed to send offer packet to %s: %v", destination, err)
+		case "call_state":
+			// Share a participant's mute and deafen state with the rest of the call
+			callID := packet.Destination
+			if !isCallParticipant(callID, clientID) {
+				gossip_common.Err("Rejected call_state from %s: not in call %s", clientID, callID)
 				continue
 			}
-			if debugLogging {
-				gossip_common.Dbg("Relayed offer from %s to %s", packet.Sender, destination)
-			}
+			broadcastToCall(callID, clientID, "call_state", clientID, packet.Payload)
 
-		case "answer":
-			destination := packet.Destination
-			answerWriter := bufio.NewWriter(connections[destination])
-			answer := packet.Payload
+		case "offer", "answer", "ice", "ckey", "cack":
+			relaySignalPacket(packet.OpCmd, clientID, packet.Destination, packet.Payload)
 
-			answerPacket := gossip_common.NewSignalPacketFromData("answer", destination, packet.Sender, answer)
-			if err := gossip_common.SendSignalPacket(answerWriter, answerPacket); err != nil {
-				gossip_common.Err("Failed to send answer packet to %s: %v", destination, err)
-				continue
-			}
-			if debugLogging {
-				gossip_common.Dbg("Relayed answer from %s to %s", packet.Sender, destination)
-			}
+		case "invite":
+			handleInvite(clientID, packet.Payload)
 
-		case "ice":
-			destination := packet.Destination
-			iceWriter := bufio.NewWriter(connections[destination])
-			candidate := packet.Payload
+		case "accept":
+			answerInvite(clientID, string(packet.Payload), true)
 
-			icePacket := gossip_common.NewSignalPacketFromData("ice", destination, packet.Sender, candidate)
-			if err := gossip_common.SendSignalPacket(iceWriter, icePacket); err != nil {
-				gossip_common.Err("Failed to send ice packet to %s: %v", destination, err)
-				continue
-			}
-			if debugLogging {
-				gossip_common.Dbg("Relayed ice from %s to %s", packet.Sender, destination)
-			}
+		case "decline":
+			answerInvite(clientID, string(packet.Payload), false)
 
 		case "hang-up":
 			/**
-			 * Handle hang-up signal by removing the sender from the call participants list.
+			 * Handle hang-up signal by removing the sender from the call participants list
+			 * and telling everyone still in the call.
 			 * @param packet The received signal packet containing the call ID in the payload.
 			 */
 			callID := string(packet.Payload)
-			sender := packet.Sender
-
-			// Lock the calls map to safely update
-			activeCallsLock.Lock()
-			if participants, ok := activeCalls[callID]; ok {
-				// Remove the sender from the call participants list
-				newParticipants := []string{}
-				for _, participant := range participants {
-					if participant != sender {
-						newParticipants = append(newParticipants, participant)
-					}
-				}
-				// Update the call participants in the map
-				if len(newParticipants) > 0 {
-					activeCalls[callID] = newParticipants
-				} else {
-					// If no participants left, delete the call entry
-					delete(activeCalls, callID)
-				}
-			}
-			activeCallsLock.Unlock()
+			sender := clientID
+
+			leaveCall(callID, sender)
 
 			if debugLogging {
 				gossip_common.Dbg("Handled hang-up from %s for call %s", sender, callID)
 			}
 
 		case "urgstr":
-
-			if clientID != "" {
-				connectionsLock.Lock()
-				delete(connections, clientID)
-				delete(publicKeys, clientID)
-				connectionsLock.Unlock()
-				if connectionLogging {
-					gossip_common.Conn("Client %s unregistered", clientID)
-				}
-				sendRMKPackets(clientID)
+			unregisterClient(clientID)
+			if connectionLogging {
+				gossip_common.Conn("Client %s unregistered", clientID)
 			}
 
+			// The connection is anonymous again until it greets and logs in anew
+			clientID = ""
+			authenticated = false
+			challenge = ""
+			clientPublicKey = nil
+
 		}
 
 	}
@@ -358,11 +421,28 @@ func handleConnection(conn net.Conn) {
 	}
 }
 
+/**
+ * unregisterClient removes a logged in client and its stream session key, tells the other
+ * clients it left and takes it out of every call.
+ * @param clientID The client to unregister.
+ */
+func unregisterClient(clientID string) {
+	connectionsLock.Lock()
+	delete(connections, clientID)
+	delete(publicKeys, clientID)
+	delete(streamCiphers, clientID)
+	connectionsLock.Unlock()
+
+	sendRMKPackets(clientID)
+	leaveAllCalls(clientID)
+}
+
 /**
  * handleDataPacket accepts a message, deserializes it, and forwards it to all recipients.
+ * @param clientID The authenticated client the message came from.
  * @param message The message to be forwarded.
  */
-func handleDataPacket(message []byte) {
+func handleDataPacket(clientID string, message []byte) {
 
 	// Decode the base64 packet
 	decodedPacket, err := base64.StdEncoding.DecodeString(string(message))
@@ -387,64 +467,102 @@ func handleDataPacket(message []byte) {
 		return
 	}
 
-	for id, conn := range connections {
-		writer := bufio.NewWriter(conn)
+	// The sender is always the authenticated connection the packet arrived on
+	dataPacket.Sender = clientID
+
+	// Pairwise packets addressed to a single client are only forwarded to that client,
+	// anything else goes to everyone. Copy the targets so no write happens under the lock.
+	type dataTarget struct {
+		conn      net.Conn
+		publicKey []byte
+	}
+	connectionsLock.RLock()
+	targets := []dataTarget{}
+	conn, pairwise := connections[dataPacket.Destination]
+	if pairwise {
+		targets = append(targets, dataTarget{conn, publicKeys[dataPacket.Destination]})
+	} else {
+		for id, conn := range connections {
+			targets = append(targets, dataTarget{conn, publicKeys[id]})
+		}
+	}
+	connectionsLock.RUnlock()
+
+	for _, target := range targets {
+		writer := bufio.NewWriter(target.conn)
 		// Reserialize and send the packet using SendDataPacket
-		if err := gossip_common.SendDataPacket(writer, *dataPacket, publicKeys[id]); err != nil {
+		if err := gossip_common.SendDataPacket(writer, *dataPacket, target.publicKey); err != nil {
 			if debugLogging {
 				gossip_common.Err("Failed to forward message: %v", err)
 			}
-			continue
 		}
 	}
-
-	if debugLogging {
+	if debugLogging && !pairwise {
 		gossip_common.Dbg("Message forwarded to all clients")
 	}
 }
 
 /**
  * handleStreamPacket accepts a message, deserializes it, and forwards it to specific recipients noted in the packet.
+ * The packet's destination is a call the sender is in; it is forwarded only to participants of that call,
+ * or to all of them but the sender when no recipients are listed. Packets are sealed with the session
+ * key of the connection they travel on; the payload inside is end-to-end encrypted with the sender's
+ * call key, so the server forwards it as it is.
+ * @param clientID The authenticated client the message came from.
  * @param message The message to be forwarded.
  */
-func handleStreamPacket(message []byte) {
-	// Decode the base64 packet
-	decodedPacket, err := base64.StdEncoding.DecodeString(string(message))
-	if err != nil {
+func handleStreamPacket(clientID string, message []byte) {
+	connectionsLock.RLock()
+	cipher := streamCiphers[clientID]
+	connectionsLock.RUnlock()
+	if cipher == nil {
 		if debugLogging {
-			gossip_common.Err("Failed to decode base64 GMStreamPacket: %v", err)
+			gossip_common.Dbg("Dropped stream packet from %s, who has not sent a session key", clientID)
 		}
 		return
 	}
 
-	// Decrypt the packet before deserializing
-	decryptedPacket, err := gossip_common.GWDecrypt(decodedPacket)
+	streamPacket, err := gossip_common.ReadStreamPacket(string(message), cipher)
 	if err != nil {
 		if debugLogging {
-			gossip_common.Err("Failed to decrypt GMStreamPacket: %v", err)
+			gossip_common.Err("Failed to read GMStreamPacket: %v", err)
 		}
 		return
 	}
 
-	// Deserialize the message into a GMStreamPacket
-	streamPacket, err := gossip_common.DeserializeGMStreamPacket(string(decryptedPacket))
-	if err != nil {
+	// The sender is always the authenticated connection the packet arrived on
+	streamPacket.Sender = clientID
+
+	// Stream packets only travel between participants of the same call
+	callID := streamPacket.Destination
+	if !isCallParticipant(callID, clientID) {
 		if debugLogging {
-			gossip_common.Err("Failed to deserialize GMStreamPacket: %v", err)
+			gossip_common.Dbg("Dropped stream packet from %s for a call they are not in", clientID)
 		}
 		return
 	}
+	recipients := streamPacket.Recipients
+	if len(recipients) == 0 {
+		recipients = callParticipants(callID)
+	}
 
 	// Forward the packet only to the recipients listed in the packet
-	for _, recipientID := range streamPacket.Recipients {
+	for _, recipientID := range recipients {
+		if recipientID == clientID || !isCallParticipant(callID, recipientID) {
+			continue
+		}
+
+		connectionsLock.RLock()
 		conn, exists := connections[recipientID]
-		if !exists {
+		recipientCipher := streamCiphers[recipientID]
+		connectionsLock.RUnlock()
+		if !exists || recipientCipher == nil {
 			continue
 		}
 
 		writer := bufio.NewWriter(conn)
-		// Reserialize and send the packet using SendDataPacket
-		if err := gossip_common.SendStreamPacket(writer, *streamPacket, publicKeys[recipientID]); err != nil {
+		// Reseal the packet with the recipient's session key
+		if err := gossip_common.SendStreamPacket(writer, *streamPacket, recipientCipher); err != nil {
 			continue
 		}
 	}
@@ -454,6 +572,58 @@ func handleStreamPacket(message []byte) {
 	}
 }
 
+// sendForbidden tells a client that its greeting or login proof was rejected.
+func sendForbidden(writer *bufio.Writer, clientID string) {
+	responsePacket := gossip_common.NewSignalPacketFromData("403", clientID, "", []byte(""))
+	if err := gossip_common.SendSignalPacket(writer, responsePacket); err != nil {
+		gossip_common.Err("Failed to send 403 packet to %s: %v", clientID, err)
+	}
+}
+
+// sendConflict tells a client that its client ID is already registered.
+func sendConflict(writer *bufio.Writer, clientID string) {
+	responsePacket := gossip_common.NewSignalPacketFromData("409", clientID, "", []byte(""))
+	if err := gossip_common.SendSignalPacket(writer, responsePacket); err != nil {
+		gossip_common.Err("Failed to send 409 packet to %s: %v", clientID, err)
+	}
+}
+
+/**
+ * relaySignalPacket forwards a peer-to-peer signaling packet to its destination,
+ * stamping it with the authenticated sender.
+ * @param opCmd The operation command to relay.
+ * @param clientID The authenticated client the packet came from.
+ * @param destination The client the packet is addressed to.
+ * @param payload The payload, which the server does not read.
+ */
+func relaySignalPacket(opCmd string, clientID string, destination string, payload []byte) {
+	relayPacket := gossip_common.NewSignalPacketFromData(opCmd, destination, clientID, payload)
+	if err := sendSignalToClient(destination, relayPacket); err != nil {
+		gossip_common.Err("Failed to send %s packet to %s: %v", opCmd, destination, err)
+		return
+	}
+	if debugLogging {
+		gossip_common.Dbg("Relayed %s from %s to %s", opCmd, clientID, destination)
+	}
+}
+
+/**
+ * sendSignalToClient sends a signal packet over another client's connection.
+ * @param destination The client to send the packet to.
+ * @param packet The packet to send.
+ * @return error An error if the client is not connected or sending fails.
+ */
+func sendSignalToClient(destination string, packet gossip_common.GMSigPacket) error {
+	connectionsLock.RLock()
+	destConn, exists := connections[destination]
+	connectionsLock.RUnlock()
+	if !exists {
+		return fmt.Errorf("%s is not connected", destination)
+	}
+
+	return gossip_common.SendSignalPacket(bufio.NewWriter(destConn), packet)
+}
+
 func sendRMKPackets(clientID string) {
 	// Notify all clients that a client has unregistered
 	for id, conn := range connections {
@@ -4,11 +4,20 @@ go 1.22.1
 
 replace gossip_common => ../gossip-common
 
-require gossip_common v0.0.0-00010101000000-000000000000
+require (
+	github.com/pion/turn/v3 v3.0.2
+	gossip_common v0.0.0-00010101000000-000000000000
+)
 
 require (
 	github.com/ProtonMail/go-crypto v1.0.0 // indirect
 	github.com/cloudflare/circl v1.3.3 // indirect
+	github.com/pion/dtls/v2 v2.2.7 // indirect
+	github.com/pion/logging v0.2.2 // indirect
+	github.com/pion/randutil v0.1.0 // indirect
+	github.com/pion/stun/v2 v2.0.0 // indirect
+	github.com/pion/transport/v2 v2.2.1 // indirect
+	github.com/pion/transport/v3 v3.0.2 // indirect
 	golang.org/x/crypto v0.22.0 // indirect
 	golang.org/x/sys v0.19.0 // indirect
 	golang.org/x/term v0.19.0 // indirect
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"path/filepath"
+
+	"gossip_common"
+)
+
+var iceServers []gossip_common.ICEServer // STUN and TURN servers pushed to clients at login
+
+// loadICEServers reads the ICE servers clients should use from gossip_ice.json, if it exists.
+func loadICEServers() {
+	iceFilePath := filepath.Join(os.TempDir(), "gossip_ice.json")
+
+	data, err := os.ReadFile(iceFilePath)
+	if os.IsNotExist(err) {
+		return
+	}
+	if err != nil {
+		gossip_common.Err("Failed to read ICE servers file: %v", err)
+		return
+	}
+
+	if err := json.Unmarshal(data, &iceServers); err != nil {
+		gossip_common.Err("Failed to parse ICE servers file: %v", err)
+		iceServers = nil
+		return
+	}
+	gossip_common.Log("Found gossip_ice.json, pushing %d ICE server(s) to clients", len(iceServers))
+}
+
+/**
+ * sendICEServers pushes the configured ICE servers, and fresh credentials for the embedded
+ * relay, to a client that logged in or is starting a call. The list is encrypted for the
+ * client since it holds TURN credentials.
+ * @param writer The client's connection writer.
+ * @param clientID The client to send the list to.
+ * @param clientPublicKey The client's public key.
+ * @return error Error if the packet could not be built or sent.
+ */
+func sendICEServers(writer *bufio.Writer, clientID string, clientPublicKey []byte) error {
+	servers := iceServers
+	if relay, ok := turnICEServer(clientID); ok {
+		servers = append([]gossip_common.ICEServer{relay}, iceServers...)
+	}
+	if len(servers) == 0 {
+		return nil
+	}
+
+	payload, err := json.Marshal(servers)
+	if err != nil {
+		return err
+	}
+	encrypted, err := gossip_common.GWEncrypt(payload, clientPublicKey)
+	if err != nil {
+		return err
+	}
+	icePacket := gossip_common.NewSignalPacketFromData("ice_servers", clientID, "", encrypted)
+	return gossip_common.SendSignalPacket(writer, icePacket)
+}
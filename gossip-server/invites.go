@@ -0,0 +1,173 @@
+package main
+
+import (
+	"encoding/json"
+	"sync"
+	"time"
+
+	"gossip_common"
+)
+
+const inviteTimeout = 30 * time.Second // How long an invitee is rung before the call counts as missed
+
+// callInvite is an outstanding invitation for one client to join a call.
+type callInvite struct {
+	callID  string
+	inviter string
+	invitee string
+	timer   *time.Timer
+}
+
+var pendingInvites = make(map[string]map[string]*callInvite) // Invitations by call ID and invitee
+var pendingInvitesLock = sync.Mutex{}
+
+/**
+ * handleInvite rings every invitee of a call the inviter is taking part in.
+ * @param clientID The authenticated client sending the invitation.
+ * @param payload The JSON encoded gossip_common.CallInvite.
+ */
+func handleInvite(clientID string, payload []byte) {
+	var invite gossip_common.CallInvite
+	if err := json.Unmarshal(payload, &invite); err != nil {
+		gossip_common.Err("Failed to unmarshal invite from %s: %v", clientID, err)
+		return
+	}
+
+	if !isCallParticipant(invite.CallID, clientID) {
+		gossip_common.Err("Rejected invite from %s: not in call %s", clientID, invite.CallID)
+		return
+	}
+
+	for _, invitee := range invite.Invitees {
+		if invitee == clientID || isCallParticipant(invite.CallID, invitee) {
+			continue
+		}
+
+		pendingInvitesLock.Lock()
+		if pendingInvites[invite.CallID] == nil {
+			pendingInvites[invite.CallID] = make(map[string]*callInvite)
+		}
+		if _, ringing := pendingInvites[invite.CallID][invitee]; ringing {
+			pendingInvitesLock.Unlock()
+			continue
+		}
+		pending := &callInvite{callID: invite.CallID, inviter: clientID, invitee: invitee}
+		pendingInvites[invite.CallID][invitee] = pending
+		pending.timer = time.AfterFunc(inviteTimeout, func() { expireInvite(pending) })
+		pendingInvitesLock.Unlock()
+
+		ringPacket := gossip_common.NewSignalPacketFromData("ring", invitee, clientID, []byte(invite.CallID))
+		if err := sendSignalToClient(invitee, ringPacket); err != nil {
+			gossip_common.Err("Failed to ring %s: %v", invitee, err)
+			takeInvite(invite.CallID, invitee)
+			missedPacket := gossip_common.NewSignalPacketFromData("invite_missed", clientID, invitee, []byte(invite.CallID))
+			sendSignalToClient(clientID, missedPacket)
+			continue
+		}
+
+		if debugLogging {
+			gossip_common.Dbg("%s is ringing %s for call %s", clientID, invitee, invite.CallID)
+		}
+	}
+}
+
+/**
+ * answerInvite resolves a pending invitation and tells the inviter whether it was accepted.
+ * @param clientID The invitee answering the call.
+ * @param callID The call being answered.
+ * @param accepted Whether the invitee accepted.
+ */
+func answerInvite(clientID string, callID string, accepted bool) {
+	pending := takeInvite(callID, clientID)
+	if pending == nil {
+		gossip_common.Err("No pending invite to %s for %s", callID, clientID)
+		return
+	}
+
+	opCmd := "invite_declined"
+	if accepted {
+		opCmd = "invite_accepted"
+	}
+
+	answerPacket := gossip_common.NewSignalPacketFromData(opCmd, pending.inviter, clientID, []byte(callID))
+	if err := sendSignalToClient(pending.inviter, answerPacket); err != nil {
+		gossip_common.Err("Failed to send %s to %s: %v", opCmd, pending.inviter, err)
+	}
+
+	if debugLogging {
+		gossip_common.Dbg("%s answered invite to %s: %s", clientID, callID, opCmd)
+	}
+}
+
+// expireInvite reports an unanswered invitation as missed to both sides.
+func expireInvite(pending *callInvite) {
+	if takeInvite(pending.callID, pending.invitee) != pending {
+		return
+	}
+
+	missedPacket := gossip_common.NewSignalPacketFromData("invite_missed", pending.inviter, pending.invitee, []byte(pending.callID))
+	sendSignalToClient(pending.inviter, missedPacket)
+
+	callMissedPacket := gossip_common.NewSignalPacketFromData("call_missed", pending.invitee, pending.inviter, []byte(pending.callID))
+	sendSignalToClient(pending.invitee, callMissedPacket)
+
+	if debugLogging {
+		gossip_common.Dbg("Invite for %s to %s expired", pending.invitee, pending.callID)
+	}
+}
+
+/**
+ * cancelInvites stops ringing everyone invited to a call that has ended.
+ * @param callID The call that ended.
+ */
+func cancelInvites(callID string) {
+	pendingInvitesLock.Lock()
+	invites := pendingInvites[callID]
+	delete(pendingInvites, callID)
+	pendingInvitesLock.Unlock()
+
+	for invitee, pending := range invites {
+		pending.timer.Stop()
+		cancelPacket := gossip_common.NewSignalPacketFromData("ring_cancel", invitee, pending.inviter, []byte(callID))
+		sendSignalToClient(invitee, cancelPacket)
+	}
+}
+
+// takeInvite removes and returns a pending invitation, or nil if there is none.
+func takeInvite(callID string, invitee string) *callInvite {
+	pendingInvitesLock.Lock()
+	defer pendingInvitesLock.Unlock()
+
+	pending, exists := pendingInvites[callID][invitee]
+	if !exists {
+		return nil
+	}
+	pending.timer.Stop()
+	delete(pendingInvites[callID], invitee)
+	if len(pendingInvites[callID]) == 0 {
+		delete(pendingInvites, callID)
+	}
+	return pending
+}
+
+// isCallParticipant reports whether a client is currently in a call.
+func isCallParticipant(callID string, clientID string) bool {
+	activeCallsLock.RLock()
+	defer activeCallsLock.RUnlock()
+
+	call, ok := activeCalls[callID]
+	if !ok {
+		return false
+	}
+	_, exists := call.joined[clientID]
+	return exists
+}
+
+// hasPendingInvite reports whether a client is being rung for a call.
+func hasPendingInvite(callID string, clientID string) bool {
+	pendingInvitesLock.Lock()
+	defer pendingInvitesLock.Unlock()
+
+	_, exists := pendingInvites[callID][clientID]
+	return exists
+}
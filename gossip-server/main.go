@@ -21,11 +21,15 @@ var (
 	password          string
 	channels          []string
 	serverName        string
+	turnPort          int
+	turnPublicIP      string
+	turnAllowPrivate  bool
 )
 
 var (
 	connections     = make(map[string]net.Conn)
 	publicKeys      = make(map[string][]byte)
+	streamCiphers   = make(map[string]*gossip_common.StreamCipher) // Session keys of the clients that sent one, for stream packets
 	connectionsLock sync.RWMutex
 )
 
@@ -35,6 +39,9 @@ func init() {
 	flag.StringVar(&host, "h", "127.0.0.1", "IP to listen on")
 	flag.IntVar(&port, "p", 1720, "Port to listen on")
 	flag.StringVar(&password, "k", "anonymous", "Password for the server")
+	flag.IntVar(&turnPort, "t", 0, "Port for the embedded TURN/STUN relay, 0 to disable it")
+	flag.StringVar(&turnPublicIP, "r", "", "Public IP the TURN relay advertises, defaults to the listen IP")
+	flag.BoolVar(&turnAllowPrivate, "a", false, "Let the TURN relay reach private, CGNAT and ULA addresses, for LAN-only deployments")
 	flag.Parse()
 }
 
@@ -55,6 +62,10 @@ func main() {
 
 	compileChannels()
 	fetchName()
+	loadICEServers()
+	if err := startTURN(); err != nil {
+		gossip_common.Err("Embedded TURN relay disabled: %v", err)
+	}
 
 	gossip_common.GenerateKeys()
 
@@ -66,6 +77,7 @@ func main() {
 	}
 
 	gossip_common.Log("Listening on ws://%s", addr)
+	go expireStaleCalls()
 	boot(listener)
 }
 
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"strconv"
+	"time"
+
+	"gossip_common"
+
+	"github.com/pion/turn/v3"
+)
+
+const (
+	turnRealm         = "gossip"
+	turnCredentialTTL = 12 * time.Hour // How long credentials issued to a client stay valid, long enough for a call
+)
+
+var (
+	turnServer  *turn.Server
+	turnSecret  string // Signs the credentials issued to clients, regenerated on every start
+	turnRelayIP net.IP // Address the relay allocates on, which relayed peers may always reach
+
+	cgnatNetwork = &net.IPNet{IP: net.IPv4(100, 64, 0, 0), Mask: net.CIDRMask(10, 32)} // RFC 6598 shared address space
+)
+
+/**
+ * startTURN runs the embedded TURN/STUN server on UDP and TCP turnPort when it is enabled.
+ * Clients authenticate with time-limited credentials issued over the signaling connection.
+ * @return error Error if the server could not listen.
+ */
+func startTURN() error {
+	if turnPort == 0 {
+		return nil
+	}
+
+	relayIP := net.ParseIP(turnPublicIP)
+	if relayIP == nil {
+		relayIP = net.ParseIP(host)
+	}
+	if relayIP == nil || relayIP.IsUnspecified() {
+		return fmt.Errorf("set the TURN relay address with -r, %q cannot be advertised to clients", host)
+	}
+
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return fmt.Errorf("failed to generate TURN secret: %w", err)
+	}
+	turnSecret = hex.EncodeToString(secret)
+	turnRelayIP = relayIP
+
+	addr := net.JoinHostPort(host, strconv.Itoa(turnPort))
+	udpListener, err := net.ListenPacket("udp4", addr)
+	if err != nil {
+		return fmt.Errorf("failed to listen for TURN on udp %s: %w", addr, err)
+	}
+	tcpListener, err := net.Listen("tcp4", addr)
+	if err != nil {
+		udpListener.Close()
+		return fmt.Errorf("failed to listen for TURN on tcp %s: %w", addr, err)
+	}
+
+	relayGenerator := func() turn.RelayAddressGenerator {
+		return &turn.RelayAddressGeneratorStatic{RelayAddress: relayIP, Address: host}
+	}
+	turnServer, err = turn.NewServer(turn.ServerConfig{
+		Realm:       turnRealm,
+		AuthHandler: turn.LongTermTURNRESTAuthHandler(turnSecret, nil),
+		PacketConnConfigs: []turn.PacketConnConfig{{
+			PacketConn:            udpListener,
+			RelayAddressGenerator: relayGenerator(),
+			PermissionHandler:     turnPeerAllowed,
+		}},
+		ListenerConfigs: []turn.ListenerConfig{{
+			Listener:              tcpListener,
+			RelayAddressGenerator: relayGenerator(),
+			PermissionHandler:     turnPeerAllowed,
+		}},
+	})
+	if err != nil {
+		udpListener.Close()
+		tcpListener.Close()
+		return fmt.Errorf("failed to start TURN server: %w", err)
+	}
+
+	gossip_common.Log("TURN/STUN relay listening on %s, relaying from %s", addr, relayIP)
+	return nil
+}
+
+/**
+ * turnPeerAllowed keeps relays from reaching loopback, link-local and multicast addresses, and
+ * unless turnAllowPrivate is set, the private (RFC 1918), CGNAT and ULA networks the server may
+ * sit in. The relay's own address stays reachable so two relayed clients can reach each other.
+ * @param clientAddr The client asking for the permission.
+ * @param peerIP The address it wants to send to.
+ * @return bool True to grant the permission.
+ */
+func turnPeerAllowed(clientAddr net.Addr, peerIP net.IP) bool {
+	if peerIP.Equal(turnRelayIP) {
+		return true
+	}
+	if peerIP.IsLoopback() || peerIP.IsUnspecified() || peerIP.IsLinkLocalUnicast() || peerIP.IsMulticast() {
+		return false
+	}
+	return turnAllowPrivate || (!peerIP.IsPrivate() && !cgnatNetwork.Contains(peerIP))
+}
+
+/**
+ * turnICEServer issues a client credentials for the embedded relay, valid for turnCredentialTTL.
+ * @param clientID The client the credentials are for, recorded in the username.
+ * @return gossip_common.ICEServer The relay's STUN and TURN URLs with the credentials.
+ * @return bool False when the embedded relay is off.
+ */
+func turnICEServer(clientID string) (gossip_common.ICEServer, bool) {
+	if turnServer == nil {
+		return gossip_common.ICEServer{}, false
+	}
+
+	username, credential, err := turn.GenerateLongTermTURNRESTCredentials(turnSecret, clientID, turnCredentialTTL)
+	if err != nil {
+		gossip_common.Err("Failed to generate TURN credentials for %s: %v", clientID, err)
+		return gossip_common.ICEServer{}, false
+	}
+
+	relayIP := turnPublicIP
+	if net.ParseIP(relayIP) == nil {
+		relayIP = host
+	}
+	addr := net.JoinHostPort(relayIP, strconv.Itoa(turnPort))
+	return gossip_common.ICEServer{
+		URLs: []string{
+			"stun:" + addr,
+			"turn:" + addr + "?transport=udp",
+			"turn:" + addr + "?transport=tcp",
+		},
+		Username:   username,
+		Credential: credential,
+	}, true
+}